@@ -0,0 +1,113 @@
+package assets
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"io/ioutil"
+)
+
+// decodeAnimatedGif reads all frames of a gif image, it returns nil if the data is not a gif with more than one frame
+func decodeAnimatedGif(source io.Reader) (*gif.GIF, error) {
+	data, err := ioutil.ReadAll(source)
+	if err != nil {
+		return nil, err
+	}
+
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || format != "gif" {
+		return nil, err
+	}
+
+	gifImg, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(gifImg.Image) < 2 {
+		return nil, nil
+	}
+
+	return gifImg, nil
+}
+
+// transformGifFrames applies the transformation to each frame as it's visible in the animation,
+// frames are drawn over the canvas state left by the disposal of the previous frame, so the transformed frames
+// cover the whole canvas and keep delays and disposal methods of the source frames
+func transformGifFrames(gifImg *gif.GIF, transform func(image.Image) image.Image) *gif.GIF {
+	canvasBounds := image.Rect(0, 0, gifImg.Config.Width, gifImg.Config.Height)
+	if canvasBounds.Empty() {
+		// some encoders leave the logical screen size empty
+		for _, frame := range gifImg.Image {
+			canvasBounds = canvasBounds.Union(frame.Bounds())
+		}
+	}
+
+	canvas := image.NewNRGBA(canvasBounds)
+	result := &gif.GIF{
+		Image:           make([]*image.Paletted, 0, len(gifImg.Image)),
+		Delay:           gifImg.Delay,
+		Disposal:        gifImg.Disposal,
+		LoopCount:       gifImg.LoopCount,
+		BackgroundIndex: gifImg.BackgroundIndex,
+		Config:          gifImg.Config,
+	}
+
+	for i, frame := range gifImg.Image {
+		disposal := byte(0)
+		if i < len(gifImg.Disposal) {
+			disposal = gifImg.Disposal[i]
+		}
+
+		var previousCanvas *image.NRGBA
+		if disposal == gif.DisposalPrevious {
+			previousCanvas = image.NewNRGBA(canvasBounds)
+			draw.Draw(previousCanvas, canvasBounds, canvas, canvasBounds.Min, draw.Src)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		transformedFrame := transform(canvas)
+		transformedBounds := transformedFrame.Bounds()
+		palettedFrame := image.NewPaletted(
+			image.Rect(0, 0, transformedBounds.Dx(), transformedBounds.Dy()),
+			withTransparentColor(frame.Palette),
+		)
+		draw.Draw(palettedFrame, palettedFrame.Bounds(), transformedFrame, transformedBounds.Min, draw.Src)
+		result.Image = append(result.Image, palettedFrame)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previousCanvas
+		}
+	}
+
+	result.Config.Width = result.Image[0].Bounds().Dx()
+	result.Config.Height = result.Image[0].Bounds().Dy()
+
+	return result
+}
+
+// withTransparentColor makes sure that transparent canvas areas, which were not covered by the source frame, stay transparent
+func withTransparentColor(palette color.Palette) color.Palette {
+	const maxPaletteSize = 256
+	for _, c := range palette {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return palette
+		}
+	}
+
+	if len(palette) >= maxPaletteSize {
+		return palette
+	}
+
+	extendedPalette := make(color.Palette, len(palette), len(palette)+1)
+	copy(extendedPalette, palette)
+
+	return append(extendedPalette, color.Transparent)
+}
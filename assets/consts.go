@@ -1,3 +1,15 @@
 package assets
 
-const SupportedImageFormats = "jpg|jpeg|png|gif"
+const SupportedImageFormats = "jpg|jpeg|png|gif|webp|bmp|tiff|tif"
+
+// supportedMimeTypes lists mime types of images which can be uploaded
+var supportedMimeTypes = map[string]bool{
+	"image/jpeg":     true,
+	"image/jpg":      true,
+	"image/png":      true,
+	"image/gif":      true,
+	"image/webp":     true,
+	"image/bmp":      true,
+	"image/x-ms-bmp": true,
+	"image/tiff":     true,
+}
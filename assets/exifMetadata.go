@@ -0,0 +1,314 @@
+package assets
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	MetadataPolicyStrip    = "strip"
+	MetadataPolicyKeep     = "keep"
+	MetadataPolicyStripGPS = "strip_gps"
+)
+
+const (
+	jpegMarkerPrefix = 0xFF
+	jpegMarkerSOI    = 0xD8
+	jpegMarkerEOI    = 0xD9
+	jpegMarkerSOS    = 0xDA
+	jpegMarkerAPP1   = 0xE1
+
+	exifTagMake             = 0x010F
+	exifTagModel            = 0x0110
+	exifTagOrientation      = 0x0112
+	exifTagExposureTime     = 0x829A
+	exifTagFNumber          = 0x829D
+	exifTagExifIFDOffset    = 0x8769
+	exifTagISOSpeedRatings  = 0x8827
+	exifTagGPSIFDOffset     = 0x8825
+	exifTagDateTimeOriginal = 0x9003
+	exifTagFocalLength      = 0x920A
+	exifTagLensModel        = 0xA434
+
+	exifTypeASCII     = 2
+	exifTypeShort     = 3
+	exifTypeLong      = 4
+	exifTypeRational  = 5
+	exifTypeSRational = 10
+
+	exifIFDEntrySize   = 12
+	tiffHeaderSize     = 8
+	maxInlineValueSize = 4
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// exifTypeSizes gives byte sizes of tiff field types by their ids
+var exifTypeSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// exifMetaTags lists exif tags exposed by the meta endpoint by their keys, gps data is never exposed
+var exifMetaTags = map[string]uint16{
+	"make":               exifTagMake,
+	"model":              exifTagModel,
+	"lens_model":         exifTagLensModel,
+	"date_time_original": exifTagDateTimeOriginal,
+	"exposure_time":      exifTagExposureTime,
+	"f_number":           exifTagFNumber,
+	"iso":                exifTagISOSpeedRatings,
+	"focal_length":       exifTagFocalLength,
+	"orientation":        exifTagOrientation,
+}
+
+// readJpegExif gives the payload of the jpeg APP1 segment with exif data or nil if the image has none
+func readJpegExif(source io.Reader) []byte {
+	reader := bufio.NewReader(source)
+	marker := make([]byte, 2)
+	_, err := io.ReadFull(reader, marker)
+	if err != nil || marker[0] != jpegMarkerPrefix || marker[1] != jpegMarkerSOI {
+		return nil
+	}
+
+	for {
+		_, err = io.ReadFull(reader, marker)
+		if err != nil || marker[0] != jpegMarkerPrefix || marker[1] == jpegMarkerSOS || marker[1] == jpegMarkerEOI {
+			return nil
+		}
+
+		segmentLength := make([]byte, 2)
+		_, err = io.ReadFull(reader, segmentLength)
+		if err != nil {
+			return nil
+		}
+
+		payloadLength := int(binary.BigEndian.Uint16(segmentLength)) - len(segmentLength)
+		if payloadLength < 0 {
+			return nil
+		}
+
+		payload := make([]byte, payloadLength)
+		_, err = io.ReadFull(reader, payload)
+		if err != nil {
+			return nil
+		}
+
+		if marker[1] == jpegMarkerAPP1 && bytes.HasPrefix(payload, exifHeader) {
+			return payload
+		}
+	}
+}
+
+// sanitizeExif resets the orientation, since uploaded images are stored already rotated, and wipes the gps data if needed,
+// nil is returned for malformed exif data, so that nothing is kept which couldn't be checked
+func sanitizeExif(payload []byte, stripGPS bool) []byte {
+	tiff := make([]byte, len(payload)-len(exifHeader))
+	copy(tiff, payload[len(exifHeader):])
+
+	byteOrder, ok := readTiffByteOrder(tiff)
+	if !ok {
+		return nil
+	}
+
+	entries, ok := readIFDEntries(tiff, byteOrder.Uint32(tiff[4:8]), byteOrder)
+	if !ok {
+		return nil
+	}
+
+	for _, entry := range entries {
+		switch byteOrder.Uint16(entry[0:2]) {
+		case exifTagOrientation:
+			byteOrder.PutUint16(entry[8:10], 1)
+		case exifTagGPSIFDOffset:
+			if stripGPS && !wipeIFD(tiff, byteOrder.Uint32(entry[8:12]), byteOrder) {
+				return nil
+			}
+		}
+	}
+
+	return append(append([]byte{}, exifHeader...), tiff...)
+}
+
+// readExifFields gives the values of the tags found in the main and the exif directories formatted as strings,
+// false is returned for malformed exif data
+func readExifFields(payload []byte, tags map[string]uint16) (map[string]string, bool) {
+	tiff := payload[len(exifHeader):]
+	byteOrder, ok := readTiffByteOrder(tiff)
+	if !ok {
+		return nil, false
+	}
+
+	entries, ok := readIFDEntries(tiff, byteOrder.Uint32(tiff[4:8]), byteOrder)
+	if !ok {
+		return nil, false
+	}
+
+	for _, entry := range entries {
+		if byteOrder.Uint16(entry[0:2]) != exifTagExifIFDOffset {
+			continue
+		}
+		exifEntries, ok := readIFDEntries(tiff, byteOrder.Uint32(entry[8:12]), byteOrder)
+		if !ok {
+			return nil, false
+		}
+		entries = append(entries, exifEntries...)
+		break
+	}
+
+	fields := map[string]string{}
+	for key, tag := range tags {
+		for _, entry := range entries {
+			if byteOrder.Uint16(entry[0:2]) != tag {
+				continue
+			}
+			if value, ok := formatExifValue(tiff, entry, byteOrder); ok {
+				fields[key] = value
+			}
+			break
+		}
+	}
+
+	return fields, true
+}
+
+// readExifOrientation gives the orientation tag of the exif data, 1 means the image isn't rotated
+func readExifOrientation(payload []byte) int {
+	fields, _ := readExifFields(payload, map[string]uint16{"orientation": exifTagOrientation})
+	orientation, err := strconv.Atoi(fields["orientation"])
+	if err != nil {
+		return 1
+	}
+
+	return orientation
+}
+
+// formatExifValue gives the first value of numeric fields and the whole value of text fields, false means
+// the field type isn't supported or the value is out of the data
+func formatExifValue(tiff []byte, entry []byte, byteOrder binary.ByteOrder) (string, bool) {
+	fieldType := byteOrder.Uint16(entry[2:4])
+	valueSize := uint64(exifTypeSizes[fieldType]) * uint64(byteOrder.Uint32(entry[4:8]))
+	if valueSize == 0 {
+		return "", false
+	}
+
+	value := entry[8:12]
+	if valueSize > maxInlineValueSize {
+		valueOffset := uint64(byteOrder.Uint32(entry[8:12]))
+		if valueOffset+valueSize > uint64(len(tiff)) {
+			return "", false
+		}
+		value = tiff[valueOffset : valueOffset+valueSize]
+	}
+
+	switch fieldType {
+	case exifTypeASCII:
+		return strings.Trim(string(value[:valueSize]), "\x00 "), true
+	case exifTypeShort:
+		return strconv.Itoa(int(byteOrder.Uint16(value[0:2]))), true
+	case exifTypeLong:
+		return strconv.FormatUint(uint64(byteOrder.Uint32(value[0:4])), 10), true
+	case exifTypeRational:
+		return fmt.Sprintf("%d/%d", byteOrder.Uint32(value[0:4]), byteOrder.Uint32(value[4:8])), true
+	case exifTypeSRational:
+		return fmt.Sprintf("%d/%d", int32(byteOrder.Uint32(value[0:4])), int32(byteOrder.Uint32(value[4:8]))), true
+	default:
+		return "", false
+	}
+}
+
+func readTiffByteOrder(tiff []byte) (binary.ByteOrder, bool) {
+	if len(tiff) < tiffHeaderSize {
+		return nil, false
+	}
+
+	switch string(tiff[:2]) {
+	case "II":
+		return binary.LittleEndian, true
+	case "MM":
+		return binary.BigEndian, true
+	default:
+		return nil, false
+	}
+}
+
+// readIFDEntries gives the entries of the directory as slices of the tiff data, so that they can be changed in place
+func readIFDEntries(tiff []byte, ifdOffset uint32, byteOrder binary.ByteOrder) ([][]byte, bool) {
+	entriesCount, ok := readIFDEntriesCount(tiff, ifdOffset, byteOrder)
+	if !ok {
+		return nil, false
+	}
+
+	entries := make([][]byte, 0, entriesCount)
+	for i := uint32(0); i < entriesCount; i++ {
+		entries = append(entries, tiff[ifdOffset+2+i*exifIFDEntrySize:ifdOffset+2+(i+1)*exifIFDEntrySize])
+	}
+
+	return entries, true
+}
+
+func readIFDEntriesCount(tiff []byte, ifdOffset uint32, byteOrder binary.ByteOrder) (uint32, bool) {
+	if uint64(ifdOffset)+2 > uint64(len(tiff)) {
+		return 0, false
+	}
+
+	entriesCount := uint32(byteOrder.Uint16(tiff[ifdOffset : ifdOffset+2]))
+	if uint64(ifdOffset)+2+uint64(entriesCount)*exifIFDEntrySize > uint64(len(tiff)) {
+		return 0, false
+	}
+
+	return entriesCount, true
+}
+
+// wipeIFD zeroes all entries of the directory together with their values and leaves it empty
+func wipeIFD(tiff []byte, ifdOffset uint32, byteOrder binary.ByteOrder) bool {
+	entries, ok := readIFDEntries(tiff, ifdOffset, byteOrder)
+	if !ok {
+		return false
+	}
+
+	for _, entry := range entries {
+		valueSize := uint64(exifTypeSizes[byteOrder.Uint16(entry[2:4])]) * uint64(byteOrder.Uint32(entry[4:8]))
+		if valueSize > maxInlineValueSize {
+			valueOffset := uint64(byteOrder.Uint32(entry[8:12]))
+			if valueOffset+valueSize > uint64(len(tiff)) {
+				return false
+			}
+			zeroBytes(tiff[valueOffset : valueOffset+valueSize])
+		}
+		zeroBytes(entry)
+	}
+
+	byteOrder.PutUint16(tiff[ifdOffset:ifdOffset+2], 0)
+
+	return true
+}
+
+func zeroBytes(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
+
+// writeJpegWithExif writes the encoded jpeg image with the exif payload as APP1 segment right after the SOI marker
+func writeJpegWithExif(targetFile io.Writer, encodedJpeg, exifPayload []byte) error {
+	const maxSegmentLength = 0xFFFF
+	if len(exifPayload)+2 > maxSegmentLength || len(encodedJpeg) < 2 {
+		_, err := targetFile.Write(encodedJpeg)
+		return err
+	}
+
+	segmentHeader := []byte{jpegMarkerPrefix, jpegMarkerAPP1, 0, 0}
+	binary.BigEndian.PutUint16(segmentHeader[2:], uint16(len(exifPayload)+2))
+
+	for _, part := range [][]byte{encodedJpeg[:2], segmentHeader, exifPayload, encodedJpeg[2:]} {
+		_, err := targetFile.Write(part)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
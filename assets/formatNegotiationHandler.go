@@ -0,0 +1,76 @@
+package assets
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/breathbath/go_utils/utils/env"
+)
+
+const webpMimeType = "image/webp"
+
+// FormatNegotiationHandler serves webp variants of resized images to clients which accept them,
+// requests with an explicitly requested output format are passed through unchanged
+type FormatNegotiationHandler struct {
+	isEnabled bool
+	presets   Presets
+	next      http.Handler
+}
+
+func NewFormatNegotiationHandler(presets Presets, next http.Handler) FormatNegotiationHandler {
+	return FormatNegotiationHandler{
+		isEnabled: env.ReadEnv("WEBP_ACCEPT_NEGOTIATION", "true") == "true",
+		presets:   presets,
+		next:      next,
+	}
+}
+
+func (fnh FormatNegotiationHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if !fnh.isEnabled || !isResizeRequestPath(r.URL.Path) {
+		fnh.next.ServeHTTP(rw, r)
+		return
+	}
+
+	// caches should keep separate variants per Accept header, since the same url gives different formats
+	rw.Header().Add("Vary", "Accept")
+
+	imagePath := parseImagePath(r.URL.Path, fnh.presets)
+	if !imagePath.IsValid || imagePath.OutputExt != "" || !isMimeTypeAccepted(r.Header.Get("Accept"), webpMimeType) {
+		fnh.next.ServeHTTP(rw, r)
+		return
+	}
+
+	negotiatedRequest := r.Clone(r.Context())
+	negotiatedRequest.URL.Path = r.URL.Path + "." + WebpExt
+	negotiatedRequest.URL.RawPath = ""
+
+	fnh.next.ServeHTTP(rw, negotiatedRequest)
+}
+
+// isMimeTypeAccepted tells if the Accept header explicitly lists the mime type with a non zero quality
+func isMimeTypeAccepted(acceptHeader, mimeType string) bool {
+	for _, mediaRange := range strings.Split(acceptHeader, ",") {
+		params := strings.Split(mediaRange, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), mimeType) {
+			continue
+		}
+
+		for _, param := range params[1:] {
+			paramParts := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			const expectedParamPartsCount = 2
+			if len(paramParts) != expectedParamPartsCount || strings.TrimSpace(paramParts[0]) != "q" {
+				continue
+			}
+
+			quality, err := strconv.ParseFloat(strings.TrimSpace(paramParts[1]), 64)
+			if err != nil || quality <= 0 {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
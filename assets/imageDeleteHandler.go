@@ -13,17 +13,15 @@ import (
 )
 
 type ImageDeleteHandler struct {
-	FileSystemManager filesystem.LocalFileSystemManager
+	FileSystemManager filesystem.Manager
 }
 
 func (idh ImageDeleteHandler) HandleDelete(rw http.ResponseWriter, r *http.Request) { //nolint:gocyclo
-	token := r.Context().Value(authentication.TokenContextKey)
-	if token == nil {
-		rw.WriteHeader(http.StatusForbidden)
+	vars := mux.Vars(r)
+	if !authentication.Authorize(rw, r, authentication.ScopeDelete, vars["folder"]) {
 		return
 	}
 
-	vars := mux.Vars(r)
 	folder, ok := vars["folder"]
 
 	if !ok {
@@ -42,7 +40,7 @@ func (idh ImageDeleteHandler) HandleDelete(rw http.ResponseWriter, r *http.Reque
 
 	proxyURL := env.ReadEnv("PROXY_URL", "")
 	imagePathRaw := folder + "/" + imageName
-	imagePath := parseImagePath(imagePathRaw)
+	imagePath := parseImagePath(imagePathRaw, nil)
 	if !imagePath.IsValid {
 		io.OutputError(fmt.Errorf("failed to parse image url %s", imagePathRaw), "", "")
 		rw.WriteHeader(http.StatusNotFound)
@@ -69,7 +67,7 @@ func (idh ImageDeleteHandler) HandleDelete(rw http.ResponseWriter, r *http.Reque
 		}
 	}
 
-	// removing resized folder e.g. /images/cache/resized_image/ldjfksljfas/someImage
+	// removing resized folder e.g. /images/cache/resized_image/ldjfksljfas/someImage.png
 	resizedFolderDeletionErr := idh.FileSystemManager.RemoveDir(imagePath, true, false)
 	if resizedFolderDeletionErr != nil && !idh.FileSystemManager.IsNonExistingPathError(resizedFolderDeletionErr) {
 		io.OutputError(resizedFolderDeletionErr, "", "Failed to delete resized folder for file '%s'", imagePath.ImageFile)
@@ -1,21 +1,116 @@
 package assets
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/breathbath/go_utils/utils/env"
 	io2 "github.com/breathbath/go_utils/utils/io"
 	"github.com/spf13/afero"
 )
 
-func DownloadFile(url, originalPath string) (http.File, error) {
-	var AppFs = afero.NewOsFs()
-	resp, err := http.Get(url) // nolint: gosec, noctx
+const (
+	defaultDownloadTimeoutSeconds = 30
+	defaultDownloadMaxRedirects   = 3
+)
+
+// blockedNetworks are special purpose ranges which are not covered by the net.IP checks of private addresses
+var blockedNetworks = parseNetworks(
+	"0.0.0.0/8",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"198.18.0.0/15",
+	"240.0.0.0/4",
+	"64:ff9b::/96",
+)
+
+var (
+	proxyDownloader     ImageDownloader
+	proxyDownloaderOnce = &sync.Once{}
+)
+
+// DownloadTooLargeError is returned if the remote file exceeds the size limit of the downloader
+type DownloadTooLargeError struct {
+	MaxBytes int64
+}
+
+func (dtle DownloadTooLargeError) Error() string {
+	return fmt.Sprintf("the remote file is larger than %d bytes", dtle.MaxBytes)
+}
+
+// DownloadStatusError is returned if the remote server responded with a non successful status
+type DownloadStatusError struct {
+	StatusCode int
+}
+
+func (dse DownloadStatusError) Error() string {
+	return fmt.Sprintf("the remote server responded with status %d", dse.StatusCode)
+}
+
+// ImageDownloader fetches remote files with a timeout, size and redirects limit, addresses of private networks
+// are refused at connection time, so that they can't be reached neither by DNS names nor by redirects
+type ImageDownloader struct {
+	client   *http.Client
+	maxBytes int64
+}
+
+// NewImageDownloader creates a downloader, timeout 0 means no timeout and maxBytes 0 means no size limit
+func NewImageDownloader(timeout time.Duration, maxRedirects int, maxBytes int64, allowPrivateNetworks bool) ImageDownloader {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivateNetworks {
+		dialer.Control = refusePrivateAddress
+	}
+
+	return ImageDownloader{
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: timeout,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > maxRedirects {
+					return fmt.Errorf("stopped after %d redirects", maxRedirects)
+				}
+				if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+					return fmt.Errorf("redirect to unsupported scheme '%s'", req.URL.Scheme)
+				}
+				return nil
+			},
+		},
+		maxBytes: maxBytes,
+	}
+}
+
+// Download writes the remote file to the target and gives its size
+func (id ImageDownloader) Download(ctx context.Context, rawURL string, target io.Writer) (int64, error) {
+	parsedURL, err := url.Parse(rawURL)
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" || parsedURL.Host == "" {
+		return 0, fmt.Errorf("unsupported url '%s', only absolute http and https urls are allowed", rawURL)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := id.client.Do(req)
+	if err != nil {
+		return 0, err
 	}
 
 	defer func() {
@@ -27,16 +122,96 @@ func DownloadFile(url, originalPath string) (http.File, error) {
 
 	if resp.StatusCode < 199 || resp.StatusCode > 299 {
 		var respBytes []byte
-		respBytes, err = httputil.DumpResponse(resp, true)
+		respBytes, err = httputil.DumpResponse(resp, false)
 		if err != nil {
 			io2.OutputError(err, "", "")
 		} else {
-			io2.OutputInfo("", "Proxy source returned response: %s", string(respBytes))
+			io2.OutputInfo("", "Remote source returned response: %s", string(respBytes))
 		}
-		return nil, &os.PathError{Op: "open", Path: originalPath, Err: os.ErrNotExist}
+		return 0, DownloadStatusError{StatusCode: resp.StatusCode}
 	}
 
-	err = AppFs.MkdirAll("/tmp", os.ModePerm)
+	if id.maxBytes <= 0 {
+		return io.Copy(target, resp.Body)
+	}
+
+	if resp.ContentLength > id.maxBytes {
+		return 0, DownloadTooLargeError{MaxBytes: id.maxBytes}
+	}
+
+	size, err := io.Copy(target, io.LimitReader(resp.Body, id.maxBytes+1))
+	if err != nil {
+		return size, err
+	}
+
+	if size > id.maxBytes {
+		return size, DownloadTooLargeError{MaxBytes: id.maxBytes}
+	}
+
+	return size, nil
+}
+
+func refusePrivateAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || isPrivateIP(ip) {
+		return fmt.Errorf("connection to the address %s is not allowed", host)
+	}
+
+	return nil
+}
+
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return true
+	}
+
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks
+}
+
+// getProxyDownloader gives the downloader of images from PROXY_URL, which is configured by the service owner
+// and can be in a private network, PROXY_TIMEOUT_SECONDS 0 means no timeout
+func getProxyDownloader() ImageDownloader {
+	proxyDownloaderOnce.Do(func() {
+		proxyDownloader = NewImageDownloader(
+			time.Duration(env.ReadEnvInt("PROXY_TIMEOUT_SECONDS", defaultDownloadTimeoutSeconds))*time.Second,
+			defaultDownloadMaxRedirects,
+			0,
+			true,
+		)
+	})
+
+	return proxyDownloader
+}
+
+func DownloadFile(url, originalPath string) (http.File, error) {
+	var AppFs = afero.NewOsFs()
+
+	err := AppFs.MkdirAll("/tmp", os.ModePerm)
 	if err != nil {
 		return nil, err
 	}
@@ -48,7 +223,19 @@ func DownloadFile(url, originalPath string) (http.File, error) {
 	}
 
 	// Write the body to file
-	_, err = io.Copy(targetFile, resp.Body)
+	_, err = getProxyDownloader().Download(context.Background(), url, targetFile)
+	if err != nil {
+		if e := targetFile.Close(); e != nil {
+			io2.OutputError(e, "", "")
+		}
+		if e := AppFs.Remove(targetFile.Name()); e != nil {
+			io2.OutputError(e, "", "")
+		}
+	}
+	var statusErr DownloadStatusError
+	if errors.As(err, &statusErr) {
+		return nil, &os.PathError{Op: "open", Path: originalPath, Err: os.ErrNotExist}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,38 @@
+package assets
+
+import (
+	"image"
+	"io"
+
+	"github.com/breathbath/media-library/filesystem"
+	"github.com/chai2010/webp"
+	"github.com/disintegration/imaging"
+)
+
+const WebpExt = "webp"
+
+// OutputFormats lists extensions which can be requested as output format of resized images
+const OutputFormats = "jpg|jpeg|png|gif|webp"
+
+func encodeImage(w io.Writer, img image.Image, imagePath *filesystem.ImagePath, defaultWebpQuality int) error {
+	ext := imagePath.GetResizedImageExt()
+	if ext == WebpExt {
+		quality := defaultWebpQuality
+		if imagePath.Quality > 0 {
+			quality = imagePath.Quality
+		}
+		return webp.Encode(w, img, &webp.Options{Quality: float32(quality)})
+	}
+
+	format, err := imaging.FormatFromExtension(ext)
+	if err != nil {
+		return err
+	}
+
+	encodeOptions := []imaging.EncodeOption{}
+	if imagePath.Quality > 0 {
+		encodeOptions = append(encodeOptions, imaging.JPEGQuality(imagePath.Quality))
+	}
+
+	return imaging.Encode(w, img, format, encodeOptions...)
+}
@@ -0,0 +1,61 @@
+package assets
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/breathbath/go_utils/utils/io"
+	"github.com/breathbath/media-library/filesystem"
+)
+
+// ImageFileServer serves images opened by ImageReadHandler like http.FileServer, but maps errors explicitly,
+// so that images over the pixel budget are refused with 422 instead of a generic status
+type ImageFileServer struct {
+	readHandler ImageReadHandler
+}
+
+func NewImageFileServer(readHandler ImageReadHandler) ImageFileServer {
+	return ImageFileServer{readHandler: readHandler}
+}
+
+func (ifs ImageFileServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	file, err := ifs.readHandler.Open(path.Clean("/" + strings.TrimLeft(r.URL.Path, "/")))
+	if err != nil {
+		ifs.writeError(rw, r, err)
+		return
+	}
+	defer func() {
+		e := file.Close()
+		if e != nil {
+			io.OutputError(e, "", "Failed to close file '%s'", r.URL.Path)
+		}
+	}()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		ifs.writeError(rw, r, err)
+		return
+	}
+	if fileInfo.IsDir() {
+		http.NotFound(rw, r)
+		return
+	}
+
+	http.ServeContent(rw, r, fileInfo.Name(), fileInfo.ModTime(), file)
+}
+
+func (ifs ImageFileServer) writeError(rw http.ResponseWriter, r *http.Request, err error) {
+	var imageTooLargeErr filesystem.ImageTooLargeError
+	switch {
+	case errors.As(err, &imageTooLargeErr):
+		http.Error(rw, "The image is too large to process", http.StatusUnprocessableEntity)
+	case errors.Is(err, os.ErrNotExist):
+		http.NotFound(rw, r)
+	default:
+		io.OutputError(err, "", "Failed to serve '%s'", r.URL.Path)
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
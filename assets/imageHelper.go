@@ -3,13 +3,16 @@ package assets
 import (
 	"path/filepath"
 	"regexp"
+	"strings"
 )
 
+// SanitizeImageName replaces unsafe characters of the name and lowercases the extension, since image urls
+// accept only lowercase extensions, e.g. IMG_1234.JPG of phones is saved as IMG_1234.jpg
 func SanitizeImageName(fullName string) string {
 	ext := filepath.Ext(fullName)
 	imageName := fullName[0 : len(fullName)-len(ext)]
 	r := regexp.MustCompile(`[^\w\-]`)
 	sanitizedImageName := r.ReplaceAllString(imageName, "_")
 
-	return sanitizedImageName + ext
+	return sanitizedImageName + strings.ToLower(ext)
 }
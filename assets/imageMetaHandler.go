@@ -0,0 +1,163 @@
+package assets
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/breathbath/go_utils/utils/io"
+	"github.com/breathbath/media-library/filesystem"
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gorilla/mux"
+)
+
+type ImageVariant struct {
+	Transformation string `json:"transformation"`
+	Format         string `json:"format"`
+	Path           string `json:"path"`
+}
+
+type ImageMeta struct {
+	Path     string            `json:"path"`
+	Width    int               `json:"width"`
+	Height   int               `json:"height"`
+	Size     int64             `json:"size"`
+	Mime     string            `json:"mime"`
+	Sha256   string            `json:"sha256"`
+	Created  time.Time         `json:"created"`
+	Variants []ImageVariant    `json:"variants"`
+	Exif     map[string]string `json:"exif,omitempty"`
+}
+
+type ImageMetaHandler struct {
+	FileSystemManager filesystem.Manager
+}
+
+func (imh ImageMetaHandler) HandleMeta(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	imagePathRaw := vars["folder"] + "/" + vars["image"]
+	imagePath := parseImagePath(imagePathRaw, nil)
+	if !imagePath.IsValid {
+		io.OutputWarning("", "Failed to parse image url %s", imagePathRaw)
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	imageMeta, err := imh.buildImageMeta(imagePath)
+	if err != nil {
+		if imh.FileSystemManager.IsNonExistingPathError(err) {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		io.OutputError(err, "", "Failed to read meta data of image '%s'", imagePathRaw)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(rw).Encode(imageMeta)
+	if err != nil {
+		io.OutputError(err, "", "Cannot send json data")
+	}
+}
+
+func (imh ImageMetaHandler) buildImageMeta(imagePath *filesystem.ImagePath) (*ImageMeta, error) {
+	file, err := imh.FileSystemManager.CreateFileReader(imagePath, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		e := file.Close()
+		if e != nil {
+			io.OutputError(e, "", "Failed to close file '%s'", imagePath.ImageFile)
+		}
+	}()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	imgConfig, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	variants, err := imh.buildVariants(imagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	detectedMime, _ := mimetype.Detect(data)
+	hash := sha256.Sum256(data)
+
+	return &ImageMeta{
+		Path:     imagePath.FolderName + "/" + imagePath.ImageFile,
+		Width:    imgConfig.Width,
+		Height:   imgConfig.Height,
+		Size:     int64(len(data)),
+		Mime:     detectedMime,
+		Sha256:   hex.EncodeToString(hash[:]),
+		Created:  fileInfo.ModTime().UTC(),
+		Variants: variants,
+		Exif:     readExifMetaFields(data),
+	}, nil
+}
+
+// buildVariants converts cached resized images to paths which can be requested to get them
+func (imh ImageMetaHandler) buildVariants(imagePath *filesystem.ImagePath) ([]ImageVariant, error) {
+	resizedImages, err := imh.FileSystemManager.ListResizedImages(imagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	variants := make([]ImageVariant, 0, len(resizedImages))
+	for _, resizedImage := range resizedImages {
+		format := strings.TrimPrefix(filepath.Ext(resizedImage), ".")
+		transformation := strings.TrimSuffix(resizedImage, filepath.Ext(resizedImage))
+
+		transformationSegment, imageFile := transformation, imagePath.ImageFile
+		switch {
+		case format == WebpExt && imagePath.ImageExt != WebpExt:
+			imageFile += "." + WebpExt
+		case format != imagePath.ImageExt:
+			transformationSegment += ",f_" + format
+		}
+
+		variants = append(variants, ImageVariant{
+			Transformation: transformation,
+			Format:         format,
+			Path:           fmt.Sprintf("%s/%s/%s", transformationSegment, imagePath.FolderName, imageFile),
+		})
+	}
+
+	return variants, nil
+}
+
+func readExifMetaFields(data []byte) map[string]string {
+	exifPayload := readJpegExif(bytes.NewReader(data))
+	if exifPayload == nil {
+		return nil
+	}
+
+	exifFields, ok := readExifFields(exifPayload, exifMetaTags)
+	if !ok {
+		io.OutputWarning("", "Failed to decode exif data")
+		return nil
+	}
+
+	return exifFields
+}
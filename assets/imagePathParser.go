@@ -2,11 +2,11 @@ package assets
 
 import (
 	"fmt"
+	"math"
 	"regexp"
 	"strconv"
 	"strings"
 
-	"github.com/breathbath/go_utils/utils/io"
 	"github.com/breathbath/media-library/filesystem"
 )
 
@@ -27,54 +27,158 @@ func parseImageName(imageFile string) (imageName, imageExt string) {
 	return
 }
 
-func extractSizes(path string) (width, height int) {
-	width, height = 0, 0
-
-	r := regexp.MustCompile(`(\d+x\d+)|(x\d+)|(\d+x)`)
-	matches := r.FindStringSubmatch(path)
+// extractSizes reads a legacy WIDTHxHEIGHT, WIDTHx or xHEIGHT segment, anything around the sizes makes it invalid,
+// so that arbitrary segments can't create separately cached copies of the same size
+func extractSizes(segment string) (width, height int) {
+	matches := regexp.MustCompile(`^(\d*)x(\d*)$`).FindStringSubmatch(segment)
 	if len(matches) == 0 {
-		return
+		return 0, 0
 	}
 
-	var e error
+	var isWidthValid, isHeightValid bool
 	if matches[1] != "" {
-		r = regexp.MustCompile(`(\d+)x(\d+)`)
-		matches2 := r.FindStringSubmatch(matches[1])
-
-		width, e = strconv.Atoi(matches2[1])
-		if e != nil {
-			io.OutputError(e, "", "")
+		width, isWidthValid = parsePositiveInt(matches[1], math.MaxInt32)
+		if !isWidthValid {
+			return 0, 0
 		}
+	}
 
-		height, e = strconv.Atoi(matches2[2])
-		if e != nil {
-			io.OutputError(e, "", "")
+	if matches[2] != "" {
+		height, isHeightValid = parsePositiveInt(matches[2], math.MaxInt32)
+		if !isHeightValid {
+			return 0, 0
 		}
+	}
 
-		return width, height
+	return width, height
+}
+
+// parseTransformation reads either a preset name, a legacy WIDTHxHEIGHT segment or a list of transformation params
+// like w_200,h_100,c_fit,q_70,bg_ffffff,g_north, see parseTransformationParams
+func parseTransformation(segment string, imagePath *filesystem.ImagePath, presets Presets) bool {
+	// presets are resolved to their params, so a changed preset gets a new cache key and previously cached variants aren't used
+	if presetTransformation, ok := presets[segment]; ok {
+		imagePath.PresetName = segment
+		return parseTransformationParams(presetTransformation, imagePath)
 	}
 
-	if matches[2] != "" {
-		r = regexp.MustCompile(`x(\d+)`)
-		matches2 := r.FindStringSubmatch(matches[2])
-		height, e = strconv.Atoi(matches2[1])
-		if e != nil {
-			io.OutputError(e, "", "")
+	if strings.Contains(segment, "_") {
+		return parseTransformationParams(segment, imagePath)
+	}
+
+	imagePath.Width, imagePath.Height = extractSizes(segment)
+	if imagePath.Width == 0 && imagePath.Height == 0 {
+		return false
+	}
+
+	// legacy sizes share the cached image with equivalent params, e.g. 200x100 and w_200,h_100
+	imagePath.Mode = ResizeModeFill
+	imagePath.Gravity = GravityCenter
+	imagePath.RawResizedFolder = buildTransformationKey(imagePath)
+
+	return true
+}
+
+// parseTransformationParams fills the transformation from comma separated key_value params, the resulting
+// RawResizedFolder is a canonical representation of the params, so that equivalent urls share the same cached image,
+// the output format isn't part of it, since it's reflected in the resized image extension
+func parseTransformationParams(segment string, imagePath *filesystem.ImagePath) bool { //nolint:gocyclo
+	imagePath.Mode = ResizeModeFill
+	imagePath.Gravity = GravityCenter
+
+	parsedKeys := map[string]bool{}
+	for _, param := range strings.Split(segment, ",") {
+		paramParts := strings.SplitN(param, "_", 2)
+		const expectedParamPartsCount = 2
+		if len(paramParts) != expectedParamPartsCount || paramParts[1] == "" || parsedKeys[paramParts[0]] {
+			return false
+		}
+		key, val := paramParts[0], paramParts[1]
+		parsedKeys[key] = true
+
+		var isValid bool
+		switch key {
+		case "w":
+			imagePath.Width, isValid = parsePositiveInt(val, math.MaxInt32)
+		case "h":
+			imagePath.Height, isValid = parsePositiveInt(val, math.MaxInt32)
+		case "q":
+			const maxQuality = 100
+			imagePath.Quality, isValid = parsePositiveInt(val, maxQuality)
+		case "c":
+			imagePath.Mode = val
+			isValid = val == ResizeModeFill || val == ResizeModeFit || val == ResizeModePad || val == ResizeModeCrop
+		case "bg":
+			imagePath.Background = strings.ToLower(val)
+			isValid = regexp.MustCompile(`^([0-9a-f]{6}|[0-9a-f]{8})$`).MatchString(imagePath.Background)
+		case "g":
+			imagePath.Gravity = val
+			_, isValid = gravityAnchors[val]
+		case "f":
+			isValid = regexp.MustCompile(fmt.Sprintf(`^(%s)$`, OutputFormats)).MatchString(val) &&
+				(imagePath.OutputExt == "" || imagePath.OutputExt == val)
+			imagePath.OutputExt = val
 		}
-		return width, height
+
+		if !isValid {
+			return false
+		}
+	}
+
+	if imagePath.Width == 0 && imagePath.Height == 0 {
+		return false
 	}
 
-	r = regexp.MustCompile(`(\d+)x`)
-	matches2 := r.FindStringSubmatch(matches[3])
-	width, e = strconv.Atoi(matches2[1])
-	if e != nil {
-		io.OutputError(e, "", "")
+	if imagePath.Mode == ResizeModePad && imagePath.Background == "" {
+		imagePath.Background = DefaultPadBackground
 	}
 
-	return width, height
+	imagePath.RawResizedFolder = buildTransformationKey(imagePath)
+
+	return true
+}
+
+func buildTransformationKey(imagePath *filesystem.ImagePath) string {
+	params := []string{}
+	if imagePath.Width > 0 {
+		params = append(params, "w_"+strconv.Itoa(imagePath.Width))
+	}
+	if imagePath.Height > 0 {
+		params = append(params, "h_"+strconv.Itoa(imagePath.Height))
+	}
+
+	params = append(params, "c_"+imagePath.Mode)
+
+	if imagePath.Quality > 0 {
+		params = append(params, "q_"+strconv.Itoa(imagePath.Quality))
+	}
+
+	if imagePath.Mode == ResizeModePad {
+		params = append(params, "bg_"+imagePath.Background)
+	}
+
+	// gravity has no effect when the whole image is fitted into the target sizes
+	if imagePath.Mode != ResizeModeFit && imagePath.Gravity != GravityCenter {
+		params = append(params, "g_"+imagePath.Gravity)
+	}
+
+	return strings.Join(params, ",")
 }
 
-func parseImagePath(path string) *filesystem.ImagePath {
+func parsePositiveInt(val string, maxVal int) (int, bool) {
+	if !regexp.MustCompile(`^\d+$`).MatchString(val) {
+		return 0, false
+	}
+
+	intVal, err := strconv.Atoi(val)
+	if err != nil || intVal <= 0 || intVal > maxVal {
+		return 0, false
+	}
+
+	return intVal, true
+}
+
+func parseImagePath(path string, presets Presets) *filesystem.ImagePath {
 	path = strings.Trim(path, "/")
 	pathItems := strings.Split(path, "/")
 	const expectedPathItemsCount = 2
@@ -103,26 +207,30 @@ func parseImagePath(path string) *filesystem.ImagePath {
 		return &filesystem.ImagePath{IsValid: false}
 	}
 
-	imageName, imageExt := parseImageName(pathItems[2])
+	// resized images can be requested in webp format by adding .webp to the image file, e.g. 200x200/folder/img.png.webp
+	imageFile := pathItems[2]
+	outputExt := ""
+	if trimmedImageFile := strings.TrimSuffix(imageFile, "."+WebpExt); trimmedImageFile != imageFile {
+		if trimmedImageName, _ := parseImageName(trimmedImageFile); trimmedImageName != "" {
+			imageFile = trimmedImageFile
+			outputExt = WebpExt
+		}
+	}
+
+	imageName, imageExt := parseImageName(imageFile)
 	if imageName == "" || imageExt == "" {
 		return &filesystem.ImagePath{IsValid: false}
 	}
 
 	imagePath := &filesystem.ImagePath{
 		FolderName: pathItems[1],
-		ImageFile:  pathItems[2],
+		ImageFile:  imageFile,
 		ImageName:  imageName,
 		ImageExt:   imageExt,
+		OutputExt:  outputExt,
 	}
 
-	imagePath.Width, imagePath.Height = extractSizes(pathItems[0])
-	if imagePath.Width == 0 && imagePath.Height == 0 {
-		imagePath.IsValid = false
-		return imagePath
-	}
-
-	imagePath.RawResizedFolder = pathItems[0]
-	imagePath.IsValid = true
+	imagePath.IsValid = parseTransformation(pathItems[0], imagePath, presets)
 
 	return imagePath
 }
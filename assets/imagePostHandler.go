@@ -1,11 +1,17 @@
 package assets
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	goio "io"
+	"io/ioutil"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/breathbath/media-library/authentication"
@@ -18,9 +24,74 @@ import (
 
 const SubmittedFileFieldName = "files[]"
 
+const (
+	bytesInMb = 1024 * 1024
+	// mimeSniffLength is the count of first bytes which the mime type is detected from
+	mimeSniffLength   = 2048
+	maxFormValueBytes = 4096
+)
+
+const (
+	UploadModeLegacy  = ""
+	UploadModePartial = "partial"
+	UploadModeAtomic  = "atomic"
+)
+
+// ViolationUploadFailure is given for files which couldn't be saved because of a server error
+const ViolationUploadFailure = "upload_failure"
+
+const (
+	UploadStatusSaved    = "saved"
+	UploadStatusRejected = "rejected"
+	UploadStatusFailed   = "failed"
+)
+
+// ResponseV2MimeType is accepted by clients which expect uploaded files described by UploadedImage objects
+const ResponseV2MimeType = "application/vnd.media-library.v2+json"
+
+// UploadFileStatus is the result of a single file in the partial upload mode response
+type UploadFileStatus struct {
+	Index            int                `json:"index"`
+	OriginalFilename string             `json:"original_filename"`
+	Status           string             `json:"status"`
+	StatusCode       int                `json:"status_code"`
+	Violations       []error2.Violation `json:"violations,omitempty"`
+	File             *UploadedImage     `json:"file,omitempty"`
+}
+
 type ImagePostHandler struct {
 	ImageSaver          ImageSaver
 	maxUploadFileSizeMb float64
+	maxUploadRequestMb  float64
+	uploadRules         UploadRules
+	uploadTokenManager  *authentication.UploadTokenManager
+	publicURL           string
+	urlPrefix           string
+}
+
+// UploadedImage is the description of a saved file in the v2 upload response
+type UploadedImage struct {
+	Path             string `json:"path"`
+	OriginalFilename string `json:"original_filename"`
+	Filename         string `json:"filename"`
+	Width            int    `json:"width"`
+	Height           int    `json:"height"`
+	Size             int64  `json:"size"`
+	Mime             string `json:"mime"`
+	Sha256           string `json:"sha256"`
+	URL              string `json:"url"`
+	MetaURL          string `json:"meta_url"`
+}
+
+// uploadedFile is a file part of the upload request, content is nil if the file was rejected while reading,
+// violations are rules failed while receiving the file, e.g. a remote file which couldn't be downloaded
+type uploadedFile struct {
+	originalFileName string
+	content          *bytes.Reader
+	size             int64
+	mime             string
+	ext              string
+	violations       []error2.Violation
 }
 
 func uniqid() string {
@@ -30,171 +101,457 @@ func uniqid() string {
 	return fmt.Sprintf("%08x%05x", sec, usec)
 }
 
-func NewImagePostHandler(imgSaver ImageSaver) ImagePostHandler {
+func NewImagePostHandler(
+	imgSaver ImageSaver,
+	uploadRules UploadRules,
+	uploadTokenManager *authentication.UploadTokenManager,
+) ImagePostHandler {
 	return ImagePostHandler{
 		ImageSaver:          imgSaver,
 		maxUploadFileSizeMb: env.ReadEnvFloat("MAX_UPLOADED_FILE_MB", 20),
+		maxUploadRequestMb:  env.ReadEnvFloat("MAX_UPLOAD_REQUEST_MB", 100),
+		uploadRules:         uploadRules,
+		uploadTokenManager:  uploadTokenManager,
+		publicURL:           strings.TrimRight(env.ReadEnv("PUBLIC_URL", ""), "/"),
+		urlPrefix:           "/" + strings.Trim(env.ReadEnv("URL_PREFIX", "/media/images/"), "/"),
 	}
 }
 
-func (iph ImagePostHandler) HandlePost(rw http.ResponseWriter, r *http.Request) { // nolint:funlen
+func (iph ImagePostHandler) HandlePost(rw http.ResponseWriter, r *http.Request) { // nolint:funlen,gocyclo
 	rw.Header().Set("Content-Type", "application/json")
 
-	token := r.Context().Value(authentication.TokenContextKey)
-	if token == nil {
-		rw.WriteHeader(http.StatusForbidden)
+	permit, ok := iph.authorizeUpload(rw, r)
+	if !ok {
+		return
+	}
+
+	iph.limitRequestBody(rw, r)
+	if isRawUploadRequested(r) {
+		iph.handleRawPost(rw, r, permit)
 		return
 	}
 
-	const twentyMb = 20
-	err := r.ParseMultipartForm(int64(iph.maxUploadFileSizeMb) * 3 << twentyMb)
+	multipartReader, err := r.MultipartReader()
 	if err != nil {
 		io.OutputError(err, "", "Multipart form parse failure")
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	uploadedFiles, ok := r.MultipartForm.File[SubmittedFileFieldName]
-	if !ok {
-		submittedNames := ""
-		for submittedName := range r.MultipartForm.File {
-			submittedNames += submittedName + ", "
+	// form fields are read while streaming, so they have to precede the files
+	requestValues := r.URL.Query()
+	submittedNames := []string{}
+	var batch *uploadBatch
+	for {
+		part, e := multipartReader.NextPart()
+		if e == goio.EOF {
+			break
+		}
+		if e != nil {
+			iph.abortUpload(rw, e, batch)
+			return
+		}
+
+		if part.FormName() != SubmittedFileFieldName {
+			submittedNames = append(submittedNames, part.FormName())
+			if part.FileName() == "" && batch != nil {
+				io.OutputWarning("", "Form field '%s' is sent after the files", part.FormName())
+				iph.rollback(batch.folderName, batch.filesToReturn)
+				writeFieldErrors(rw, http.StatusBadRequest, error2.ValidationErrors{
+					part.FormName(): {fmt.Sprintf("Should be sent before the '%s' files", SubmittedFileFieldName)},
+				})
+				return
+			}
+			if part.FileName() == "" {
+				value, e := readFormValue(part)
+				if e != nil {
+					iph.abortUpload(rw, e, batch)
+					return
+				}
+				requestValues.Add(part.FormName(), value)
+			}
+			continue
+		}
+
+		if batch == nil {
+			uploadMode, uploadRules, ok := iph.readUploadSettings(rw, requestValues)
+			if !ok {
+				return
+			}
+			batch = newUploadBatch(SubmittedFileFieldName, uploadMode, uploadRules)
+			batch.permit = permit
+		}
+
+		io.OutputInfo("", "Got file to save: name: %s, header: %v", part.FileName(), part.Header)
+		uploadedFile, e := iph.readUploadedFile(part.FileName(), part)
+		if e != nil {
+			iph.abortUpload(rw, e, batch)
+			return
 		}
+		io.OutputInfo("", "Read file '%s' of %d bytes", uploadedFile.originalFileName, uploadedFile.size)
 
+		if !iph.addToBatch(rw, batch, uploadedFile) {
+			return
+		}
+	}
+
+	if batch == nil {
 		io.OutputWarning(
 			"",
 			"MultipartForm file field '%s' is not submitted, submitted fields list %s",
 			SubmittedFileFieldName,
-			submittedNames,
+			strings.Join(submittedNames, ", "),
 		)
 
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	filesToReturn := make([]string, 0, len(uploadedFiles))
-	validationErrors := error2.NewValidationErrors()
-	folderName := uniqid()
-	for _, uploadedFileHeader := range uploadedFiles {
-		io.OutputInfo(
-			"",
-			"Got file to save: name: %s, size: %d bytes, header: %v",
-			uploadedFileHeader.Filename,
-			uploadedFileHeader.Size,
-			uploadedFileHeader.Header,
-		)
-		statusErr, curFilesToReturn := iph.handleUploadedFile(uploadedFileHeader, iph.maxUploadFileSizeMb, folderName)
-		if statusErr.Error != nil {
-			rw.WriteHeader(statusErr.Status)
-			io.OutputError(statusErr.Error, "", statusErr.Text)
-			return
+	iph.writeBatchResponse(rw, r, batch)
+}
+
+// parseUploadToken gives the permit of the upload_token query param, nil means the token is missing or invalid,
+// the token is consumed only once the uploaded files are saved, see consumePermit
+// authorizeUpload checks the bearer token or the upload token of a presigned upload url, uploads authorized
+// by the upload url are restricted by the returned permit, false means the response is already written
+func (iph ImagePostHandler) authorizeUpload(rw http.ResponseWriter, r *http.Request) (*authentication.UploadPermit, bool) {
+	token := r.Context().Value(authentication.TokenContextKey)
+	if token == nil && r.URL.Query().Get(UploadTokenQueryParam) != "" {
+		permit := iph.parseUploadToken(r)
+		if permit == nil {
+			rw.WriteHeader(http.StatusForbidden)
+			return nil, false
 		}
+		return permit, true
+	}
+
+	return nil, authentication.Authorize(rw, r, authentication.ScopeUpload, "")
+}
+
+func (iph ImagePostHandler) parseUploadToken(r *http.Request) *authentication.UploadPermit {
+	rawToken := r.URL.Query().Get(UploadTokenQueryParam)
+	if rawToken == "" || !iph.uploadTokenManager.IsEnabled() {
+		return nil
+	}
+
+	permit, err := iph.uploadTokenManager.ParseToken(rawToken)
+	if err != nil {
+		io.OutputWarning("", "Invalid upload token: %v", err)
+		return nil
+	}
+
+	return &permit
+}
+
+// consumePermit marks the upload token of the batch used if saved files are kept, so that a request with rejected files
+// doesn't use up the url, if a concurrent request used it meanwhile, the saved files are removed,
+// false means the response is already written
+func (iph ImagePostHandler) consumePermit(rw http.ResponseWriter, batch *uploadBatch) bool {
+	if batch.permit == nil || len(batch.filesToReturn) == 0 {
+		return true
+	}
+
+	// the atomic upload with rejected files is rolled back
+	if batch.uploadMode == UploadModeAtomic && len(batch.validationErrors) > 0 {
+		return true
+	}
+
+	err := iph.uploadTokenManager.Consume(*batch.permit)
+	if err == nil {
+		return true
+	}
+
+	iph.rollback(batch.folderName, batch.filesToReturn)
+	if errors.Is(err, authentication.ErrUploadTokenUsed) {
+		io.OutputWarning("", "Rejected upload token '%s': %v", batch.permit.ID, err)
+		rw.WriteHeader(http.StatusForbidden)
+		return false
+	}
+
+	io.OutputError(err, "", "Failed to mark upload token '%s' as used", batch.permit.ID)
+	rw.WriteHeader(http.StatusInternalServerError)
+
+	return false
+}
+
+func (iph ImagePostHandler) limitRequestBody(rw http.ResponseWriter, r *http.Request) {
+	if iph.maxUploadRequestMb > 0 {
+		r.Body = http.MaxBytesReader(rw, r.Body, int64(iph.maxUploadRequestMb*bytesInMb))
+	}
+}
+
+// readUploadSettings gives the upload mode and rules from query params and form fields preceding the files
+func (iph ImagePostHandler) readUploadSettings(
+	rw http.ResponseWriter,
+	requestValues url.Values,
+) (uploadMode string, uploadRules UploadRules, ok bool) {
+	uploadMode = requestValues.Get("upload_mode")
+	if uploadMode != UploadModeLegacy && uploadMode != UploadModePartial && uploadMode != UploadModeAtomic {
+		io.OutputWarning("", "Unknown upload mode '%s'", uploadMode)
+		writeFieldErrors(rw, http.StatusBadRequest, error2.ValidationErrors{
+			"upload_mode": {fmt.Sprintf("Should be one of '%s', '%s'", UploadModePartial, UploadModeAtomic)},
+		})
+		return "", UploadRules{}, false
+	}
+
+	uploadRules, overrideErrors := iph.uploadRules.WithOverrides(requestValues)
+	if len(overrideErrors) > 0 {
+		io.OutputWarning("", "Invalid upload rules in the request")
+		writeFieldErrors(rw, http.StatusBadRequest, overrideErrors)
+		return "", UploadRules{}, false
+	}
+
+	return uploadMode, uploadRules, true
+}
+
+func readFormValue(part *multipart.Part) (string, error) {
+	value, err := ioutil.ReadAll(goio.LimitReader(part, maxFormValueBytes+1))
+	if err != nil {
+		return "", err
+	}
+
+	if len(value) > maxFormValueBytes {
+		return "", fmt.Errorf("form field '%s' is longer than %d bytes", part.FormName(), maxFormValueBytes)
+	}
+
+	return string(value), nil
+}
 
-		if len(statusErr.ValidationErrs) > 0 {
-			validationErrors.Merge(statusErr.ValidationErrs)
+// readUploadedFile streams the file up to the size limit, the content is kept only if the file has a supported type
+// and fits the limit, reading stops one byte over the limit, so the exact size of a too large file isn't known,
+// the rest of a multipart file is skipped by the multipart reader within the request size limit
+func (iph ImagePostHandler) readUploadedFile(originalFileName string, source goio.Reader) (uploadedFile, error) {
+	file := uploadedFile{originalFileName: originalFileName}
+
+	header := make([]byte, mimeSniffLength)
+	headerLength, err := goio.ReadFull(source, header)
+	if err != nil && err != goio.EOF && err != goio.ErrUnexpectedEOF {
+		return file, err
+	}
+	header = header[:headerLength]
+	file.mime, file.ext = mimetype.Detect(header)
+	file.size = int64(headerLength)
+
+	maxFileSize := int64(iph.maxUploadFileSizeMb * bytesInMb)
+	content := bytes.NewBuffer(header)
+	copiedSize, err := goio.Copy(content, goio.LimitReader(source, maxFileSize-file.size+1))
+	file.size += copiedSize
+	if err != nil {
+		return file, err
+	}
+
+	if file.size > maxFileSize || !supportedMimeTypes[file.mime] {
+		return file, nil
+	}
+
+	file.content = bytes.NewReader(content.Bytes())
+
+	return file, nil
+}
+
+// abortUpload rejects the request which body can't be read further, files saved by it are removed,
+// since the client doesn't get their paths
+func (iph ImagePostHandler) abortUpload(rw http.ResponseWriter, err error, batch *uploadBatch) {
+	fieldName := SubmittedFileFieldName
+	if batch != nil {
+		iph.rollback(batch.folderName, batch.filesToReturn)
+		fieldName = batch.fieldName
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		io.OutputWarning("", "Upload request exceeds the limit of %d bytes", maxBytesErr.Limit)
+		writeFieldErrors(rw, http.StatusRequestEntityTooLarge, error2.ValidationErrors{
+			fieldName: {fmt.Sprintf("The request is too large. Allowed maximum size is %v Mb", iph.maxUploadRequestMb)},
+		})
+		return
+	}
+
+	io.OutputError(err, "", "Multipart form read failure")
+	rw.WriteHeader(http.StatusBadRequest)
+}
+
+func writeFieldErrors(rw http.ResponseWriter, status int, fieldErrors error2.ValidationErrors) {
+	rw.WriteHeader(status)
+	err := json.NewEncoder(rw).Encode(fieldErrors)
+	if err != nil {
+		io.OutputError(err, "", "Cannot send json data")
+	}
+}
+
+func buildUploadFileStatus(
+	index int,
+	originalFilename string,
+	statusErr error2.StatusError,
+	uploadedImage *UploadedImage,
+) UploadFileStatus {
+	fileStatus := UploadFileStatus{
+		Index:            index,
+		OriginalFilename: originalFilename,
+		Status:           UploadStatusSaved,
+		StatusCode:       http.StatusOK,
+		File:             uploadedImage,
+	}
+
+	if statusErr.Error != nil {
+		fileStatus.Status = UploadStatusFailed
+		fileStatus.StatusCode = statusErr.Status
+		fileStatus.Violations = []error2.Violation{{Code: ViolationUploadFailure, Message: statusErr.Text}}
+		return fileStatus
+	}
+
+	if len(statusErr.Violations) > 0 {
+		fileStatus.Status = UploadStatusRejected
+		fileStatus.StatusCode = http.StatusBadRequest
+		fileStatus.Violations = statusErr.Violations
+	}
+
+	return fileStatus
+}
+
+// writePartialResponse gives the status of each file, saved files are kept even if other files failed
+func (iph ImagePostHandler) writePartialResponse(rw http.ResponseWriter, r *http.Request, fileStatuses []UploadFileStatus) {
+	baseURL := iph.buildBaseURL(r)
+	for _, fileStatus := range fileStatuses {
+		if fileStatus.File != nil {
+			iph.fillURLs(baseURL, fileStatus.File)
 		}
+	}
 
-		filesToReturn = append(filesToReturn, curFilesToReturn...)
+	rw.WriteHeader(http.StatusMultiStatus)
+	err := json.NewEncoder(rw).Encode(struct {
+		Files []UploadFileStatus `json:"files"`
+	}{
+		Files: fileStatuses,
+	})
+	if err != nil {
+		io.OutputError(err, "", "Cannot send json data")
 	}
+}
 
-	if len(validationErrors) > 0 {
-		var body []byte
-		body, err = json.Marshal(validationErrors)
+// rollback removes files saved in the request folder, so that a failed atomic upload leaves nothing behind
+func (iph ImagePostHandler) rollback(folderName string, uploadedImages []*UploadedImage) {
+	for _, uploadedImage := range uploadedImages {
+		io.OutputInfo("", "Rolling back saved file '%s'", uploadedImage.Path)
+		err := iph.ImageSaver.RemoveImage(folderName, uploadedImage.Filename)
 		if err != nil {
-			rw.WriteHeader(http.StatusInternalServerError)
-			io.OutputError(err, "", "cannot generate response for validation errors")
-			return
+			io.OutputError(err, "", "Failed to roll back saved file '%s'", uploadedImage.Path)
 		}
-		io.OutputError(fmt.Errorf("validation errors for incoming file: %s", string(body)), "", "Validation failure")
-		rw.WriteHeader(http.StatusBadRequest)
-		_, err = rw.Write(body)
-		if err != nil {
-			rw.WriteHeader(http.StatusInternalServerError)
-			io.OutputError(err, "", "cannot send json data")
+	}
+}
+
+// isV2ResponseRequested tells if the client expects the v2 response either by the Accept header or the version query param
+func isV2ResponseRequested(r *http.Request) bool {
+	return r.URL.Query().Get("version") == "2" || strings.Contains(r.Header.Get("Accept"), ResponseV2MimeType)
+}
+
+func (iph ImagePostHandler) buildResponse(r *http.Request, uploadedImages []*UploadedImage) interface{} {
+	if isV2ResponseRequested(r) {
+		baseURL := iph.buildBaseURL(r)
+		for _, uploadedImage := range uploadedImages {
+			iph.fillURLs(baseURL, uploadedImage)
 		}
 
-		return
+		return struct {
+			Files []*UploadedImage `json:"files"`
+		}{
+			Files: uploadedImages,
+		}
 	}
 
-	if len(filesToReturn) == 0 {
-		rw.WriteHeader(http.StatusBadRequest)
-		io.OutputWarning("", "No files were submitted")
-		err = json.NewEncoder(rw).Encode(map[string][]string{
-			SubmittedFileFieldName: {"Should contain at least 1 element"},
-		})
-		if err != nil {
-			rw.WriteHeader(http.StatusInternalServerError)
-			io.OutputError(err, "", "Cannot send json data")
-		}
-		return
+	filePaths := make([]string, 0, len(uploadedImages))
+	for _, uploadedImage := range uploadedImages {
+		filePaths = append(filePaths, uploadedImage.Path)
 	}
 
-	resp := struct {
+	return struct {
 		FilesToReturn []string `json:"filepathes"`
 	}{
-		FilesToReturn: filesToReturn,
+		FilesToReturn: filePaths,
 	}
+}
 
-	err = json.NewEncoder(rw).Encode(resp)
-	if err != nil {
-		rw.WriteHeader(http.StatusInternalServerError)
-		io.OutputError(err, "", "Cannot send json data")
-		return
+func (iph ImagePostHandler) fillURLs(baseURL string, uploadedImage *UploadedImage) {
+	uploadedImage.URL = baseURL + "/" + uploadedImage.Path
+	uploadedImage.MetaURL = uploadedImage.URL + "/meta"
+}
+
+// buildBaseURL gives the absolute url of images, PUBLIC_URL is used if the service is behind a proxy or cdn
+func (iph ImagePostHandler) buildBaseURL(r *http.Request) string {
+	if iph.publicURL != "" {
+		return iph.publicURL + iph.urlPrefix
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
 	}
+
+	return scheme + "://" + r.Host + iph.urlPrefix
 }
 
 func (iph ImagePostHandler) handleUploadedFile(
-	uploadedFileHeader *multipart.FileHeader,
-	maxUploadFileSizeMb float64,
+	file uploadedFile,
+	uploadRules UploadRules,
 	folderName string,
-) (statusErr error2.StatusError, files []string) {
-	filesToReturn := []string{}
-	infile, err := uploadedFileHeader.Open()
-	defer func() {
-		err = infile.Close()
-		if err != nil {
-			io.OutputError(err, "", "Failed to close input file")
-		}
-	}()
-
-	if err != nil {
+) (statusErr error2.StatusError, uploadedImage *UploadedImage) {
+	fileName := file.originalFileName
+	if len(file.violations) > 0 {
 		return error2.StatusError{
-			Status: http.StatusInternalServerError,
-			Error:  err,
-			Text:   "Uploaded source file opening failure",
-		}, filesToReturn
+			Status:     http.StatusBadRequest,
+			Violations: file.violations,
+		}, nil
 	}
 
-	fileName := uploadedFileHeader.Filename
-	detectedMime, detectedExt, err := mimetype.DetectReader(infile)
+	violations, err := Validate(file.size, file.mime, iph.maxUploadFileSizeMb)
 	if err != nil {
 		return error2.StatusError{
 			Status: http.StatusBadRequest,
 			Error:  err,
-			Text:   fmt.Sprintf("Failed to detect mimetype and extension of uploaded file '%s'", fileName),
-		}, filesToReturn
+			Text:   fmt.Sprintf("Failed to validate uploaded file '%s'", fileName),
+		}, nil
+	}
+
+	if file.content == nil {
+		return error2.StatusError{
+			Status:     http.StatusBadRequest,
+			Violations: violations,
+		}, nil
 	}
 
-	validationErrs, err := Validate(uploadedFileHeader, detectedMime, SubmittedFileFieldName, maxUploadFileSizeMb)
+	budgetViolations, err := ValidatePixelBudget(file.content, iph.ImageSaver.maxImagePixels)
 	if err != nil {
 		return error2.StatusError{
-			Status: http.StatusBadRequest,
+			Status: http.StatusInternalServerError,
 			Error:  err,
-			Text:   fmt.Sprintf("Failed to detect mimetype and extension of uploaded file '%s'", fileName),
-		}, filesToReturn
+			Text:   fmt.Sprintf("Failed to read dimensions of uploaded file '%s'", fileName),
+		}, nil
+	}
+	violations = append(violations, budgetViolations...)
+
+	if len(budgetViolations) == 0 && !uploadRules.IsEmpty() {
+		dimensionViolations, e := uploadRules.ValidateImage(file.content)
+		if e != nil {
+			return error2.StatusError{
+				Status: http.StatusInternalServerError,
+				Error:  e,
+				Text:   fmt.Sprintf("Failed to read dimensions of uploaded file '%s'", fileName),
+			}, nil
+		}
+		violations = append(violations, dimensionViolations...)
 	}
 
-	if len(validationErrs) > 0 {
+	if len(violations) > 0 {
 		return error2.StatusError{
-			Status:         http.StatusBadRequest,
-			Error:          nil,
-			ValidationErrs: validationErrs,
-		}, filesToReturn
+			Status:     http.StatusBadRequest,
+			Error:      nil,
+			Violations: violations,
+		}, nil
 	}
 
 	if filepath.Ext(fileName) == "" {
-		if detectedExt != "" {
-			fileName += "." + detectedExt
+		if file.ext != "" {
+			fileName += "." + file.ext
 			io.OutputInfo("", "Added extension to the file: %s", fileName)
 		} else {
 			io.OutputWarning("", "Was not able to detect file extension")
@@ -204,17 +561,23 @@ func (iph ImagePostHandler) handleUploadedFile(
 	fileName = SanitizeImageName(fileName)
 	io.OutputInfo("", "File name after sanitizing: %s", fileName)
 
-	err = iph.ImageSaver.SaveImage(infile, folderName, fileName)
+	savedImage, err := iph.ImageSaver.SaveImage(file.content, folderName, fileName)
 	if err != nil {
 		return error2.StatusError{
-			Status:         http.StatusInternalServerError,
-			Error:          err,
-			ValidationErrs: validationErrs,
-			Text:           "Folder generation failure",
-		}, filesToReturn
+			Status: http.StatusInternalServerError,
+			Error:  err,
+			Text:   "Folder generation failure",
+		}, nil
 	}
 
-	filesToReturn = append(filesToReturn, folderName+"/"+fileName)
-
-	return error2.StatusError{}, filesToReturn
+	return error2.StatusError{}, &UploadedImage{
+		Path:             folderName + "/" + savedImage.FileName,
+		OriginalFilename: file.originalFileName,
+		Filename:         savedImage.FileName,
+		Width:            savedImage.Width,
+		Height:           savedImage.Height,
+		Size:             savedImage.Size,
+		Mime:             savedImage.Mime,
+		Sha256:           savedImage.Sha256,
+	}
 }
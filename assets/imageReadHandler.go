@@ -1,23 +1,31 @@
 package assets
 
 import (
+	"bytes"
 	"fmt"
-	"math"
+	"image"
+	"image/gif"
 	"net/http"
 	"os"
 	"strings"
 
 	"github.com/breathbath/go_utils/utils/env"
+	"github.com/breathbath/go_utils/utils/io"
 	"github.com/breathbath/media-library/filesystem"
-	"github.com/disintegration/imaging"
 )
 
+const defaultWebpQuality = 80
+
 type ImageReadHandler struct {
 	fileSystemManager filesystem.Manager
 	proxyURL          string
+	presets           Presets
+	resizeLimits      ResizeLimits
+	webpQuality       int
+	maxImagePixels    int64
 }
 
-func NewImageReadHandler(fileSystemManager filesystem.Manager) ImageReadHandler {
+func NewImageReadHandler(fileSystemManager filesystem.Manager, presets Presets, resizeLimits ResizeLimits) ImageReadHandler {
 	proxyURL := env.ReadEnv("PROXY_URL", "")
 	if proxyURL != "" {
 		urlPrefix := env.ReadEnv("URL_PREFIX", "/media/images")
@@ -29,16 +37,24 @@ func NewImageReadHandler(fileSystemManager filesystem.Manager) ImageReadHandler
 	return ImageReadHandler{
 		fileSystemManager: fileSystemManager,
 		proxyURL:          proxyURL,
+		presets:           presets,
+		resizeLimits:      resizeLimits,
+		webpQuality:       int(env.ReadEnvInt("WEBP_QUALITY", defaultWebpQuality)),
+		maxImagePixels:    filesystem.ReadMaxImagePixels(),
 	}
 }
 
 func (nfs ImageReadHandler) Open(path string) (http.File, error) {
-	imagePath := parseImagePath(path)
+	imagePath := parseImagePath(path, nfs.presets)
 	if !imagePath.IsValid {
 		return nil, nfs.createNonExistsError(path)
 	}
 
 	if imagePath.RawResizedFolder != "" {
+		if !nfs.resizeLimits.IsAllowed(imagePath) {
+			io.OutputWarning("", "Requested size %dx%d is not allowed", imagePath.Width, imagePath.Height)
+			return nil, nfs.createNonExistsError(path)
+		}
 		return nfs.handleResizedImage(imagePath)
 	}
 
@@ -73,37 +89,81 @@ func (nfs ImageReadHandler) handleResizedImage(imagePath *filesystem.ImagePath)
 }
 
 func (nfs ImageReadHandler) generateResizedImage(imagePath *filesystem.ImagePath) (http.File, error) {
-	srcImage, err := nfs.fileSystemManager.OpenNonResizedImage(imagePath)
+	encodedImg, err := nfs.generateResizedAnimatedGif(imagePath)
 	if err != nil {
+		nfs.warnIfImageTooLarge(err, imagePath)
 		return nil, err
 	}
 
-	const half = 0.5
-	const MaxX = 1.0
-	if imagePath.Width == 0 {
-		srcBound := srcImage.Bounds()
-		srcW := srcBound.Dx()
-		srcH := srcBound.Dy()
-		tmpW := float64(imagePath.Height) * float64(srcW) / float64(srcH)
-		imagePath.Width = int(math.Max(MaxX, math.Floor(tmpW+half)))
+	if encodedImg == nil {
+		srcImage, e := nfs.fileSystemManager.OpenNonResizedImage(imagePath)
+		if e != nil {
+			nfs.warnIfImageTooLarge(e, imagePath)
+			return nil, e
+		}
+
+		targetImg := transformImage(srcImage, imagePath)
+
+		encodedImg = &bytes.Buffer{}
+		err = encodeImage(encodedImg, targetImg, imagePath, nfs.webpQuality)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	if imagePath.Height == 0 {
-		srcBound := srcImage.Bounds()
-		srcW := srcBound.Dx()
-		srcH := srcBound.Dy()
-		tmpH := float64(imagePath.Width) * float64(srcH) / float64(srcW)
-		imagePath.Height = int(math.Max(MaxX, math.Floor(tmpH+half)))
+	file, err := nfs.fileSystemManager.SaveResizedImage(imagePath, encodedImg)
+	if err != nil {
+		return nil, err
 	}
 
-	targetImg := imaging.Thumbnail(srcImage, imagePath.Width, imagePath.Height, imaging.Lanczos)
+	return file, nil
+}
+
+// generateResizedAnimatedGif transforms all frames of animated gifs, it returns nil for other images
+// or if another output format is requested
+func (nfs ImageReadHandler) generateResizedAnimatedGif(imagePath *filesystem.ImagePath) (*bytes.Buffer, error) {
+	if imagePath.ImageExt != "gif" || imagePath.GetResizedImageExt() != "gif" {
+		return nil, nil
+	}
 
-	file, err := nfs.fileSystemManager.SaveResizedImage(imagePath, targetImg)
+	srcFile, err := nfs.fileSystemManager.CreateFileReader(imagePath, false)
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		e := srcFile.Close()
+		if e != nil {
+			io.OutputError(e, "", "Failed to close file '%s'", imagePath.ImageFile)
+		}
+	}()
 
-	return file, nil
+	err = filesystem.CheckPixelBudget(srcFile, nfs.maxImagePixels)
+	if err != nil {
+		return nil, err
+	}
+
+	gifImg, err := decodeAnimatedGif(srcFile)
+	if err != nil || gifImg == nil {
+		return nil, err
+	}
+
+	gifImg = transformGifFrames(gifImg, func(frame image.Image) image.Image {
+		return transformImage(frame, imagePath)
+	})
+
+	encodedImg := &bytes.Buffer{}
+	err = gif.EncodeAll(encodedImg, gifImg)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodedImg, nil
+}
+
+func (nfs ImageReadHandler) warnIfImageTooLarge(err error, imagePath *filesystem.ImagePath) {
+	if imageTooLargeErr, ok := err.(filesystem.ImageTooLargeError); ok {
+		io.OutputWarning("", "Refused to resize '%s/%s': %v", imagePath.FolderName, imagePath.ImageFile, imageTooLargeErr)
+	}
 }
 
 func (nfs ImageReadHandler) handleNonResizedImage(imagePath *filesystem.ImagePath) (http.File, error) {
@@ -130,14 +190,19 @@ func (nfs ImageReadHandler) getProxyImage(imagePath *filesystem.ImagePath) (http
 		)
 	}
 
+	imageFile := imagePath.ImageFile
+	if imagePath.GetResizedImageExt() != imagePath.ImageExt {
+		imageFile += "." + imagePath.GetResizedImageExt()
+	}
+
 	return DownloadFile(
 		fmt.Sprintf(
 			"%s/%s/%s/%s",
 			nfs.proxyURL,
 			imagePath.RawResizedFolder,
 			imagePath.FolderName,
-			imagePath.ImageFile,
+			imageFile,
 		),
-		imagePath.ImageFile,
+		imageFile,
 	)
 }
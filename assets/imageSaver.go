@@ -1,55 +1,185 @@
 package assets
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"image"
+	"image/color"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
 	"path/filepath"
+	"regexp"
 	"strings"
 
 	"github.com/breathbath/go_utils/utils/env"
 	io2 "github.com/breathbath/go_utils/utils/io"
 	"github.com/breathbath/media-library/filesystem"
+	"github.com/chai2010/webp"
 	"github.com/disintegration/imaging"
+	"github.com/gabriel-vasile/mimetype"
+	_ "golang.org/x/image/bmp"  // registers bmp decoder for uploads
+	_ "golang.org/x/image/tiff" // registers tiff decoder for uploads
 )
 
+// encodableExts lists extensions of formats which uploaded images are re-encoded to
+var encodableExts = map[string]bool{"jpg": true, "jpeg": true, "png": true, "gif": true, WebpExt: true, "bmp": true, "tiff": true, "tif": true}
+
 type ImageSaver struct {
 	FileSystemHandler                      filesystem.Manager
 	vertMaxImageWidth, horizMaxImageHeight int64
 	jpegQuality                            int64
+	webpQuality                            int64
+	normalizeFormat                        string
+	metadataPolicy                         string
+	maxImagePixels                         int64
 }
 
-func NewImageSaver(fsHandler filesystem.Manager) ImageSaver {
+func NewImageSaver(fsHandler filesystem.Manager) (ImageSaver, error) {
+	normalizeFormat := strings.ToLower(env.ReadEnv("UPLOAD_NORMALIZE_FORMAT", ""))
+	if normalizeFormat != "" && !regexp.MustCompile(fmt.Sprintf(`^(%s)$`, SupportedImageFormats)).MatchString(normalizeFormat) {
+		return ImageSaver{}, fmt.Errorf(
+			"invalid UPLOAD_NORMALIZE_FORMAT '%s', supported formats are %s",
+			normalizeFormat,
+			SupportedImageFormats,
+		)
+	}
+
+	metadataPolicy := env.ReadEnv("UPLOAD_METADATA_POLICY", MetadataPolicyStrip)
+	if metadataPolicy != MetadataPolicyStrip && metadataPolicy != MetadataPolicyKeep && metadataPolicy != MetadataPolicyStripGPS {
+		return ImageSaver{}, fmt.Errorf(
+			"invalid UPLOAD_METADATA_POLICY '%s', supported policies are %s, %s, %s",
+			metadataPolicy,
+			MetadataPolicyStrip,
+			MetadataPolicyKeep,
+			MetadataPolicyStripGPS,
+		)
+	}
+
 	return ImageSaver{
 		FileSystemHandler:   fsHandler,
 		vertMaxImageWidth:   env.ReadEnvInt("VERT_MAX_IMAGE_WIDTH", 0),
 		horizMaxImageHeight: env.ReadEnvInt("HORIZ_MAX_IMAGE_HEIGHT", 0),
 		jpegQuality:         env.ReadEnvInt("COMPRESS_JPG_QUALITY", 85),
-	}
+		webpQuality:         env.ReadEnvInt("WEBP_QUALITY", defaultWebpQuality),
+		normalizeFormat:     normalizeFormat,
+		metadataPolicy:      metadataPolicy,
+		maxImagePixels:      filesystem.ReadMaxImagePixels(),
+	}, nil
+}
+
+// SavedImage describes the stored image after compression and normalization
+type SavedImage struct {
+	FileName string
+	Width    int
+	Height   int
+	Size     int64
+	Mime     string
+	Sha256   string
 }
 
-func (is ImageSaver) SaveImage(sourceFile io.ReadSeeker, folderName, fileName string) error {
+// SaveImage stores the uploaded image, the returned file name has another extension
+// if the image was normalized to UPLOAD_NORMALIZE_FORMAT. The image is encoded before anything is written,
+// so that a failed encoding keeps the existing image, if it's replaced
+func (is ImageSaver) SaveImage(sourceFile io.ReadSeeker, folderName, fileName string) (SavedImage, error) {
+	fileName = is.getNormalizedFileName(fileName)
+
 	io2.OutputInfo("", "Will save file %s in folder %s", fileName, folderName)
-	targetFile, err := is.FileSystemHandler.CreateNonResizedFileWriter(folderName, fileName)
-	defer func() {
-		e := targetFile.Close()
-		if e != nil {
-			io2.OutputError(e, "", "Failed to close file '%s'", fileName)
-		}
-	}()
+	savedContent := &bytes.Buffer{}
+	err := is.SaveCompressedImageIfPossible(sourceFile, savedContent, filepath.Ext(fileName))
+	if err != nil {
+		return SavedImage{}, err
+	}
 
+	err = is.FileSystemHandler.SaveNonResizedImage(folderName, fileName, bytes.NewReader(savedContent.Bytes()))
 	if err != nil {
+		// the storage removes the incomplete file, the folder created for it is removed if it has no other images
+		cleanupErr := is.removeFolderIfEmpty(&filesystem.ImagePath{FolderName: folderName})
+		if cleanupErr != nil {
+			io2.OutputError(cleanupErr, "", "Failed to remove folder '%s' of the unsaved image", folderName)
+		}
+		return SavedImage{}, err
+	}
+
+	return describeSavedImage(fileName, savedContent.Bytes()), nil
+}
+
+// RemoveImage deletes a saved image together with its folder if no other images are left there,
+// the name isn't parsed like in image urls, so that saved images which can't be requested, e.g. photo.JPG, are removed too
+func (is ImageSaver) RemoveImage(folderName, fileName string) error {
+	if !isFolderValid(folderName) || fileName == "" || strings.ContainsAny(fileName, `/\`) {
+		return fmt.Errorf("invalid image path '%s/%s'", folderName, fileName)
+	}
+
+	imagePath := &filesystem.ImagePath{FolderName: folderName, ImageFile: fileName}
+	err := is.FileSystemHandler.RemoveNonResizedImage(imagePath)
+	if err != nil && !is.FileSystemHandler.IsNonExistingPathError(err) {
 		return err
 	}
 
-	err = is.SaveCompressedImageIfPossible(sourceFile, targetFile, filepath.Ext(fileName))
-	if err != nil {
+	return is.removeFolderIfEmpty(imagePath)
+}
+
+func (is ImageSaver) removeFolderIfEmpty(imagePath *filesystem.ImagePath) error {
+	isDirEmpty, err := is.FileSystemHandler.IsImageDirEmpty(imagePath, false)
+	if err != nil && is.FileSystemHandler.IsNonExistingPathError(err) {
+		return nil
+	}
+	if err != nil || !isDirEmpty {
 		return err
 	}
 
-	return nil
+	return is.FileSystemHandler.RemoveDir(imagePath, false, false)
+}
+
+func describeSavedImage(fileName string, content []byte) SavedImage {
+	savedImage := SavedImage{
+		FileName: fileName,
+		Size:     int64(len(content)),
+	}
+
+	imgConfig, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err == nil {
+		savedImage.Width, savedImage.Height = imgConfig.Width, imgConfig.Height
+	}
+
+	savedImage.Mime, _ = mimetype.Detect(content)
+	hash := sha256.Sum256(content)
+	savedImage.Sha256 = hex.EncodeToString(hash[:])
+
+	return savedImage
+}
+
+func (is ImageSaver) getNormalizedFileName(fileName string) string {
+	if is.normalizeFormat == "" {
+		return fileName
+	}
+
+	ext := strings.TrimLeft(filepath.Ext(fileName), ".")
+	if isSameFormat(ext, is.normalizeFormat) {
+		return fileName
+	}
+
+	normalizedFileName := strings.TrimSuffix(fileName, filepath.Ext(fileName)) + "." + is.normalizeFormat
+	io2.OutputInfo("", "Will normalize file %s to %s", fileName, normalizedFileName)
+
+	return normalizedFileName
+}
+
+func isSameFormat(ext1, ext2 string) bool {
+	formatsByExt := map[string]string{"jpeg": "jpg", "tif": "tiff"}
+	ext1, ext2 = strings.ToLower(ext1), strings.ToLower(ext2)
+	if format, ok := formatsByExt[ext1]; ok {
+		ext1 = format
+	}
+	if format, ok := formatsByExt[ext2]; ok {
+		ext2 = format
+	}
+
+	return ext1 == ext2
 }
 
 func (is ImageSaver) SaveCompressedImageIfPossible(
@@ -57,33 +187,63 @@ func (is ImageSaver) SaveCompressedImageIfPossible(
 	targetFile io.Writer,
 	extWithDot string,
 ) error {
-	ext := strings.TrimLeft(extWithDot, ".")
-	_, err := sourceFile.Seek(0, 0)
+	// the budget is checked again, since the image is decoded fully below
+	err := filesystem.CheckPixelBudget(sourceFile, is.maxImagePixels)
 	if err != nil {
 		return err
 	}
 
-	imgRcr, _, err := image.Decode(sourceFile)
+	ext, err := is.detectEncodingExt(sourceFile, extWithDot)
 	if err != nil {
 		return err
 	}
 
-	resizeX, resizeY := 0, 0
-	if is.vertMaxImageWidth+is.horizMaxImageHeight > 0 {
-		bounds := imgRcr.Bounds()
-		if (bounds.Dy() > bounds.Dx() || bounds.Dy() == bounds.Dx()) && bounds.Dx() > int(is.vertMaxImageWidth) {
-			resizeX = int(is.vertMaxImageWidth)
-		} else if bounds.Dx() > bounds.Dy() && bounds.Dy() > int(is.horizMaxImageHeight) {
-			resizeY = int(is.horizMaxImageHeight)
+	if ext == "gif" {
+		gifImg, e := decodeAnimatedGif(sourceFile)
+		if e != nil {
+			return e
 		}
+		if gifImg != nil {
+			return is.saveAnimatedGif(gifImg, targetFile)
+		}
+
+		_, err = sourceFile.Seek(0, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	exifPayload, err := is.readExifToKeep(sourceFile)
+	if err != nil {
+		return err
+	}
+
+	// phone photos are often stored rotated with the exif orientation tag, which is lost after re-encoding
+	imgRcr, err := imaging.Decode(sourceFile, imaging.AutoOrientation(true))
+	if err != nil {
+		return err
 	}
 
+	resizeX, resizeY := is.calculateDownscaleSizes(imgRcr.Bounds())
 	if resizeX+resizeY > 0 {
 		imgRcr = imaging.Resize(imgRcr, resizeX, resizeY, imaging.Lanczos)
 	}
 
 	if ext == "jpg" || ext == "jpeg" {
-		return jpeg.Encode(targetFile, imgRcr, &jpeg.Options{Quality: int(is.jpegQuality)})
+		// jpeg has no transparency, so images converted from other formats get white background instead of black
+		background := imaging.New(imgRcr.Bounds().Dx(), imgRcr.Bounds().Dy(), color.White)
+		imgRcr = imaging.Overlay(background, imgRcr, image.Point{}, 1)
+		if exifPayload == nil {
+			return jpeg.Encode(targetFile, imgRcr, &jpeg.Options{Quality: int(is.jpegQuality)})
+		}
+
+		encodedImg := &bytes.Buffer{}
+		err = jpeg.Encode(encodedImg, imgRcr, &jpeg.Options{Quality: int(is.jpegQuality)})
+		if err != nil {
+			return err
+		}
+
+		return writeJpegWithExif(targetFile, encodedImg.Bytes(), exifPayload)
 	}
 
 	if ext == "png" {
@@ -97,8 +257,25 @@ func (is ImageSaver) SaveCompressedImageIfPossible(
 		return gif.Encode(targetFile, imgRcr, &gif.Options{})
 	}
 
+	if ext == WebpExt {
+		return webp.Encode(targetFile, imgRcr, &webp.Options{Quality: float32(is.webpQuality)})
+	}
+
+	if ext == "bmp" || ext == "tiff" || ext == "tif" {
+		format, e := imaging.FormatFromExtension(ext)
+		if e != nil {
+			return e
+		}
+		return imaging.Encode(targetFile, imgRcr, format)
+	}
+
 	io2.OutputWarning("", "Unknown file extension %s, will just copy file", ext)
 
+	_, err = sourceFile.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+
 	_, err = io.Copy(targetFile, sourceFile)
 	if err != nil {
 		return err
@@ -106,3 +283,82 @@ func (is ImageSaver) SaveCompressedImageIfPossible(
 
 	return nil
 }
+
+// detectEncodingExt gives the lowercased extension of the format the image is encoded to, the detected type is used
+// for extensions without an encoder, images which can't be re-encoded are copied only if their metadata is kept,
+// the source is rewound afterwards
+func (is ImageSaver) detectEncodingExt(sourceFile io.ReadSeeker, extWithDot string) (string, error) {
+	ext := strings.ToLower(strings.TrimLeft(extWithDot, "."))
+	if encodableExts[ext] {
+		return ext, nil
+	}
+
+	header := make([]byte, mimeSniffLength)
+	headerLength, err := io.ReadFull(sourceFile, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	_, err = sourceFile.Seek(0, 0)
+	if err != nil {
+		return "", err
+	}
+
+	_, detectedExt := mimetype.Detect(header[:headerLength])
+	if encodableExts[detectedExt] {
+		return detectedExt, nil
+	}
+
+	if is.metadataPolicy != MetadataPolicyKeep {
+		return "", fmt.Errorf(
+			"the image with extension '%s' can't be re-encoded, so its metadata can't be removed by policy '%s'",
+			ext,
+			is.metadataPolicy,
+		)
+	}
+
+	return ext, nil
+}
+
+// readExifToKeep gives exif data of jpeg images according to UPLOAD_METADATA_POLICY, other metadata is never kept,
+// the source is rewound afterwards
+func (is ImageSaver) readExifToKeep(sourceFile io.ReadSeeker) ([]byte, error) {
+	if is.metadataPolicy == MetadataPolicyStrip {
+		return nil, nil
+	}
+
+	exifPayload := readJpegExif(sourceFile)
+	_, err := sourceFile.Seek(0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if exifPayload == nil {
+		return nil, nil
+	}
+
+	return sanitizeExif(exifPayload, is.metadataPolicy == MetadataPolicyStripGPS), nil
+}
+
+// calculateDownscaleSizes gives the target width or height if the image exceeds VERT_MAX_IMAGE_WIDTH or HORIZ_MAX_IMAGE_HEIGHT
+func (is ImageSaver) calculateDownscaleSizes(bounds image.Rectangle) (resizeX, resizeY int) {
+	if is.vertMaxImageWidth+is.horizMaxImageHeight > 0 {
+		if (bounds.Dy() > bounds.Dx() || bounds.Dy() == bounds.Dx()) && bounds.Dx() > int(is.vertMaxImageWidth) {
+			resizeX = int(is.vertMaxImageWidth)
+		} else if bounds.Dx() > bounds.Dy() && bounds.Dy() > int(is.horizMaxImageHeight) {
+			resizeY = int(is.horizMaxImageHeight)
+		}
+	}
+
+	return resizeX, resizeY
+}
+
+func (is ImageSaver) saveAnimatedGif(gifImg *gif.GIF, targetFile io.Writer) error {
+	resizeX, resizeY := is.calculateDownscaleSizes(image.Rect(0, 0, gifImg.Config.Width, gifImg.Config.Height))
+	if resizeX+resizeY > 0 {
+		gifImg = transformGifFrames(gifImg, func(frame image.Image) image.Image {
+			return imaging.Resize(frame, resizeX, resizeY, imaging.Lanczos)
+		})
+	}
+
+	return gif.EncodeAll(targetFile, gifImg)
+}
@@ -0,0 +1,138 @@
+package assets
+
+import (
+	"encoding/hex"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/breathbath/media-library/filesystem"
+	"github.com/disintegration/imaging"
+)
+
+const (
+	ResizeModeFill = "fill"
+	ResizeModeFit  = "fit"
+	ResizeModePad  = "pad"
+	ResizeModeCrop = "crop"
+
+	GravityCenter = "center"
+
+	DefaultPadBackground = "ffffff"
+)
+
+var gravityAnchors = map[string]imaging.Anchor{
+	GravityCenter: imaging.Center,
+	"north":       imaging.Top,
+	"south":       imaging.Bottom,
+	"east":        imaging.Right,
+	"west":        imaging.Left,
+	"northeast":   imaging.TopRight,
+	"northwest":   imaging.TopLeft,
+	"southeast":   imaging.BottomRight,
+	"southwest":   imaging.BottomLeft,
+}
+
+func transformImage(srcImage image.Image, imagePath *filesystem.ImagePath) image.Image {
+	srcBound := srcImage.Bounds()
+	srcW := srcBound.Dx()
+	srcH := srcBound.Dy()
+
+	if imagePath.Mode == ResizeModeCrop {
+		// cropping doesn't scale the image, so a missing dimension means the whole source side
+		width, height := imagePath.Width, imagePath.Height
+		if width == 0 {
+			width = srcW
+		}
+		if height == 0 {
+			height = srcH
+		}
+		return imaging.CropAnchor(srcImage, width, height, gravityAnchors[imagePath.Gravity])
+	}
+
+	completeProportionalSizes(imagePath, srcW, srcH)
+
+	switch imagePath.Mode {
+	case ResizeModeFit:
+		fitW, fitH := calculateFitSizes(srcW, srcH, imagePath.Width, imagePath.Height)
+		return imaging.Resize(srcImage, fitW, fitH, imaging.Lanczos)
+	case ResizeModePad:
+		fitW, fitH := calculateFitSizes(srcW, srcH, imagePath.Width, imagePath.Height)
+		fittedImg := imaging.Resize(srcImage, fitW, fitH, imaging.Lanczos)
+		canvas := imaging.New(imagePath.Width, imagePath.Height, parseHexColor(imagePath.Background))
+		return imaging.Paste(
+			canvas,
+			fittedImg,
+			calculateAnchorPoint(canvas.Bounds(), fittedImg.Bounds(), gravityAnchors[imagePath.Gravity]),
+		)
+	default:
+		return imaging.Fill(srcImage, imagePath.Width, imagePath.Height, gravityAnchors[imagePath.Gravity], imaging.Lanczos)
+	}
+}
+
+// completeProportionalSizes calculates a missing width or height from the source image aspect ratio
+func completeProportionalSizes(imagePath *filesystem.ImagePath, srcW, srcH int) {
+	const half = 0.5
+	const MaxX = 1.0
+	if imagePath.Width == 0 {
+		tmpW := float64(imagePath.Height) * float64(srcW) / float64(srcH)
+		imagePath.Width = int(math.Max(MaxX, math.Floor(tmpW+half)))
+	}
+
+	if imagePath.Height == 0 {
+		tmpH := float64(imagePath.Width) * float64(srcH) / float64(srcW)
+		imagePath.Height = int(math.Max(MaxX, math.Floor(tmpH+half)))
+	}
+}
+
+// calculateFitSizes gives the largest sizes with the source aspect ratio, which fit into the target box
+func calculateFitSizes(srcW, srcH, boxW, boxH int) (width, height int) {
+	const half = 0.5
+	const minSize = 1.0
+	ratio := math.Min(float64(boxW)/float64(srcW), float64(boxH)/float64(srcH))
+
+	width = int(math.Max(minSize, math.Min(float64(boxW), math.Floor(float64(srcW)*ratio+half))))
+	height = int(math.Max(minSize, math.Min(float64(boxH), math.Floor(float64(srcH)*ratio+half))))
+
+	return width, height
+}
+
+func calculateAnchorPoint(canvas, img image.Rectangle, anchor imaging.Anchor) image.Point {
+	freeX := canvas.Dx() - img.Dx()
+	freeY := canvas.Dy() - img.Dy()
+
+	switch anchor {
+	case imaging.TopLeft:
+		return image.Pt(0, 0)
+	case imaging.Top:
+		return image.Pt(freeX/2, 0)
+	case imaging.TopRight:
+		return image.Pt(freeX, 0)
+	case imaging.Left:
+		return image.Pt(0, freeY/2)
+	case imaging.Right:
+		return image.Pt(freeX, freeY/2)
+	case imaging.BottomLeft:
+		return image.Pt(0, freeY)
+	case imaging.Bottom:
+		return image.Pt(freeX/2, freeY)
+	case imaging.BottomRight:
+		return image.Pt(freeX, freeY)
+	default:
+		return image.Pt(freeX/2, freeY/2)
+	}
+}
+
+// parseHexColor converts RRGGBB or RRGGBBAA value to a color, the value is expected to be validated by the path parser
+func parseHexColor(hexColor string) color.NRGBA {
+	rgba, err := hex.DecodeString(hexColor)
+	if err != nil || (len(rgba) != 3 && len(rgba) != 4) {
+		return color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	}
+
+	if len(rgba) == 3 {
+		rgba = append(rgba, 255)
+	}
+
+	return color.NRGBA{R: rgba[0], G: rgba[1], B: rgba[2], A: rgba[3]}
+}
@@ -0,0 +1,47 @@
+package assets
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+
+	"github.com/breathbath/go_utils/utils/io"
+	"github.com/breathbath/media-library/filesystem"
+)
+
+// Presets maps preset names to transformation params, e.g. {"thumb": "w_300,h_200,c_fill"}
+type Presets map[string]string
+
+// LoadPresets reads presets from a json file, empty path gives no presets
+func LoadPresets(configPath string) (Presets, error) {
+	presets := Presets{}
+	if configPath == "" {
+		return presets, nil
+	}
+
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(content, &presets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse presets config '%s': %v", configPath, err)
+	}
+
+	presetNameRegex := regexp.MustCompile(`^[a-zA-Z][\w\-]*$`)
+	for presetName, transformation := range presets {
+		if !presetNameRegex.MatchString(presetName) {
+			return nil, fmt.Errorf("invalid preset name '%s', it should start with a letter and contain only letters, digits, _ or -", presetName)
+		}
+
+		if !parseTransformationParams(transformation, &filesystem.ImagePath{}) {
+			return nil, fmt.Errorf("invalid transformation '%s' for preset '%s'", transformation, presetName)
+		}
+	}
+
+	io.OutputInfo("", "Loaded %d transformation presets from '%s'", len(presets), configPath)
+
+	return presets, nil
+}
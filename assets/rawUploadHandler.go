@@ -0,0 +1,168 @@
+package assets
+
+import (
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/breathbath/go_utils/utils/io"
+	"github.com/breathbath/media-library/authentication"
+	error2 "github.com/breathbath/media-library/error"
+	"github.com/gorilla/mux"
+)
+
+// RawUploadFieldName is the key of validation errors of images uploaded as the raw request body
+const RawUploadFieldName = "image"
+
+// reservedFolderName is the folder of resized images, which can't be chosen for uploads
+const reservedFolderName = "cache"
+
+// HandlePut stores the request body as the image under the path of the request, existing images are replaced
+// unless the request has the If-None-Match: * header
+func (iph ImagePostHandler) HandlePut(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(r)
+	folderName, imageName := vars["folder"], vars["image"]
+	if !authentication.Authorize(rw, r, authentication.ScopeUpload, folderName) {
+		return
+	}
+	if folderName == reservedFolderName || !isFolderValid(folderName) {
+		io.OutputWarning("", "Invalid folder name '%s' of the uploaded image", folderName)
+		writeFieldErrors(rw, http.StatusBadRequest, error2.ValidationErrors{
+			"folder": {"Should contain only letters, digits and '_' and should not be '" + reservedFolderName + "'"},
+		})
+		return
+	}
+
+	// the extension is lowercased like in the name of the saved image
+	imageExt := filepath.Ext(imageName)
+	imageName = strings.TrimSuffix(imageName, imageExt) + strings.ToLower(imageExt)
+	imagePath := parseImagePath(folderName+"/"+iph.ImageSaver.getNormalizedFileName(imageName), nil)
+	if !imagePath.IsValid {
+		io.OutputWarning("", "Invalid name '%s' of the uploaded image", imageName)
+		writeFieldErrors(rw, http.StatusBadRequest, error2.ValidationErrors{
+			RawUploadFieldName: {"Should contain only letters, digits, '_' and '-' with one of extensions " + SupportedImageFormats},
+		})
+		return
+	}
+
+	exists, err := iph.ImageSaver.FileSystemHandler.FileExists(imagePath, false)
+	if err != nil {
+		io.OutputError(err, "", "Failed to check if image '%s' exists", imagePath.GetNonResizedImagePath())
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	isReplaceForbidden := r.Header.Get("If-None-Match") == "*"
+	if exists && isReplaceForbidden {
+		io.OutputInfo("", "Image '%s' exists, won't replace it", imagePath.GetNonResizedImagePath())
+		rw.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	iph.limitRequestBody(rw, r)
+	batch, file, ok := iph.readRawUpload(rw, r, imageName)
+	if !ok {
+		return
+	}
+	batch.folderName = folderName
+	if !exists {
+		batch.savedStatus = http.StatusCreated
+	}
+
+	if isReplaceForbidden {
+		// an empty image is created atomically before saving, so that only one of concurrent requests creates the image
+		isCreated, e := iph.ImageSaver.FileSystemHandler.CreateMarker(imagePath.GetNonResizedImagePath())
+		if e != nil {
+			io.OutputError(e, "", "Failed to create image '%s'", imagePath.GetNonResizedImagePath())
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !isCreated {
+			io.OutputInfo("", "Image '%s' was created by another request, won't replace it", imagePath.GetNonResizedImagePath())
+			rw.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+	}
+
+	ok = iph.addToBatch(rw, batch, file)
+	if isReplaceForbidden && (!ok || len(batch.filesToReturn) == 0) {
+		e := iph.ImageSaver.RemoveImage(folderName, imagePath.ImageFile)
+		if e != nil {
+			io.OutputError(e, "", "Failed to remove the empty image '%s'", imagePath.GetNonResizedImagePath())
+		}
+	}
+	if !ok {
+		return
+	}
+
+	if exists && len(batch.filesToReturn) > 0 {
+		// resized variants of the replaced image are outdated
+		err = iph.ImageSaver.FileSystemHandler.RemoveDir(imagePath, true, false)
+		if err != nil && !iph.ImageSaver.FileSystemHandler.IsNonExistingPathError(err) {
+			io.OutputError(err, "", "Failed to delete resized images of replaced image '%s'", imagePath.GetNonResizedImagePath())
+		}
+	}
+
+	iph.writeBatchResponse(rw, r, batch)
+}
+
+// isRawUploadRequested tells if the image is posted as the request body with the file name in the Content-Disposition header
+func isRawUploadRequested(r *http.Request) bool {
+	if r.Header.Get("Content-Disposition") == "" {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	return err != nil || mediaType != "multipart/form-data"
+}
+
+// handleRawPost saves the request body to a new folder like a posted file
+func (iph ImagePostHandler) handleRawPost(rw http.ResponseWriter, r *http.Request, permit *authentication.UploadPermit) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition"))
+	if err != nil || params["filename"] == "" {
+		io.OutputWarning("", "Invalid Content-Disposition header '%s'", r.Header.Get("Content-Disposition"))
+		writeFieldErrors(rw, http.StatusBadRequest, error2.ValidationErrors{
+			RawUploadFieldName: {"Content-Disposition header should contain the file name"},
+		})
+		return
+	}
+
+	batch, file, ok := iph.readRawUpload(rw, r, params["filename"])
+	if !ok {
+		return
+	}
+	batch.permit = permit
+
+	if !iph.addToBatch(rw, batch, file) {
+		return
+	}
+
+	iph.writeBatchResponse(rw, r, batch)
+}
+
+// readRawUpload reads the request body as a single file, false means the response is already written
+func (iph ImagePostHandler) readRawUpload(
+	rw http.ResponseWriter,
+	r *http.Request,
+	fileName string,
+) (batch *uploadBatch, file uploadedFile, ok bool) {
+	uploadMode, uploadRules, ok := iph.readUploadSettings(rw, r.URL.Query())
+	if !ok {
+		return nil, file, false
+	}
+
+	batch = newUploadBatch(RawUploadFieldName, uploadMode, uploadRules)
+
+	file, err := iph.readUploadedFile(fileName, r.Body)
+	if err != nil {
+		iph.abortUpload(rw, err, batch)
+		return nil, file, false
+	}
+	io.OutputInfo("", "Read raw file '%s' of %d bytes", file.originalFileName, file.size)
+
+	return batch, file, true
+}
@@ -0,0 +1,153 @@
+package assets
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/breathbath/go_utils/utils/env"
+	"github.com/breathbath/go_utils/utils/io"
+	"github.com/breathbath/media-library/authentication"
+	error2 "github.com/breathbath/media-library/error"
+)
+
+const (
+	// RemoteUploadPath is the path under URL_PREFIX where images are uploaded by their urls
+	RemoteUploadPath = "remote"
+	// RemoteUploadFieldName is the JSON field of the urls list, validation errors are reported under it
+	RemoteUploadFieldName = "urls"
+	// ViolationDownloadFailed is given for remote files which couldn't be fetched
+	ViolationDownloadFailed = "download_failed"
+)
+
+const (
+	maxRemoteUploadRequestBytes = 1024 * 1024
+	defaultRemoteUploadMaxURLs  = 10
+	defaultRemoteFileName       = "image"
+)
+
+type remoteUploadRequest struct {
+	URLs []string `json:"urls"`
+}
+
+// RemoteUploadHandler fetches images by their urls and saves them like files posted to ImagePostHandler
+type RemoteUploadHandler struct {
+	postHandler ImagePostHandler
+	downloader  ImageDownloader
+	maxURLs     int
+}
+
+func NewRemoteUploadHandler(postHandler ImagePostHandler) RemoteUploadHandler {
+	return RemoteUploadHandler{
+		postHandler: postHandler,
+		downloader: NewImageDownloader(
+			time.Duration(env.ReadEnvInt("REMOTE_UPLOAD_TIMEOUT_SECONDS", defaultDownloadTimeoutSeconds))*time.Second,
+			int(env.ReadEnvInt("REMOTE_UPLOAD_MAX_REDIRECTS", defaultDownloadMaxRedirects)),
+			int64(postHandler.maxUploadFileSizeMb*bytesInMb),
+			env.ReadEnv("REMOTE_UPLOAD_ALLOW_PRIVATE_NETWORKS", "false") == "true",
+		),
+		maxURLs: int(env.ReadEnvInt("REMOTE_UPLOAD_MAX_URLS", defaultRemoteUploadMaxURLs)),
+	}
+}
+
+func (ruh RemoteUploadHandler) HandlePost(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+
+	if !authentication.Authorize(rw, r, authentication.ScopeUpload, "") {
+		return
+	}
+
+	uploadRequest := remoteUploadRequest{}
+	err := json.NewDecoder(http.MaxBytesReader(rw, r.Body, maxRemoteUploadRequestBytes)).Decode(&uploadRequest)
+	if err != nil {
+		io.OutputWarning("", "Invalid remote upload request: %v", err)
+		writeFieldErrors(rw, http.StatusBadRequest, error2.ValidationErrors{
+			RemoteUploadFieldName: {"Should be a JSON object with the list of image urls"},
+		})
+		return
+	}
+
+	if len(uploadRequest.URLs) == 0 {
+		writeFieldErrors(rw, http.StatusBadRequest, error2.ValidationErrors{
+			RemoteUploadFieldName: {"Should contain at least 1 element"},
+		})
+		return
+	}
+
+	if ruh.maxURLs > 0 && len(uploadRequest.URLs) > ruh.maxURLs {
+		writeFieldErrors(rw, http.StatusBadRequest, error2.ValidationErrors{
+			RemoteUploadFieldName: {fmt.Sprintf("Should contain at most %d elements", ruh.maxURLs)},
+		})
+		return
+	}
+
+	uploadMode, uploadRules, ok := ruh.postHandler.readUploadSettings(rw, r.URL.Query())
+	if !ok {
+		return
+	}
+
+	batch := newUploadBatch(RemoteUploadFieldName, uploadMode, uploadRules)
+	for _, rawURL := range uploadRequest.URLs {
+		io.OutputInfo("", "Got remote file to save: %s", rawURL)
+		if !ruh.postHandler.addToBatch(rw, batch, ruh.downloadFile(r, rawURL)) {
+			return
+		}
+	}
+
+	ruh.postHandler.writeBatchResponse(rw, r, batch)
+}
+
+// downloadFile fetches the remote file, failures are given as violations, so that they are reported per url,
+// the failure details are only logged, otherwise clients could probe hosts and ports behind the service
+func (ruh RemoteUploadHandler) downloadFile(r *http.Request, rawURL string) uploadedFile {
+	fileName := remoteFileName(rawURL)
+
+	content := &bytes.Buffer{}
+	_, err := ruh.downloader.Download(r.Context(), rawURL, content)
+
+	var tooLargeErr DownloadTooLargeError
+	if errors.As(err, &tooLargeErr) {
+		io.OutputWarning("", "Remote file '%s' is too large", rawURL)
+		return uploadedFile{
+			originalFileName: fileName,
+			violations:       []error2.Violation{buildFileTooLargeViolation(ruh.postHandler.maxUploadFileSizeMb)},
+		}
+	}
+
+	if err == nil {
+		var file uploadedFile
+		file, err = ruh.postHandler.readUploadedFile(fileName, content)
+		if err == nil {
+			return file
+		}
+	}
+
+	io.OutputWarning("", "Failed to download remote file '%s': %v", rawURL, err)
+	return uploadedFile{
+		originalFileName: fileName,
+		violations: []error2.Violation{{
+			Code:    ViolationDownloadFailed,
+			Message: "The file cannot be downloaded",
+		}},
+	}
+}
+
+// remoteFileName gives the last segment of the url path, the extension is added later from the detected type if missing
+func remoteFileName(rawURL string) string {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return defaultRemoteFileName
+	}
+
+	fileName := path.Base(parsedURL.Path)
+	if fileName == "." || fileName == "/" {
+		return defaultRemoteFileName
+	}
+
+	return fileName
+}
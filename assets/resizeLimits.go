@@ -0,0 +1,89 @@
+package assets
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/breathbath/go_utils/utils/env"
+	"github.com/breathbath/media-library/filesystem"
+)
+
+// ResizeLimits restricts sizes which clients can request, so that the resized images cache stays bounded,
+// sizes defined by presets are always allowed
+type ResizeLimits struct {
+	allowedSizes map[string]bool
+	maxWidth     int
+	maxHeight    int
+}
+
+func NewResizeLimits() (ResizeLimits, error) {
+	resizeLimits := ResizeLimits{
+		allowedSizes: map[string]bool{},
+		maxWidth:     int(env.ReadEnvInt("RESIZE_MAX_WIDTH", 0)),
+		maxHeight:    int(env.ReadEnvInt("RESIZE_MAX_HEIGHT", 0)),
+	}
+
+	rawAllowedSizes := env.ReadEnv("RESIZE_ALLOWED_SIZES", "")
+	if rawAllowedSizes == "" {
+		return resizeLimits, nil
+	}
+
+	sizeRegex := regexp.MustCompile(`^(\d*)x(\d*)$`)
+	for _, rawSize := range strings.Split(rawAllowedSizes, ",") {
+		rawSize = strings.TrimSpace(rawSize)
+		matches := sizeRegex.FindStringSubmatch(rawSize)
+		if len(matches) == 0 || rawSize == "x" {
+			return ResizeLimits{}, fmt.Errorf(
+				"invalid size '%s' in RESIZE_ALLOWED_SIZES, expected format is WIDTHxHEIGHT, WIDTHx or xHEIGHT",
+				rawSize,
+			)
+		}
+
+		width, _ := strconv.Atoi(matches[1])
+		height, _ := strconv.Atoi(matches[2])
+		resizeLimits.allowedSizes[buildSizeKey(width, height)] = true
+	}
+
+	return resizeLimits, nil
+}
+
+// IsAllowed checks the requested sizes, missing width or height is matched only by an allowed size with the same missing side,
+// with allowed sizes quality and background params are rejected too, since each of their values would be cached separately
+func (rl ResizeLimits) IsAllowed(imagePath *filesystem.ImagePath) bool {
+	if imagePath.PresetName != "" {
+		return true
+	}
+
+	if rl.maxWidth > 0 && imagePath.Width > rl.maxWidth {
+		return false
+	}
+
+	if rl.maxHeight > 0 && imagePath.Height > rl.maxHeight {
+		return false
+	}
+
+	if len(rl.allowedSizes) == 0 {
+		return true
+	}
+
+	// resize modes and gravities are short fixed lists, so they can't flood the cache
+	if imagePath.Quality > 0 || (imagePath.Background != "" && imagePath.Background != DefaultPadBackground) {
+		return false
+	}
+
+	return rl.allowedSizes[buildSizeKey(imagePath.Width, imagePath.Height)]
+}
+
+func buildSizeKey(width, height int) string {
+	key := "x"
+	if width > 0 {
+		key = strconv.Itoa(width) + key
+	}
+	if height > 0 {
+		key += strconv.Itoa(height)
+	}
+
+	return key
+}
@@ -0,0 +1,45 @@
+package assets
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/breathbath/go_utils/utils/io"
+)
+
+// SignedURLHandler rejects resize requests without a valid signature before they reach the file server,
+// requests for original images are passed through unchanged
+type SignedURLHandler struct {
+	signer URLSigner
+	next   http.Handler
+}
+
+func NewSignedURLHandler(signer URLSigner, next http.Handler) SignedURLHandler {
+	return SignedURLHandler{
+		signer: signer,
+		next:   next,
+	}
+}
+
+func (suh SignedURLHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if !suh.signer.IsEnabled() || !isResizeRequestPath(r.URL.Path) {
+		suh.next.ServeHTTP(rw, r)
+		return
+	}
+
+	err := suh.signer.Verify(r.URL.Path, r.URL.Query(), time.Now())
+	if err != nil {
+		io.OutputWarning("", "Rejected resize request '%s': %v", r.URL.Path, err)
+		rw.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	suh.next.ServeHTTP(rw, r)
+}
+
+// isResizeRequestPath tells if the path has a transformation segment before the folder and image name
+func isResizeRequestPath(path string) bool {
+	const resizePathItemsCount = 3
+	return len(strings.Split(strings.Trim(path, "/"), "/")) >= resizePathItemsCount
+}
@@ -0,0 +1,608 @@
+package assets
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	goio "io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/breathbath/go_utils/utils/env"
+	"github.com/breathbath/go_utils/utils/io"
+	"github.com/breathbath/media-library/authentication"
+	"github.com/gorilla/mux"
+)
+
+const (
+	TusVersion        = "1.0.0"
+	TusExtensions     = "creation,expiration,termination"
+	TusOffsetMimeType = "application/offset+octet-stream"
+	// ImagePathHeader gives the path of the saved image after the last chunk of a resumable upload
+	ImagePathHeader = "Media-Image-Path"
+	// TusUploadFieldName is the key of validation errors of images uploaded with resumable uploads
+	TusUploadFieldName = "file"
+	// TusUploadsPath is the path under URL_PREFIX where resumable uploads are created
+	TusUploadsPath = "uploads"
+)
+
+const (
+	tusUploadIDBytes          = 16
+	tusInfoFileExt            = ".json"
+	tusDataFileExt            = ".bin"
+	defaultTusExpirationHours = 24
+	tusCleanupInterval        = time.Hour
+)
+
+// tusUpload is the state of a resumable upload stored next to its data in the staging folder, Query keeps
+// the upload settings of the creation request and Permit the restrictions of the presigned upload url it was created with
+type tusUpload struct {
+	ID        string                       `json:"id"`
+	Length    int64                        `json:"length"`
+	Metadata  string                       `json:"metadata"`
+	FileName  string                       `json:"filename"`
+	Query     string                       `json:"query,omitempty"`
+	Permit    *authentication.UploadPermit `json:"permit,omitempty"`
+	ImagePath string                       `json:"image_path,omitempty"`
+	Created   time.Time                    `json:"created"`
+}
+
+// TusUploadHandler implements the tus.io resumable upload protocol, chunks are assembled in the staging folder
+// and the completed file is saved like files posted to ImagePostHandler, expired uploads are removed periodically
+// until Close is called
+type TusUploadHandler struct {
+	postHandler ImagePostHandler
+	stagingPath string
+	expiration  time.Duration
+	uploadLocks *sync.Map
+	stopCleanup chan struct{}
+	closeOnce   *sync.Once
+}
+
+func NewTusUploadHandler(postHandler ImagePostHandler) (TusUploadHandler, error) {
+	stagingPath := env.ReadEnv("TUS_STAGING_PATH", "")
+	if stagingPath == "" {
+		stagingPath = filepath.Join(os.TempDir(), "media-library-uploads")
+		// chunks of an upload can reach another instance, which doesn't see the local folder
+		if env.ReadEnv("STORAGE_DRIVER", "local") != "local" {
+			io.OutputWarning(
+				"",
+				"TUS_STAGING_PATH is not set, resumable uploads are staged in the local folder '%s', "+
+					"set it to a folder shared by all instances of the service",
+				stagingPath,
+			)
+		}
+	}
+
+	err := os.MkdirAll(stagingPath, os.ModePerm)
+	if err != nil {
+		return TusUploadHandler{}, fmt.Errorf("failed to create TUS_STAGING_PATH '%s': %v", stagingPath, err)
+	}
+
+	tuh := TusUploadHandler{
+		postHandler: postHandler,
+		stagingPath: stagingPath,
+		expiration:  time.Duration(env.ReadEnvInt("TUS_UPLOAD_EXPIRATION_HOURS", defaultTusExpirationHours)) * time.Hour,
+		uploadLocks: &sync.Map{},
+		stopCleanup: make(chan struct{}),
+		closeOnce:   &sync.Once{},
+	}
+	go tuh.removeExpiredUploadsPeriodically(tusCleanupInterval)
+
+	return tuh, nil
+}
+
+// Close stops the periodic removal of expired uploads
+func (tuh TusUploadHandler) Close() {
+	tuh.closeOnce.Do(func() {
+		close(tuh.stopCleanup)
+	})
+}
+
+func (tuh TusUploadHandler) maxSize() int64 {
+	return int64(tuh.postHandler.maxUploadFileSizeMb * bytesInMb)
+}
+
+// HandleOptions gives the capabilities of the server, it doesn't need authentication
+func (tuh TusUploadHandler) HandleOptions(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Tus-Resumable", TusVersion)
+	rw.Header().Set("Tus-Version", TusVersion)
+	rw.Header().Set("Tus-Extension", TusExtensions)
+	rw.Header().Set("Tus-Max-Size", strconv.FormatInt(tuh.maxSize(), 10))
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// checkRequest validates the token and the protocol version, the response is written if the request can't be handled,
+// requests authorized by a presigned upload url get its permit
+func (tuh TusUploadHandler) checkRequest(rw http.ResponseWriter, r *http.Request) (*authentication.UploadPermit, bool) {
+	rw.Header().Set("Tus-Resumable", TusVersion)
+
+	permit, ok := tuh.postHandler.authorizeUpload(rw, r)
+	if !ok {
+		return nil, false
+	}
+
+	if r.Header.Get("Tus-Resumable") != TusVersion {
+		io.OutputWarning("", "Unsupported tus version '%s'", r.Header.Get("Tus-Resumable"))
+		rw.Header().Set("Tus-Version", TusVersion)
+		rw.WriteHeader(http.StatusPreconditionFailed)
+		return nil, false
+	}
+
+	return permit, true
+}
+
+// HandleCreate starts a new upload, the client gets its url in the Location header, the upload mode and rules
+// of the request are applied once the upload is completed
+func (tuh TusUploadHandler) HandleCreate(rw http.ResponseWriter, r *http.Request) {
+	permit, ok := tuh.checkRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		io.OutputWarning("", "Invalid Upload-Length '%s'", r.Header.Get("Upload-Length"))
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	maxSize := tuh.maxSize()
+	if permit != nil && int64(permit.MaxFileSizeMb*bytesInMb) < maxSize {
+		maxSize = int64(permit.MaxFileSizeMb * bytesInMb)
+	}
+	if length > maxSize {
+		io.OutputWarning("", "Upload-Length %d exceeds the limit of %d bytes", length, maxSize)
+		rw.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// invalid settings are rejected before the upload, rather than after all chunks are sent
+	query := r.URL.Query()
+	query.Del(UploadTokenQueryParam)
+	rw.Header().Set("Content-Type", "application/json")
+	_, _, ok = tuh.postHandler.readUploadSettings(rw, query)
+	if !ok {
+		return
+	}
+	rw.Header().Del("Content-Type")
+
+	upload := tusUpload{
+		Length:   length,
+		Metadata: r.Header.Get("Upload-Metadata"),
+		FileName: parseTusMetadata(r.Header.Get("Upload-Metadata"))["filename"],
+		Query:    query.Encode(),
+		Permit:   permit,
+		Created:  time.Now().UTC(),
+	}
+
+	upload.ID, err = generateTusUploadID()
+	if err != nil {
+		io.OutputError(err, "", "Failed to generate upload id")
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = ioutil.WriteFile(tuh.buildDataPath(upload.ID), []byte{}, 0600)
+	if err != nil {
+		io.OutputError(err, "", "Failed to create upload data file")
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = tuh.saveUpload(upload)
+	if err != nil {
+		io.OutputError(err, "", "Failed to save upload '%s'", upload.ID)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	io.OutputInfo("", "Created upload '%s' of %d bytes for file '%s'", upload.ID, upload.Length, upload.FileName)
+	location := tuh.postHandler.buildBaseURL(r) + "/" + TusUploadsPath + "/" + upload.ID
+	if permit != nil {
+		// the chunks are sent to the location, so they are authorized by the same upload url
+		location += "?" + url.Values{UploadTokenQueryParam: {r.URL.Query().Get(UploadTokenQueryParam)}}.Encode()
+	}
+	rw.Header().Set("Location", location)
+	rw.Header().Set("Upload-Expires", tuh.buildExpiration(upload))
+	rw.WriteHeader(http.StatusCreated)
+}
+
+// HandleHead gives the offset of the upload, so that the client can resume it
+func (tuh TusUploadHandler) HandleHead(rw http.ResponseWriter, r *http.Request) {
+	permit, ok := tuh.checkRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	uploadID := mux.Vars(r)["id"]
+	uploadLock, ok := tuh.lockUpload(rw, uploadID)
+	if !ok {
+		return
+	}
+	defer uploadLock.Unlock()
+
+	upload, offset, ok := tuh.readUploadState(rw, uploadID, permit)
+	if !ok {
+		return
+	}
+
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	rw.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.Metadata != "" {
+		rw.Header().Set("Upload-Metadata", upload.Metadata)
+	}
+	if upload.ImagePath != "" {
+		rw.Header().Set(ImagePathHeader, upload.ImagePath)
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+// HandlePatch appends a chunk to the upload, after the last chunk the image is validated and saved
+func (tuh TusUploadHandler) HandlePatch(rw http.ResponseWriter, r *http.Request) { // nolint:funlen
+	permit, ok := tuh.checkRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != TusOffsetMimeType {
+		rw.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	uploadID := mux.Vars(r)["id"]
+	uploadLock, ok := tuh.lockUpload(rw, uploadID)
+	if !ok {
+		return
+	}
+	defer uploadLock.Unlock()
+
+	upload, offset, ok := tuh.readUploadState(rw, uploadID, permit)
+	if !ok {
+		return
+	}
+
+	requestOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || requestOffset != offset || upload.ImagePath != "" {
+		io.OutputWarning("", "Upload-Offset '%s' doesn't match offset %d of upload '%s'", r.Header.Get("Upload-Offset"), offset, uploadID)
+		rw.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	if r.ContentLength > upload.Length-offset {
+		rw.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	dataFile, err := os.OpenFile(tuh.buildDataPath(uploadID), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		io.OutputError(err, "", "Failed to open data of upload '%s'", uploadID)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// received bytes are kept even if the connection drops, so that the client can resume from them
+	written, err := goio.Copy(dataFile, goio.LimitReader(r.Body, upload.Length-offset))
+	closeErr := dataFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		io.OutputError(err, "", "Failed to write chunk of upload '%s' after %d bytes", uploadID, written)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	offset += written
+	rw.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	rw.Header().Set("Upload-Expires", tuh.buildExpiration(upload))
+	if offset < upload.Length {
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	tuh.completeUpload(rw, r, upload)
+}
+
+// completeUpload saves the assembled file like a posted one with the settings and the permit of the upload,
+// the upload state is kept after success, so that a client which lost the response can still get the image path
+// with a HEAD request, rejected uploads are removed
+func (tuh TusUploadHandler) completeUpload(rw http.ResponseWriter, r *http.Request, upload tusUpload) {
+	rw.Header().Set("Content-Type", "application/json")
+
+	// the response is built for the settings of the creation request
+	r = r.Clone(r.Context())
+	r.URL.RawQuery = upload.Query
+	uploadMode, uploadRules, ok := tuh.postHandler.readUploadSettings(rw, r.URL.Query())
+	if !ok {
+		tuh.removeUpload(upload.ID)
+		return
+	}
+	batch := newUploadBatch(TusUploadFieldName, uploadMode, uploadRules)
+	batch.permit = upload.Permit
+
+	dataFile, err := os.Open(tuh.buildDataPath(upload.ID))
+	if err != nil {
+		io.OutputError(err, "", "Failed to open data of upload '%s'", upload.ID)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	fileName := upload.FileName
+	if fileName == "" {
+		fileName = upload.ID
+	}
+
+	file, err := tuh.postHandler.readUploadedFile(fileName, dataFile)
+	closeErr := dataFile.Close()
+	if closeErr != nil {
+		io.OutputError(closeErr, "", "Failed to close data of upload '%s'", upload.ID)
+	}
+	if err != nil {
+		io.OutputError(err, "", "Failed to read data of upload '%s'", upload.ID)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// after a server error the upload is kept, so that the client can complete it again
+	if !tuh.postHandler.addToBatch(rw, batch, file) {
+		return
+	}
+
+	// the permit is consumed before the response, so that the upload keeps the path only if the image is kept
+	if !tuh.postHandler.consumePermit(rw, batch) {
+		return
+	}
+	batch.permit = nil
+
+	if len(batch.filesToReturn) == 0 {
+		// unlike failed uploads, rejected ones can't be completed again
+		if len(batch.validationErrors) > 0 {
+			tuh.removeUpload(upload.ID)
+		}
+		tuh.postHandler.writeBatchResponse(rw, r, batch)
+		return
+	}
+
+	upload.ImagePath = batch.filesToReturn[0].Path
+	err = tuh.saveUpload(upload)
+	if err != nil {
+		io.OutputError(err, "", "Failed to save upload '%s'", upload.ID)
+	}
+
+	err = os.Remove(tuh.buildDataPath(upload.ID))
+	if err != nil {
+		io.OutputError(err, "", "Failed to remove data of upload '%s'", upload.ID)
+	}
+
+	io.OutputInfo("", "Completed upload '%s' as '%s'", upload.ID, upload.ImagePath)
+	rw.Header().Set(ImagePathHeader, upload.ImagePath)
+	tuh.postHandler.writeBatchResponse(rw, r, batch)
+}
+
+// HandleDelete terminates the upload and removes its data
+func (tuh TusUploadHandler) HandleDelete(rw http.ResponseWriter, r *http.Request) {
+	permit, ok := tuh.checkRequest(rw, r)
+	if !ok {
+		return
+	}
+
+	uploadID := mux.Vars(r)["id"]
+	uploadLock, ok := tuh.lockUpload(rw, uploadID)
+	if !ok {
+		return
+	}
+	defer uploadLock.Unlock()
+
+	upload, _, ok := tuh.readUploadState(rw, uploadID, permit)
+	if !ok {
+		return
+	}
+
+	tuh.removeUpload(upload.ID)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// lockUpload takes the lock of the upload, so that a chunk being written isn't read or removed by concurrent requests,
+// the lock is held by one instance of the service, so requests of an upload are expected to reach the same instance,
+// false means the response is already written
+func (tuh TusUploadHandler) lockUpload(rw http.ResponseWriter, uploadID string) (*sync.Mutex, bool) {
+	if !isValidTusUploadID(uploadID) {
+		rw.WriteHeader(http.StatusNotFound)
+		return nil, false
+	}
+
+	lock, _ := tuh.uploadLocks.LoadOrStore(uploadID, &sync.Mutex{})
+	uploadLock := lock.(*sync.Mutex)
+	if !uploadLock.TryLock() {
+		io.OutputWarning("", "Upload '%s' is already being written", uploadID)
+		rw.WriteHeader(http.StatusConflict)
+		return nil, false
+	}
+
+	return uploadLock, true
+}
+
+// readUploadState gives the upload and the count of received bytes, 404 is written for unknown or expired uploads
+// and for uploads created with another presigned upload url than the request
+func (tuh TusUploadHandler) readUploadState(
+	rw http.ResponseWriter,
+	uploadID string,
+	permit *authentication.UploadPermit,
+) (upload tusUpload, offset int64, ok bool) {
+	if !isValidTusUploadID(uploadID) {
+		rw.WriteHeader(http.StatusNotFound)
+		return tusUpload{}, 0, false
+	}
+
+	rawUpload, err := ioutil.ReadFile(tuh.buildInfoPath(uploadID))
+	if os.IsNotExist(err) {
+		rw.WriteHeader(http.StatusNotFound)
+		return tusUpload{}, 0, false
+	}
+
+	if err == nil {
+		err = json.Unmarshal(rawUpload, &upload)
+	}
+
+	if err != nil {
+		io.OutputError(err, "", "Failed to read upload '%s'", uploadID)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return tusUpload{}, 0, false
+	}
+
+	if tuh.isExpired(upload) {
+		tuh.removeUpload(uploadID)
+		rw.WriteHeader(http.StatusNotFound)
+		return tusUpload{}, 0, false
+	}
+
+	if permit != nil && (upload.Permit == nil || upload.Permit.ID != permit.ID) {
+		io.OutputWarning("", "Upload '%s' is requested with another upload token", uploadID)
+		rw.WriteHeader(http.StatusNotFound)
+		return tusUpload{}, 0, false
+	}
+
+	if upload.ImagePath != "" {
+		return upload, upload.Length, true
+	}
+
+	dataFileInfo, err := os.Stat(tuh.buildDataPath(uploadID))
+	if err != nil {
+		io.OutputError(err, "", "Failed to read data of upload '%s'", uploadID)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return tusUpload{}, 0, false
+	}
+
+	return upload, dataFileInfo.Size(), true
+}
+
+func (tuh TusUploadHandler) saveUpload(upload tusUpload) error {
+	rawUpload, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(tuh.buildInfoPath(upload.ID), rawUpload, 0600)
+}
+
+func (tuh TusUploadHandler) removeUpload(uploadID string) {
+	for _, filePath := range []string{tuh.buildDataPath(uploadID), tuh.buildInfoPath(uploadID)} {
+		err := os.Remove(filePath)
+		if err != nil && !os.IsNotExist(err) {
+			io.OutputError(err, "", "Failed to remove '%s'", filePath)
+		}
+	}
+	tuh.uploadLocks.Delete(uploadID)
+}
+
+func (tuh TusUploadHandler) removeExpiredUploadsPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		tuh.removeExpiredUploads()
+
+		select {
+		case <-tuh.stopCleanup:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// removeExpiredUploads cleans the staging folder from uploads which clients never completed,
+// uploads which are being written are skipped
+func (tuh TusUploadHandler) removeExpiredUploads() {
+	infoPaths, err := filepath.Glob(filepath.Join(tuh.stagingPath, "*"+tusInfoFileExt))
+	if err != nil {
+		io.OutputError(err, "", "Failed to list uploads")
+		return
+	}
+
+	for _, infoPath := range infoPaths {
+		upload := tusUpload{}
+		rawUpload, err := ioutil.ReadFile(infoPath)
+		if err == nil {
+			err = json.Unmarshal(rawUpload, &upload)
+		}
+		if err != nil || !tuh.isExpired(upload) || !isValidTusUploadID(upload.ID) {
+			continue
+		}
+
+		lock, _ := tuh.uploadLocks.LoadOrStore(upload.ID, &sync.Mutex{})
+		uploadLock := lock.(*sync.Mutex)
+		if !uploadLock.TryLock() {
+			continue
+		}
+
+		io.OutputInfo("", "Removing expired upload '%s'", upload.ID)
+		tuh.removeUpload(upload.ID)
+		uploadLock.Unlock()
+	}
+}
+
+func (tuh TusUploadHandler) isExpired(upload tusUpload) bool {
+	return time.Since(upload.Created) > tuh.expiration
+}
+
+func (tuh TusUploadHandler) buildExpiration(upload tusUpload) string {
+	return upload.Created.Add(tuh.expiration).Format(http.TimeFormat)
+}
+
+func (tuh TusUploadHandler) buildInfoPath(uploadID string) string {
+	return filepath.Join(tuh.stagingPath, uploadID+tusInfoFileExt)
+}
+
+func (tuh TusUploadHandler) buildDataPath(uploadID string) string {
+	return filepath.Join(tuh.stagingPath, uploadID+tusDataFileExt)
+}
+
+func generateTusUploadID() (string, error) {
+	idBytes := make([]byte, tusUploadIDBytes)
+	_, err := rand.Read(idBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(idBytes), nil
+}
+
+func isValidTusUploadID(uploadID string) bool {
+	_, err := hex.DecodeString(uploadID)
+	return err == nil && len(uploadID) == tusUploadIDBytes*2
+}
+
+// parseTusMetadata reads the Upload-Metadata header which has comma separated keys with base64 encoded values
+func parseTusMetadata(rawMetadata string) map[string]string {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(rawMetadata, ",") {
+		keyValue := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+		if keyValue[0] == "" {
+			continue
+		}
+
+		value := ""
+		if len(keyValue) == 2 {
+			decodedValue, err := base64.StdEncoding.DecodeString(keyValue[1])
+			if err != nil {
+				io.OutputWarning("", "Invalid base64 value of upload metadata key '%s'", keyValue[0])
+				continue
+			}
+			value = string(decodedValue)
+		}
+		metadata[keyValue[0]] = value
+	}
+
+	return metadata
+}
@@ -0,0 +1,148 @@
+package assets
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/breathbath/go_utils/utils/io"
+	"github.com/breathbath/media-library/authentication"
+	error2 "github.com/breathbath/media-library/error"
+)
+
+// uploadBatch collects results of files uploaded in one request, so that all upload endpoints give the same responses
+type uploadBatch struct {
+	fieldName            string
+	uploadMode           string
+	uploadRules          UploadRules
+	folderName           string
+	savedStatus          int
+	permit               *authentication.UploadPermit
+	filesToReturn        []*UploadedImage
+	fileStatuses         []UploadFileStatus
+	validationErrors     error2.ValidationErrors
+	fileValidationErrors []error2.FileValidationError
+}
+
+func newUploadBatch(fieldName, uploadMode string, uploadRules UploadRules) *uploadBatch {
+	return &uploadBatch{
+		fieldName:            fieldName,
+		uploadMode:           uploadMode,
+		uploadRules:          uploadRules,
+		folderName:           uniqid(),
+		savedStatus:          http.StatusOK,
+		filesToReturn:        []*UploadedImage{},
+		fileStatuses:         []UploadFileStatus{},
+		validationErrors:     error2.NewValidationErrors(),
+		fileValidationErrors: []error2.FileValidationError{},
+	}
+}
+
+// addToBatch validates and saves the file, false means the request failed and the response is already written
+func (iph ImagePostHandler) addToBatch(rw http.ResponseWriter, batch *uploadBatch, file uploadedFile) bool {
+	i := len(batch.fileStatuses)
+
+	if batch.permit != nil {
+		if i >= batch.permit.MaxFiles {
+			io.OutputWarning("", "Upload token '%s' allows only %d files", batch.permit.ID, batch.permit.MaxFiles)
+			iph.rollback(batch.folderName, batch.filesToReturn)
+			writeFieldErrors(rw, http.StatusBadRequest, error2.ValidationErrors{
+				batch.fieldName: {fmt.Sprintf("Should contain at most %d elements", batch.permit.MaxFiles)},
+			})
+			return false
+		}
+		file.violations = append(file.violations, validateUploadPermit(file, *batch.permit)...)
+	}
+
+	statusErr, uploadedImage := iph.handleUploadedFile(file, batch.uploadRules, batch.folderName)
+	batch.fileStatuses = append(batch.fileStatuses, buildUploadFileStatus(i, file.originalFileName, statusErr, uploadedImage))
+
+	if statusErr.Error != nil {
+		io.OutputError(statusErr.Error, "", statusErr.Text)
+		if batch.uploadMode == UploadModePartial {
+			return true
+		}
+		// the client doesn't get the paths of the files saved before, so they are removed
+		// and the upload permit stays unused
+		iph.rollback(batch.folderName, batch.filesToReturn)
+		rw.WriteHeader(statusErr.Status)
+		return false
+	}
+
+	if len(statusErr.Violations) > 0 {
+		batch.validationErrors.AddViolations(batch.fieldName, statusErr.Violations)
+		batch.fileValidationErrors = append(batch.fileValidationErrors, error2.FileValidationError{
+			Index:      i,
+			Filename:   file.originalFileName,
+			Field:      batch.fieldName,
+			Violations: statusErr.Violations,
+		})
+	}
+
+	if uploadedImage != nil {
+		batch.filesToReturn = append(batch.filesToReturn, uploadedImage)
+	}
+
+	return true
+}
+
+func (iph ImagePostHandler) writeBatchResponse(rw http.ResponseWriter, r *http.Request, batch *uploadBatch) {
+	if !iph.consumePermit(rw, batch) {
+		return
+	}
+
+	if batch.uploadMode == UploadModePartial {
+		iph.writePartialResponse(rw, r, batch.fileStatuses)
+		return
+	}
+
+	if batch.uploadMode == UploadModeAtomic && len(batch.validationErrors) > 0 {
+		iph.rollback(batch.folderName, batch.filesToReturn)
+	}
+
+	if len(batch.validationErrors) > 0 {
+		body, err := json.Marshal(batch.validationErrors)
+		if isV2ResponseRequested(r) {
+			body, err = json.Marshal(struct {
+				Errors []error2.FileValidationError `json:"errors"`
+			}{
+				Errors: batch.fileValidationErrors,
+			})
+		}
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			io.OutputError(err, "", "cannot generate response for validation errors")
+			return
+		}
+		io.OutputError(fmt.Errorf("validation errors for incoming file: %s", string(body)), "", "Validation failure")
+		rw.WriteHeader(http.StatusBadRequest)
+		_, err = rw.Write(body)
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			io.OutputError(err, "", "cannot send json data")
+		}
+
+		return
+	}
+
+	if len(batch.filesToReturn) == 0 {
+		rw.WriteHeader(http.StatusBadRequest)
+		io.OutputWarning("", "No files were submitted")
+		err := json.NewEncoder(rw).Encode(map[string][]string{
+			batch.fieldName: {"Should contain at least 1 element"},
+		})
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			io.OutputError(err, "", "Cannot send json data")
+		}
+		return
+	}
+
+	rw.WriteHeader(batch.savedStatus)
+	err := json.NewEncoder(rw).Encode(iph.buildResponse(r, batch.filesToReturn))
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		io.OutputError(err, "", "Cannot send json data")
+		return
+	}
+}
@@ -0,0 +1,347 @@
+package assets
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/breathbath/go_utils/utils/env"
+	error2 "github.com/breathbath/media-library/error"
+)
+
+const (
+	ViolationWidthTooSmall         = "width_too_small"
+	ViolationWidthTooLarge         = "width_too_large"
+	ViolationHeightTooSmall        = "height_too_small"
+	ViolationHeightTooLarge        = "height_too_large"
+	ViolationTooManyPixels         = "too_many_pixels"
+	ViolationAspectRatioNotAllowed = "aspect_ratio_not_allowed"
+	ViolationImageNotDecodable     = "image_not_decodable"
+)
+
+const (
+	aspectRatioTolerance           = 0.0001
+	aspectRatioRangeSeparator      = "-"
+	aspectRatioSidesSeparator      = ":"
+	aspectRatioRangesListSeparator = ","
+	// exif orientations from 5 to 8 rotate the image by 90 or 270 degrees
+	firstRotatingExifOrientation = 5
+	lastRotatingExifOrientation  = 8
+)
+
+// AspectRatioRange is the inclusive range of allowed width to height ratios
+type AspectRatioRange struct {
+	Min float64
+	Max float64
+}
+
+func (arr AspectRatioRange) String() string {
+	if arr.Min == arr.Max {
+		return strconv.FormatFloat(arr.Min, 'f', -1, 64)
+	}
+
+	return strconv.FormatFloat(arr.Min, 'f', -1, 64) + aspectRatioRangeSeparator + strconv.FormatFloat(arr.Max, 'f', -1, 64)
+}
+
+// UploadRules restricts dimensions of uploaded images, zero values mean no restriction
+type UploadRules struct {
+	minWidth          int
+	minHeight         int
+	maxWidth          int
+	maxHeight         int
+	maxPixels         int
+	aspectRatioRanges []AspectRatioRange
+}
+
+func NewUploadRules() (UploadRules, error) {
+	aspectRatioRanges, err := parseAspectRatioRanges(env.ReadEnv("UPLOAD_ASPECT_RATIOS", ""))
+	if err != nil {
+		return UploadRules{}, fmt.Errorf("invalid UPLOAD_ASPECT_RATIOS: %v", err)
+	}
+
+	return UploadRules{
+		minWidth:          int(env.ReadEnvInt("UPLOAD_MIN_WIDTH", 0)),
+		minHeight:         int(env.ReadEnvInt("UPLOAD_MIN_HEIGHT", 0)),
+		maxWidth:          int(env.ReadEnvInt("UPLOAD_MAX_WIDTH", 0)),
+		maxHeight:         int(env.ReadEnvInt("UPLOAD_MAX_HEIGHT", 0)),
+		maxPixels:         int(env.ReadEnvInt("UPLOAD_MAX_PIXELS", 0)),
+		aspectRatioRanges: aspectRatioRanges,
+	}, nil
+}
+
+// parseAspectRatioRanges reads a comma separated list of ratios like "1:1" or ranges like "2.9:1-3.1:1" or "1.5-2"
+func parseAspectRatioRanges(rawRanges string) ([]AspectRatioRange, error) {
+	aspectRatioRanges := []AspectRatioRange{}
+	if strings.TrimSpace(rawRanges) == "" {
+		return aspectRatioRanges, nil
+	}
+
+	for _, rawRange := range strings.Split(rawRanges, aspectRatioRangesListSeparator) {
+		rawRange = strings.TrimSpace(rawRange)
+		rawLimits := strings.Split(rawRange, aspectRatioRangeSeparator)
+		const maxLimitsCount = 2
+		if len(rawLimits) > maxLimitsCount {
+			return nil, fmt.Errorf("invalid aspect ratio range '%s', expected format is RATIO or RATIO-RATIO", rawRange)
+		}
+
+		minRatio, err := parseAspectRatio(rawLimits[0])
+		if err != nil {
+			return nil, err
+		}
+
+		maxRatio := minRatio
+		if len(rawLimits) == maxLimitsCount {
+			maxRatio, err = parseAspectRatio(rawLimits[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if minRatio > maxRatio {
+			return nil, fmt.Errorf("invalid aspect ratio range '%s', the minimum is greater than the maximum", rawRange)
+		}
+
+		aspectRatioRanges = append(aspectRatioRanges, AspectRatioRange{Min: minRatio, Max: maxRatio})
+	}
+
+	return aspectRatioRanges, nil
+}
+
+// parseAspectRatio reads ratios given as WIDTH:HEIGHT or as a decimal number
+func parseAspectRatio(rawRatio string) (float64, error) {
+	rawRatio = strings.TrimSpace(rawRatio)
+	rawSides := strings.Split(rawRatio, aspectRatioSidesSeparator)
+	const sidesCount = 2
+	if len(rawSides) > sidesCount {
+		return 0, fmt.Errorf("invalid aspect ratio '%s', expected format is WIDTH:HEIGHT or a decimal number", rawRatio)
+	}
+
+	ratio, err := strconv.ParseFloat(strings.TrimSpace(rawSides[0]), 64)
+	if err != nil || ratio <= 0 || math.IsInf(ratio, 0) {
+		return 0, fmt.Errorf("invalid aspect ratio '%s', expected format is WIDTH:HEIGHT or a decimal number", rawRatio)
+	}
+
+	if len(rawSides) == sidesCount {
+		height, err := strconv.ParseFloat(strings.TrimSpace(rawSides[1]), 64)
+		if err != nil || height <= 0 || math.IsInf(height, 0) {
+			return 0, fmt.Errorf("invalid aspect ratio '%s', expected format is WIDTH:HEIGHT or a decimal number", rawRatio)
+		}
+		ratio /= height
+	}
+
+	return ratio, nil
+}
+
+// WithOverrides applies rules given in the request params, they can only tighten the rules of the server
+func (ur UploadRules) WithOverrides(requestValues url.Values) (UploadRules, error2.ValidationErrors) {
+	validationErrors := error2.NewValidationErrors()
+
+	readOverride := func(fieldName string) int {
+		rawValue := requestValues.Get(fieldName)
+		if rawValue == "" {
+			return 0
+		}
+
+		value, err := strconv.Atoi(rawValue)
+		if err != nil || value <= 0 {
+			validationErrors[fieldName] = []string{"Should be a positive integer"}
+			return 0
+		}
+
+		return value
+	}
+
+	overriddenRules := UploadRules{
+		minWidth:          maxInt(ur.minWidth, readOverride("min_width")),
+		minHeight:         maxInt(ur.minHeight, readOverride("min_height")),
+		maxWidth:          minLimit(ur.maxWidth, readOverride("max_width")),
+		maxHeight:         minLimit(ur.maxHeight, readOverride("max_height")),
+		maxPixels:         minLimit(ur.maxPixels, readOverride("max_pixels")),
+		aspectRatioRanges: ur.aspectRatioRanges,
+	}
+
+	rawAspectRatioRanges := requestValues.Get("aspect_ratios")
+	if rawAspectRatioRanges == "" {
+		return overriddenRules, validationErrors
+	}
+
+	requestedRanges, err := parseAspectRatioRanges(rawAspectRatioRanges)
+	if err != nil {
+		validationErrors["aspect_ratios"] = []string{err.Error()}
+		return overriddenRules, validationErrors
+	}
+
+	overriddenRules.aspectRatioRanges = intersectAspectRatioRanges(ur.aspectRatioRanges, requestedRanges)
+	if len(overriddenRules.aspectRatioRanges) == 0 {
+		validationErrors["aspect_ratios"] = []string{
+			fmt.Sprintf("Should overlap the allowed aspect ratios %s", formatAspectRatioRanges(ur.aspectRatioRanges)),
+		}
+	}
+
+	return overriddenRules, validationErrors
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+// minLimit gives the lowest of two limits, where zero means no limit
+func minLimit(a, b int) int {
+	if a == 0 || (b > 0 && b < a) {
+		return b
+	}
+
+	return a
+}
+
+// intersectAspectRatioRanges gives ratios allowed by both lists, an empty list allows any ratio
+func intersectAspectRatioRanges(serverRanges, requestedRanges []AspectRatioRange) []AspectRatioRange {
+	if len(serverRanges) == 0 {
+		return requestedRanges
+	}
+
+	intersection := []AspectRatioRange{}
+	for _, serverRange := range serverRanges {
+		for _, requestedRange := range requestedRanges {
+			commonRange := AspectRatioRange{
+				Min: math.Max(serverRange.Min, requestedRange.Min),
+				Max: math.Min(serverRange.Max, requestedRange.Max),
+			}
+			if commonRange.Min <= commonRange.Max {
+				intersection = append(intersection, commonRange)
+			}
+		}
+	}
+
+	return intersection
+}
+
+func formatAspectRatioRanges(aspectRatioRanges []AspectRatioRange) string {
+	rawRanges := make([]string, 0, len(aspectRatioRanges))
+	for _, aspectRatioRange := range aspectRatioRanges {
+		rawRanges = append(rawRanges, aspectRatioRange.String())
+	}
+
+	return strings.Join(rawRanges, aspectRatioRangesListSeparator)
+}
+
+// IsEmpty tells if no dimension rules are defined, so that images don't need to be inspected
+func (ur UploadRules) IsEmpty() bool {
+	return ur.minWidth+ur.minHeight+ur.maxWidth+ur.maxHeight+ur.maxPixels == 0 && len(ur.aspectRatioRanges) == 0
+}
+
+// ValidateImage checks dimensions of the uploaded image as it will be stored, i.e. after the exif orientation is applied
+func (ur UploadRules) ValidateImage(source io.ReadSeeker) ([]error2.Violation, error) {
+	width, height, err := readOrientedImageSize(source)
+	if err != nil {
+		return []error2.Violation{{Code: ViolationImageNotDecodable, Message: "The image cannot be decoded"}}, nil
+	}
+
+	_, err = source.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	return ur.validateDimensions(width, height), nil
+}
+
+func (ur UploadRules) validateDimensions(width, height int) []error2.Violation {
+	violations := []error2.Violation{}
+
+	if ur.minWidth > 0 && width < ur.minWidth {
+		violations = append(violations, error2.Violation{
+			Code:    ViolationWidthTooSmall,
+			Message: fmt.Sprintf("The image width %dpx is less than the minimum %dpx", width, ur.minWidth),
+		})
+	}
+
+	if ur.maxWidth > 0 && width > ur.maxWidth {
+		violations = append(violations, error2.Violation{
+			Code:    ViolationWidthTooLarge,
+			Message: fmt.Sprintf("The image width %dpx is greater than the maximum %dpx", width, ur.maxWidth),
+		})
+	}
+
+	if ur.minHeight > 0 && height < ur.minHeight {
+		violations = append(violations, error2.Violation{
+			Code:    ViolationHeightTooSmall,
+			Message: fmt.Sprintf("The image height %dpx is less than the minimum %dpx", height, ur.minHeight),
+		})
+	}
+
+	if ur.maxHeight > 0 && height > ur.maxHeight {
+		violations = append(violations, error2.Violation{
+			Code:    ViolationHeightTooLarge,
+			Message: fmt.Sprintf("The image height %dpx is greater than the maximum %dpx", height, ur.maxHeight),
+		})
+	}
+
+	if ur.maxPixels > 0 && width*height > ur.maxPixels {
+		violations = append(violations, error2.Violation{
+			Code:    ViolationTooManyPixels,
+			Message: fmt.Sprintf("The image has %d pixels, allowed maximum is %d", width*height, ur.maxPixels),
+		})
+	}
+
+	if len(ur.aspectRatioRanges) > 0 && height > 0 && !ur.isAspectRatioAllowed(float64(width)/float64(height)) {
+		violations = append(violations, error2.Violation{
+			Code: ViolationAspectRatioNotAllowed,
+			Message: fmt.Sprintf(
+				"The image aspect ratio %s is not allowed, allowed ratios are %s",
+				strconv.FormatFloat(float64(width)/float64(height), 'f', 2, 64),
+				formatAspectRatioRanges(ur.aspectRatioRanges),
+			),
+		})
+	}
+
+	return violations
+}
+
+func (ur UploadRules) isAspectRatioAllowed(aspectRatio float64) bool {
+	for _, aspectRatioRange := range ur.aspectRatioRanges {
+		if aspectRatio >= aspectRatioRange.Min-aspectRatioTolerance && aspectRatio <= aspectRatioRange.Max+aspectRatioTolerance {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readOrientedImageSize reads sizes from the image header without decoding pixels,
+// sides are swapped for jpeg images which are rotated by 90 degrees with the exif orientation
+func readOrientedImageSize(source io.ReadSeeker) (width, height int, err error) {
+	_, err = source.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	imgConfig, _, err := image.DecodeConfig(source)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	_, err = source.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	exifPayload := readJpegExif(source)
+	if exifPayload == nil {
+		return imgConfig.Width, imgConfig.Height, nil
+	}
+
+	orientation := readExifOrientation(exifPayload)
+	if orientation >= firstRotatingExifOrientation && orientation <= lastRotatingExifOrientation {
+		return imgConfig.Height, imgConfig.Width, nil
+	}
+
+	return imgConfig.Width, imgConfig.Height, nil
+}
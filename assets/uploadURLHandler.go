@@ -0,0 +1,188 @@
+package assets
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/breathbath/go_utils/utils/env"
+	"github.com/breathbath/go_utils/utils/io"
+	"github.com/breathbath/media-library/authentication"
+	error2 "github.com/breathbath/media-library/error"
+)
+
+const (
+	// UploadURLsPath is the path under URL_PREFIX where presigned upload urls are created
+	UploadURLsPath = "upload-urls"
+	// UploadTokenQueryParam authorizes a posted upload instead of the bearer token
+	UploadTokenQueryParam = "upload_token"
+)
+
+const (
+	defaultUploadURLMaxTTLSeconds = 900
+	maxUploadURLRequestBytes      = 64 * 1024
+)
+
+type uploadURLRequest struct {
+	MaxSizeMb  float64  `json:"max_size_mb"`
+	Formats    []string `json:"formats"`
+	MaxFiles   int      `json:"max_files"`
+	TTLSeconds int      `json:"ttl_seconds"`
+}
+
+// UploadURLResponse describes a presigned upload url, which accepts files posted like to the upload endpoint
+type UploadURLResponse struct {
+	URL         string    `json:"url"`
+	UploadToken string    `json:"upload_token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	MaxSizeMb   float64   `json:"max_size_mb"`
+	Formats     []string  `json:"formats"`
+	MaxFiles    int       `json:"max_files"`
+}
+
+// UploadURLHandler creates presigned single-use upload urls for clients which can't be trusted with JWT tokens
+type UploadURLHandler struct {
+	postHandler  ImagePostHandler
+	tokenManager *authentication.UploadTokenManager
+	maxTTL       time.Duration
+}
+
+func NewUploadURLHandler(postHandler ImagePostHandler, tokenManager *authentication.UploadTokenManager) UploadURLHandler {
+	return UploadURLHandler{
+		postHandler:  postHandler,
+		tokenManager: tokenManager,
+		maxTTL:       time.Duration(env.ReadEnvInt("UPLOAD_URL_MAX_TTL_SECONDS", defaultUploadURLMaxTTLSeconds)) * time.Second,
+	}
+}
+
+func (uuh UploadURLHandler) HandleCreate(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+
+	// upload urls are given for new folders, so tokens restricted to folders can't create them
+	if !authentication.Authorize(rw, r, authentication.ScopeUpload, "") {
+		return
+	}
+
+	if !uuh.tokenManager.IsEnabled() {
+		io.OutputWarning("", "Upload url is requested, but UPLOAD_URL_SECRET is not set")
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	uploadRequest := uploadURLRequest{}
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(http.MaxBytesReader(rw, r.Body, maxUploadURLRequestBytes)).Decode(&uploadRequest)
+		if err != nil {
+			io.OutputWarning("", "Invalid upload url request: %v", err)
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	permit, validationErrors := uuh.buildPermit(uploadRequest, time.Now())
+	if len(validationErrors) > 0 {
+		writeFieldErrors(rw, http.StatusBadRequest, validationErrors)
+		return
+	}
+
+	uploadToken, err := uuh.tokenManager.GenerateToken(permit)
+	if err != nil {
+		io.OutputError(err, "", "Failed to generate upload token")
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(rw).Encode(UploadURLResponse{
+		URL:         uuh.postHandler.buildBaseURL(r) + "?" + url.Values{UploadTokenQueryParam: {uploadToken}}.Encode(),
+		UploadToken: uploadToken,
+		ExpiresAt:   permit.ExpiresAt,
+		MaxSizeMb:   permit.MaxFileSizeMb,
+		Formats:     permit.Formats,
+		MaxFiles:    permit.MaxFiles,
+	})
+	if err != nil {
+		io.OutputError(err, "", "Cannot send json data")
+	}
+}
+
+// buildPermit applies defaults to the requested restrictions, they can't exceed the limits of the server
+func (uuh UploadURLHandler) buildPermit(
+	uploadRequest uploadURLRequest,
+	now time.Time,
+) (authentication.UploadPermit, error2.ValidationErrors) {
+	validationErrors := error2.NewValidationErrors()
+	maxUploadFileSizeMb := uuh.postHandler.maxUploadFileSizeMb
+
+	permit := authentication.UploadPermit{
+		MaxFileSizeMb: uploadRequest.MaxSizeMb,
+		Formats:       []string{},
+		MaxFiles:      uploadRequest.MaxFiles,
+		ExpiresAt:     now.Add(uuh.maxTTL).UTC().Truncate(time.Second),
+	}
+
+	if permit.MaxFileSizeMb == 0 {
+		permit.MaxFileSizeMb = maxUploadFileSizeMb
+	}
+	if permit.MaxFileSizeMb < 0 || permit.MaxFileSizeMb > maxUploadFileSizeMb {
+		validationErrors["max_size_mb"] = []string{fmt.Sprintf("Should be between 0 and %v", maxUploadFileSizeMb)}
+	}
+
+	formatRegex := regexp.MustCompile(fmt.Sprintf(`^(%s)$`, SupportedImageFormats))
+	for _, format := range uploadRequest.Formats {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if !formatRegex.MatchString(format) {
+			validationErrors["formats"] = []string{fmt.Sprintf("Should contain only formats %s", SupportedImageFormats)}
+			break
+		}
+		permit.Formats = append(permit.Formats, format)
+	}
+
+	if permit.MaxFiles == 0 {
+		permit.MaxFiles = 1
+	}
+	if permit.MaxFiles < 0 {
+		validationErrors["max_files"] = []string{"Should be a positive number"}
+	}
+
+	if uploadRequest.TTLSeconds != 0 {
+		ttl := time.Duration(uploadRequest.TTLSeconds) * time.Second
+		if ttl < 0 || ttl > uuh.maxTTL {
+			validationErrors["ttl_seconds"] = []string{fmt.Sprintf("Should be between 0 and %d", int(uuh.maxTTL.Seconds()))}
+		}
+		permit.ExpiresAt = now.Add(ttl).UTC().Truncate(time.Second)
+	}
+
+	return permit, validationErrors
+}
+
+// validateUploadPermit gives violations of the restrictions of the upload url the file was posted to
+func validateUploadPermit(file uploadedFile, permit authentication.UploadPermit) []error2.Violation {
+	violations := []error2.Violation{}
+
+	if len(permit.Formats) > 0 {
+		isFormatAllowed := false
+		for _, format := range permit.Formats {
+			isFormatAllowed = isFormatAllowed || supportedMimeTypes[file.mime] && isSameFormat(file.ext, format)
+		}
+		if !isFormatAllowed {
+			violations = append(violations, error2.Violation{
+				Code: ViolationUnsupportedMimeType,
+				Message: fmt.Sprintf(
+					"Not supported image type '%s', supported types are %s",
+					file.mime,
+					strings.Join(permit.Formats, "|"),
+				),
+			})
+		}
+	}
+
+	if permit.MaxFileSizeMb*bytesInMb < float64(file.size) {
+		violations = append(violations, buildFileTooLargeViolation(permit.MaxFileSizeMb))
+	}
+
+	return violations
+}
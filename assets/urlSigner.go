@@ -0,0 +1,94 @@
+package assets
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/breathbath/go_utils/utils/env"
+)
+
+const (
+	SignatureQueryParam = "s"
+	ExpiryQueryParam    = "e"
+)
+
+var (
+	ErrMissingSignature = errors.New("url signature is missing")
+	ErrInvalidSignature = errors.New("url signature is invalid")
+	ErrExpiredSignature = errors.New("url signature is expired")
+)
+
+// URLSigner creates and checks HMAC signatures of image paths, so that only urls generated by trusted parties
+// can trigger image resizing
+type URLSigner struct {
+	secret []byte
+}
+
+func NewURLSigner() URLSigner {
+	return URLSigner{
+		secret: []byte(env.ReadEnv("URL_SIGNING_SECRET", "")),
+	}
+}
+
+func (us URLSigner) IsEnabled() bool {
+	return len(us.secret) > 0
+}
+
+// Sign gives the path with signature query params, zero expiresAt produces a never expiring signature
+func (us URLSigner) Sign(path string, expiresAt time.Time) string {
+	path = strings.Trim(path, "/")
+	var expiry int64
+	if !expiresAt.IsZero() {
+		expiry = expiresAt.Unix()
+	}
+
+	query := url.Values{}
+	if expiry > 0 {
+		query.Set(ExpiryQueryParam, strconv.FormatInt(expiry, 10))
+	}
+	query.Set(SignatureQueryParam, us.calculateSignature(path, expiry))
+
+	return path + "?" + query.Encode()
+}
+
+// Verify checks the signature from the query params against the path, which is relative to the url prefix
+func (us URLSigner) Verify(path string, query url.Values, now time.Time) error {
+	signature := query.Get(SignatureQueryParam)
+	if signature == "" {
+		return ErrMissingSignature
+	}
+
+	var expiry int64
+	if rawExpiry := query.Get(ExpiryQueryParam); rawExpiry != "" {
+		var err error
+		expiry, err = strconv.ParseInt(rawExpiry, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid expiry '%s'", ErrInvalidSignature, rawExpiry)
+		}
+	}
+
+	expectedSignature := us.calculateSignature(strings.Trim(path, "/"), expiry)
+	if !hmac.Equal([]byte(signature), []byte(expectedSignature)) {
+		return ErrInvalidSignature
+	}
+
+	if expiry > 0 && now.Unix() > expiry {
+		return ErrExpiredSignature
+	}
+
+	return nil
+}
+
+func (us URLSigner) calculateSignature(path string, expiry int64) string {
+	mac := hmac.New(sha256.New, us.secret)
+	_, _ = mac.Write([]byte(path + ":" + strconv.FormatInt(expiry, 10)))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
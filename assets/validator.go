@@ -2,47 +2,85 @@ package assets
 
 import (
 	"fmt"
-	"mime/multipart"
-	"strings"
+	"io"
 
 	error2 "github.com/breathbath/media-library/error"
+	"github.com/breathbath/media-library/filesystem"
+)
+
+const (
+	ViolationUnsupportedMimeType = "unsupported_mime_type"
+	ViolationFileTooLarge        = "file_too_large"
+	ViolationPixelBudgetExceeded = "pixel_budget_exceeded"
 )
 
 func Validate(
-	fileHeader *multipart.FileHeader,
-	curMime, submittedFileFieldName string,
+	size int64,
+	curMime string,
 	maxUploadFileSizeMb float64,
-) (error2.ValidationErrors, error) {
-	validationErrors := error2.NewValidationErrors()
-
-	isCurMimeSupported := false
-	for _, supportedExt := range strings.Split(SupportedImageFormats, "|") {
-		supportedMime := "image/" + supportedExt
-		if curMime == supportedMime {
-			isCurMimeSupported = true
-			break
-		}
-	}
+) ([]error2.Violation, error) {
+	violations := []error2.Violation{}
 
-	if !isCurMimeSupported {
-		validationErrors[submittedFileFieldName] = []string{
-			fmt.Sprintf(
+	if !supportedMimeTypes[curMime] {
+		violations = append(violations, error2.Violation{
+			Code: ViolationUnsupportedMimeType,
+			Message: fmt.Sprintf(
 				"Not supported image type '%s', supported types are %s",
 				curMime,
 				SupportedImageFormats,
 			),
-		}
+		})
 	}
 
-	if maxUploadFileSizeMb*1024.0*1024.0 < float64(fileHeader.Size) {
-		validationErrors[submittedFileFieldName] = []string{
-			fmt.Sprintf(
-				"The file is too large (%d bytes). Allowed maximum size is %v Mb",
-				fileHeader.Size,
-				maxUploadFileSizeMb,
+	if maxUploadFileSizeMb*bytesInMb < float64(size) {
+		violations = append(violations, buildFileTooLargeViolation(maxUploadFileSizeMb))
+	}
+
+	return violations, nil
+}
+
+// buildFileTooLargeViolation doesn't give the file size, since files are read only up to the limit
+func buildFileTooLargeViolation(maxFileSizeMb float64) error2.Violation {
+	return error2.Violation{
+		Code:    ViolationFileTooLarge,
+		Message: fmt.Sprintf("The file is larger than %v Mb, which is the allowed maximum size", maxFileSizeMb),
+	}
+}
+
+// ValidatePixelBudget rejects images which would take too much memory if decoded, only the image header is read
+func ValidatePixelBudget(source io.ReadSeeker, maxImagePixels int64) ([]error2.Violation, error) {
+	err := filesystem.CheckPixelBudget(source, maxImagePixels)
+	if imageTooLargeErr, ok := err.(filesystem.ImageTooLargeError); ok && imageTooLargeErr.Frames > 1 {
+		return []error2.Violation{{
+			Code: ViolationPixelBudgetExceeded,
+			Message: fmt.Sprintf(
+				"The animated image is too large to process (%dx%d pixels, %d frames). Allowed maximum is %d pixels in all frames",
+				imageTooLargeErr.Width,
+				imageTooLargeErr.Height,
+				imageTooLargeErr.Frames,
+				imageTooLargeErr.MaxPixels,
+			),
+		}}, nil
+	}
+
+	if imageTooLargeErr, ok := err.(filesystem.ImageTooLargeError); ok {
+		return []error2.Violation{{
+			Code: ViolationPixelBudgetExceeded,
+			Message: fmt.Sprintf(
+				"The image is too large to process (%dx%d pixels). Allowed maximum is %d pixels",
+				imageTooLargeErr.Width,
+				imageTooLargeErr.Height,
+				imageTooLargeErr.MaxPixels,
 			),
+		}}, nil
+	}
+
+	if err != nil {
+		if _, e := source.Seek(0, io.SeekStart); e != nil {
+			return nil, e
 		}
+		return []error2.Violation{{Code: ViolationImageNotDecodable, Message: "The image cannot be decoded"}}, nil
 	}
 
-	return validationErrors, nil
+	return []error2.Violation{}, nil
 }
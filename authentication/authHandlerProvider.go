@@ -2,10 +2,11 @@ package authentication
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 
-	"github.com/breathbath/go_utils/utils/env"
 	"github.com/breathbath/go_utils/utils/io"
 	"github.com/golang-jwt/jwt/v4"
 )
@@ -14,15 +15,21 @@ type ContextKey string
 
 const TokenContextKey ContextKey = "token"
 
+// TokenErrorContextKey keeps the reason why the token of the request was rejected
+const TokenErrorContextKey ContextKey = "token_error"
+
+const (
+	bearerPrefix = "Bearer "
+	authRealm    = "media"
+)
+
 type AuthHandlerProvider struct {
-	jwtManager          *JwtManager
-	acceptedTokenIssuer string
+	jwtManager *JwtManager
 }
 
 func NewAuthHandlerProvider(jwtManager *JwtManager) *AuthHandlerProvider {
 	return &AuthHandlerProvider{
-		jwtManager:          jwtManager,
-		acceptedTokenIssuer: env.ReadEnv("TOKEN_ISSUER", ""),
+		jwtManager: jwtManager,
 	}
 }
 
@@ -30,34 +37,80 @@ func (ahp *AuthHandlerProvider) GetHandlerFunc() func(rw http.ResponseWriter, re
 	return ahp.AuthenticateClient
 }
 
+// AuthenticateClient passes requests without a valid token unauthenticated, so that public routes are served,
+// the reason of a rejected token is kept for Authorize
 func (ahp *AuthHandlerProvider) AuthenticateClient(rw http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
-	rawTokens, ok := req.Header["Authorization"]
-	if !ok {
+	rawToken := strings.TrimSpace(req.Header.Get("Authorization"))
+	if rawToken == "" {
 		next(rw, req)
 		return
 	}
 
-	rawToken := rawTokens[0]
-	if rawToken == "" {
+	// tokens without the Bearer prefix are accepted too, since older clients send them so,
+	// credentials of other schemes are ignored
+	if len(rawToken) > len(bearerPrefix) && strings.EqualFold(rawToken[:len(bearerPrefix)], bearerPrefix) {
+		rawToken = strings.TrimSpace(rawToken[len(bearerPrefix):])
+	} else if strings.Contains(rawToken, " ") {
 		next(rw, req)
 		return
 	}
 
-	rawToken = strings.Replace(rawToken, "Bearer ", "", -1)
-
 	token, err := ahp.jwtManager.ParseToken(rawToken)
-
 	if err != nil {
-		io.OutputError(err, "Auth handler", "Invalid token: "+rawToken)
-		next(rw, req)
-		return
-	}
-
-	if !token.Valid || token.Claims.(jwt.MapClaims)["iss"].(string) != ahp.acceptedTokenIssuer {
-		next(rw, req)
+		if isTokenRejected(err) {
+			// the token itself is not logged, since it could be used by anyone reading the logs
+			io.OutputWarning("Auth handler", "Rejected token of %s: %v", req.RemoteAddr, err)
+		} else {
+			io.OutputError(err, "Auth handler", "Failed to check token")
+		}
+		next(rw, req.WithContext(context.WithValue(req.Context(), TokenErrorContextKey, err)))
 		return
 	}
 
 	ctx := context.WithValue(req.Context(), TokenContextKey, token)
+	ctx = context.WithValue(ctx, TokenScopeContextKey, NewTokenScopeFromClaims(token.Claims.(jwt.MapClaims)))
 	next(rw, req.WithContext(ctx))
 }
+
+// Authorize tells if the request is authenticated with a token having the scope for the folder, otherwise it responds
+// with 401 for a missing or rejected token and with 403 for a token without the scope as described in RFC 6750
+func Authorize(rw http.ResponseWriter, r *http.Request, scope, folder string) bool {
+	if IsAllowed(r.Context(), scope, folder) {
+		return true
+	}
+
+	if r.Context().Value(TokenScopeContextKey) != nil {
+		rw.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s", error="insufficient_scope"`, authRealm))
+		rw.WriteHeader(http.StatusForbidden)
+		return false
+	}
+
+	tokenErr, _ := r.Context().Value(TokenErrorContextKey).(error)
+	if tokenErr != nil && !isTokenRejected(tokenErr) {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+
+	authenticate := fmt.Sprintf(`Bearer realm="%s"`, authRealm)
+	if tokenErr != nil {
+		description := strings.Map(func(r rune) rune {
+			if r < ' ' || r > '~' || r == '"' || r == '\\' {
+				return '\''
+			}
+			return r
+		}, tokenErr.Error())
+		authenticate += fmt.Sprintf(`, error="invalid_token", error_description="%s"`, description)
+	}
+
+	rw.Header().Set("WWW-Authenticate", authenticate)
+	rw.WriteHeader(http.StatusUnauthorized)
+
+	return false
+}
+
+// isTokenRejected tells if the token is invalid, other errors are failures to check the token
+func isTokenRejected(err error) bool {
+	var validationErr *jwt.ValidationError
+
+	return errors.As(err, &validationErr) || errors.Is(err, ErrTokenRevoked)
+}
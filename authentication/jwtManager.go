@@ -1,6 +1,7 @@
 package authentication
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
@@ -9,9 +10,12 @@ import (
 )
 
 type JwtManager struct {
-	issuer        string
-	tokenDuration time.Duration
-	secret        string
+	issuer         string
+	tokenDuration  time.Duration
+	secret         string
+	leeway         time.Duration
+	keySet         *KeySet
+	revocationList *RevocationList
 }
 
 const (
@@ -24,29 +28,70 @@ func NewJwtManager() (*JwtManager, error) {
 		return nil, err
 	}
 
-	secret, err := env.ReadEnvOrError("TOKEN_SECRET")
+	const defaultJwksReloadSeconds = 10
+	jwksReloadSeconds := env.ReadEnvInt("TOKEN_JWKS_RELOAD_SECONDS", defaultJwksReloadSeconds)
+	keySet, err := NewKeySet(
+		env.ReadEnv("TOKEN_PUBLIC_KEY_PATH", ""),
+		env.ReadEnv("TOKEN_JWKS_PATH", ""),
+		time.Duration(jwksReloadSeconds)*time.Second,
+	)
 	if err != nil {
 		return nil, err
 	}
 
+	// the secret is optional if tokens are signed by another service and only verified here
+	secret := env.ReadEnv("TOKEN_SECRET", "")
+	if secret == "" && !keySet.IsEnabled() {
+		return nil, errors.New("TOKEN_SECRET, TOKEN_PUBLIC_KEY_PATH or TOKEN_JWKS_PATH should be set")
+	}
+
 	tokenDuration := env.ReadEnvInt("TOKEN_DURATION_DAYS", 30)
+	leewaySeconds := env.ReadEnvInt("TOKEN_LEEWAY_SECONDS", 0)
+	if leewaySeconds < 0 {
+		return nil, errors.New("TOKEN_LEEWAY_SECONDS should not be negative")
+	}
+
+	leeway := time.Duration(leewaySeconds) * time.Second
 
 	return &JwtManager{
-		secret:        secret,
-		issuer:        issuer,
-		tokenDuration: time.Hour * 24 * time.Duration(tokenDuration),
+		secret:         secret,
+		leeway:         leeway,
+		keySet:         keySet,
+		issuer:         issuer,
+		tokenDuration:  time.Hour * 24 * time.Duration(tokenDuration),
+		revocationList: NewRevocationList(env.ReadEnv("TOKEN_REVOCATION_LIST_PATH", ""), leeway),
 	}, nil
 }
 
 func (jwtm *JwtManager) GenerateToken(appName string) (string, error) {
-	token := jwt.New(jwt.SigningMethodHS256)
-	token.Claims = jwt.MapClaims{
-		"exp": time.Now().UTC().Add(jwtm.tokenDuration).Unix(),
-		"iat": time.Now().UTC().Unix(),
-		"sub": appName,
-		"iss": jwtm.issuer,
-		"aud": tokenAudience,
+	return jwtm.GenerateScopedToken(appName, TokenScope{}, 0)
+}
+
+// GenerateScopedToken creates a token with limited permissions, zero ttl means TOKEN_DURATION_DAYS
+func (jwtm *JwtManager) GenerateScopedToken(appName string, tokenScope TokenScope, ttl time.Duration) (string, error) {
+	if jwtm.secret == "" {
+		return "", errors.New("TOKEN_SECRET is not set, tokens can be only verified with public keys")
+	}
+
+	if ttl <= 0 {
+		ttl = jwtm.tokenDuration
+	}
+
+	id, err := generateTokenID()
+	if err != nil {
+		return "", err
 	}
+
+	claims := tokenScope.Claims()
+	claims["jti"] = id
+	claims["exp"] = time.Now().UTC().Add(ttl).Unix()
+	claims["iat"] = time.Now().UTC().Unix()
+	claims["sub"] = appName
+	claims["iss"] = jwtm.issuer
+	claims["aud"] = tokenAudience
+
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Claims = claims
 	tokenString, err := token.SignedString([]byte(jwtm.secret))
 	if err != nil {
 		return "", err
@@ -54,15 +99,91 @@ func (jwtm *JwtManager) GenerateToken(appName string) (string, error) {
 	return tokenString, nil
 }
 
+// ParseToken checks the signature and the claims of the token, tokens from the revocation list are rejected,
+// HMAC signatures are checked with TOKEN_SECRET and RSA or ECDSA ones with the public keys.
+// Rejected tokens give *jwt.ValidationError or ErrTokenRevoked, other errors are failures to check the token
 func (jwtm *JwtManager) ParseToken(rawToken string) (*jwt.Token, error) {
-	token, err := jwt.Parse(rawToken, func(token *jwt.Token) (interface{}, error) {
+	// time based claims are validated with the leeway by validateClaims
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.Parse(rawToken, func(token *jwt.Token) (interface{}, error) {
 		// Don't forget to validate the alg is what you expect:
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		switch token.Method.(type) {
+		case *jwt.SigningMethodHMAC:
+			if jwtm.secret != "" {
+				return []byte(jwtm.secret), nil
+			}
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+			if jwtm.keySet.IsEnabled() {
+				return jwtm.keySet.Key(token)
+			}
 		}
 
-		return []byte(jwtm.secret), nil
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 	})
+	if err != nil {
+		return token, err
+	}
+
+	err = jwtm.validateClaims(token.Claims.(jwt.MapClaims), time.Now())
+	if err != nil {
+		return token, err
+	}
+
+	// tokens issued before ids were added can't be revoked one by one
+	if id, ok := token.Claims.(jwt.MapClaims)["jti"].(string); ok && id != "" {
+		isRevoked, e := jwtm.revocationList.IsRevoked(id)
+		if e != nil {
+			return token, e
+		}
+		if isRevoked {
+			return token, ErrTokenRevoked
+		}
+	}
+
+	return token, nil
+}
+
+// InspectToken gives the claims of the token even if it's invalid, the error tells why the token isn't accepted
+func (jwtm *JwtManager) InspectToken(rawToken string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, _, err := new(jwt.Parser).ParseUnverified(rawToken, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = jwtm.ParseToken(rawToken)
+
+	return claims, err
+}
+
+// validateClaims checks that the token is issued for this service, expires and is valid at the moment allowing for the clock skew
+func (jwtm *JwtManager) validateClaims(claims jwt.MapClaims, now time.Time) error {
+	leeway := int64(jwtm.leeway.Seconds())
+
+	if !claims.VerifyIssuer(jwtm.issuer, true) {
+		return jwt.NewValidationError("token is issued by another issuer", jwt.ValidationErrorIssuer)
+	}
+
+	if !claims.VerifyAudience(tokenAudience, true) {
+		return jwt.NewValidationError("token is issued for another audience", jwt.ValidationErrorAudience)
+	}
+
+	// tokens without expiry would stay valid forever, if they leak
+	if _, ok := claims["exp"]; !ok {
+		return jwt.NewValidationError("token has no expiration time", jwt.ValidationErrorExpired)
+	}
+
+	if !claims.VerifyExpiresAt(now.Unix()-leeway, true) {
+		return jwt.NewValidationError("token is expired", jwt.ValidationErrorExpired)
+	}
+
+	if !claims.VerifyNotBefore(now.Unix()+leeway, false) {
+		return jwt.NewValidationError("token is not valid yet", jwt.ValidationErrorNotValidYet)
+	}
+
+	if !claims.VerifyIssuedAt(now.Unix()+leeway, false) {
+		return jwt.NewValidationError("token is issued in the future", jwt.ValidationErrorIssuedAt)
+	}
 
-	return token, err
+	return nil
 }
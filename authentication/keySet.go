@@ -0,0 +1,261 @@
+package authentication
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/breathbath/go_utils/utils/io"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var errUnsupportedKey = errors.New("unsupported key")
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// KeySet gives public keys for tokens signed with RSA or ECDSA by another service, keys are read from a PEM file
+// and from a JWKS file, which is reloaded once it's changed, so that keys can be rotated without restarts,
+// the file is checked for changes at most once per reload interval
+type KeySet struct {
+	pemKey         interface{}
+	jwksPath       string
+	reloadInterval time.Duration
+	lock           *sync.RWMutex
+	jwksKeys       map[string]interface{}
+	jwksCheckedAt  time.Time
+	jwksMod        time.Time
+	jwksSize       int64
+	isEnabled      bool
+}
+
+// NewKeySet reads the keys, empty paths are skipped, if both are empty the key set is disabled
+func NewKeySet(pemPath, jwksPath string, reloadInterval time.Duration) (*KeySet, error) {
+	keySet := &KeySet{
+		jwksPath:       jwksPath,
+		reloadInterval: reloadInterval,
+		lock:           &sync.RWMutex{},
+		jwksKeys:       map[string]interface{}{},
+		jwksCheckedAt:  time.Now(),
+		isEnabled:      pemPath != "" || jwksPath != "",
+	}
+
+	if pemPath != "" {
+		pemKey, err := readPemPublicKey(pemPath)
+		if err != nil {
+			return nil, err
+		}
+		keySet.pemKey = pemKey
+	}
+
+	if jwksPath != "" {
+		err := keySet.reloadJwks()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return keySet, nil
+}
+
+func (ks *KeySet) IsEnabled() bool {
+	return ks.isEnabled
+}
+
+// Key gives the public key by the kid header of the token, the PEM key is used for unknown ids,
+// tokens without kid are accepted if the JWKS file has just one key
+func (ks *KeySet) Key(token *jwt.Token) (interface{}, error) {
+	if ks.jwksPath != "" {
+		ks.reloadJwksIfDue(time.Now())
+	}
+
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+
+	kid, _ := token.Header["kid"].(string)
+	if key, ok := ks.jwksKeys[kid]; ok && kid != "" {
+		return key, nil
+	}
+
+	if ks.pemKey != nil {
+		return ks.pemKey, nil
+	}
+
+	if kid == "" && len(ks.jwksKeys) == 1 {
+		for _, key := range ks.jwksKeys {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown key id '%s'", kid)
+}
+
+// reloadJwksIfDue checks the JWKS file once the reload interval passed since the last check
+func (ks *KeySet) reloadJwksIfDue(now time.Time) {
+	ks.lock.RLock()
+	isDue := now.Sub(ks.jwksCheckedAt) >= ks.reloadInterval
+	ks.lock.RUnlock()
+	if !isDue {
+		return
+	}
+
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	// a concurrent request could have checked the file meanwhile
+	if now.Sub(ks.jwksCheckedAt) < ks.reloadInterval {
+		return
+	}
+	ks.jwksCheckedAt = now
+
+	err := ks.reloadJwks()
+	if err != nil {
+		// keeping the previous keys, so that a broken file doesn't reject all tokens
+		io.OutputError(err, "Auth handler", "Failed to reload JWKS file %s", ks.jwksPath)
+	}
+}
+
+// reloadJwks reads the JWKS file if it was changed since the last read, keys of unsupported types or curves are skipped
+func (ks *KeySet) reloadJwks() error {
+	fileInfo, err := os.Stat(ks.jwksPath)
+	if err != nil {
+		return err
+	}
+
+	if fileInfo.ModTime().Equal(ks.jwksMod) && fileInfo.Size() == ks.jwksSize {
+		return nil
+	}
+	// a broken file is reported once, it's read again after the next change
+	ks.jwksMod, ks.jwksSize = fileInfo.ModTime(), fileInfo.Size()
+
+	content, err := ioutil.ReadFile(ks.jwksPath)
+	if err != nil {
+		return err
+	}
+
+	jwks := jsonWebKeySet{}
+	err = json.Unmarshal(content, &jwks)
+	if err != nil {
+		return fmt.Errorf("invalid JWKS file %s: %v", ks.jwksPath, err)
+	}
+
+	jwksKeys := make(map[string]interface{}, len(jwks.Keys))
+	for i, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, e := jwk.publicKey()
+		if errors.Is(e, errUnsupportedKey) {
+			// the file can be shared with services using other algorithms, e.g. Ed25519
+			io.OutputWarning("Auth handler", "Skipped key %d '%s' in JWKS file %s: %v", i, jwk.Kid, ks.jwksPath, e)
+			continue
+		}
+		if e != nil {
+			return fmt.Errorf("invalid key %d '%s' in JWKS file %s: %v", i, jwk.Kid, ks.jwksPath, e)
+		}
+		jwksKeys[jwk.Kid] = key
+	}
+
+	ks.jwksKeys = jwksKeys
+
+	return nil
+}
+
+func (jwk jsonWebKey) publicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeKeyParam(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeKeyParam(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{
+			"P-256": elliptic.P256(),
+			"P-384": elliptic.P384(),
+			"P-521": elliptic.P521(),
+		}
+		curve, ok := curves[jwk.Crv]
+		if !ok {
+			return nil, fmt.Errorf("%w curve '%s'", errUnsupportedKey, jwk.Crv)
+		}
+
+		x, err := decodeKeyParam(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeKeyParam(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("the point is not on the curve")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("%w type '%s'", errUnsupportedKey, jwk.Kty)
+	}
+}
+
+func decodeKeyParam(param string) (*big.Int, error) {
+	value, err := base64.RawURLEncoding.DecodeString(param)
+	if err != nil {
+		return nil, err
+	}
+	if len(value) == 0 {
+		return nil, errors.New("missing key parameter")
+	}
+
+	return new(big.Int).SetBytes(value), nil
+}
+
+// readPemPublicKey accepts RSA and ECDSA public keys and certificates
+func readPemPublicKey(path string) (interface{}, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, err := jwt.ParseRSAPublicKeyFromPEM(content)
+	if err == nil {
+		return rsaKey, nil
+	}
+
+	ecdsaKey, err := jwt.ParseECPublicKeyFromPEM(content)
+	if err == nil {
+		return ecdsaKey, nil
+	}
+
+	return nil, fmt.Errorf("%s should contain an RSA or ECDSA public key in PEM format", path)
+}
@@ -0,0 +1,237 @@
+package authentication
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/breathbath/go_utils/utils/io"
+)
+
+const (
+	tokenIDBytes = 16
+	// revocationCheckInterval limits how often the server checks the file for changes
+	revocationCheckInterval = time.Second
+	// revocationLockTimeout is how long Revoke waits for another process to release the lock file,
+	// older lock files are left by crashed processes and are removed
+	revocationLockTimeout   = 5 * time.Second
+	revocationLockRetryTime = 10 * time.Millisecond
+)
+
+var ErrTokenRevoked = errors.New("token is revoked")
+
+// RevokedToken is an entry of the revocation list, ExpiresAt is the exp claim as unix time, 0 if it's unknown
+type RevokedToken struct {
+	ID        string    `json:"jti"`
+	RevokedAt time.Time `json:"revoked_at"`
+	ExpiresAt int64     `json:"exp,omitempty"`
+}
+
+// RevocationList keeps ids of revoked tokens in a JSON file, the file is checked for changes at most once
+// per second, so that tokens revoked by the cli command are rejected by the running server,
+// entries of tokens which expired more than the leeway ago are removed on the next revocation
+type RevocationList struct {
+	path       string
+	leeway     time.Duration
+	lock       *sync.Mutex
+	revokedIDs map[string]bool
+	checkedAt  time.Time
+	modTime    time.Time
+	size       int64
+}
+
+func NewRevocationList(path string, leeway time.Duration) *RevocationList {
+	return &RevocationList{
+		path:       path,
+		leeway:     leeway,
+		lock:       &sync.Mutex{},
+		revokedIDs: map[string]bool{},
+	}
+}
+
+func (rl *RevocationList) IsEnabled() bool {
+	return rl.path != ""
+}
+
+// IsRevoked tells if the token id is in the list, a missing file means an empty list
+func (rl *RevocationList) IsRevoked(id string) (bool, error) {
+	if !rl.IsEnabled() {
+		return false, nil
+	}
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(rl.checkedAt) < revocationCheckInterval {
+		return rl.revokedIDs[id], nil
+	}
+
+	fileInfo, err := os.Stat(rl.path)
+	if os.IsNotExist(err) {
+		rl.revokedIDs, rl.checkedAt = map[string]bool{}, now
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	rl.checkedAt = now
+
+	if !fileInfo.ModTime().Equal(rl.modTime) || fileInfo.Size() != rl.size {
+		revokedTokens, e := rl.read()
+		if e != nil {
+			return false, e
+		}
+
+		rl.revokedIDs = make(map[string]bool, len(revokedTokens))
+		for _, revokedToken := range revokedTokens {
+			rl.revokedIDs[revokedToken.ID] = true
+		}
+		rl.modTime, rl.size = fileInfo.ModTime(), fileInfo.Size()
+	}
+
+	return rl.revokedIDs[id], nil
+}
+
+// Revoke adds the token id to the list, false is returned if it was already revoked, zero expiresAt means
+// the expiration is unknown and the entry is kept forever, the file is locked, since it can be changed
+// by several processes at once
+func (rl *RevocationList) Revoke(id string, expiresAt, now time.Time) (bool, error) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	err := rl.lockFile()
+	if err != nil {
+		return false, err
+	}
+	defer rl.unlockFile()
+
+	revokedTokens, err := rl.read()
+	if err != nil {
+		return false, err
+	}
+
+	keptTokens := make([]RevokedToken, 0, len(revokedTokens)+1)
+	for _, revokedToken := range revokedTokens {
+		if revokedToken.ID == id {
+			return false, nil
+		}
+		if revokedToken.ExpiresAt == 0 || now.Before(time.Unix(revokedToken.ExpiresAt, 0).Add(rl.leeway)) {
+			keptTokens = append(keptTokens, revokedToken)
+		}
+	}
+
+	revokedToken := RevokedToken{ID: id, RevokedAt: now.UTC()}
+	if !expiresAt.IsZero() {
+		revokedToken.ExpiresAt = expiresAt.Unix()
+	}
+
+	return true, rl.write(append(keptTokens, revokedToken))
+}
+
+// lockFile creates the lock file next to the list, it waits until the lock file of another process is removed
+func (rl *RevocationList) lockFile() error {
+	lockPath := rl.lockPath()
+	startedAt := time.Now()
+	for {
+		lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			return lockFile.Close()
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+
+		lockInfo, err := os.Stat(lockPath)
+		if err == nil && time.Since(lockInfo.ModTime()) > revocationLockTimeout {
+			io.OutputWarning("Auth handler", "Removing stale lock file %s", lockPath)
+			_ = os.Remove(lockPath)
+			continue
+		}
+
+		if time.Since(startedAt) > revocationLockTimeout {
+			return fmt.Errorf("failed to lock %s, the lock file %s is kept by another process", rl.path, lockPath)
+		}
+		time.Sleep(revocationLockRetryTime)
+	}
+}
+
+func (rl *RevocationList) unlockFile() {
+	err := os.Remove(rl.lockPath())
+	if err != nil {
+		io.OutputError(err, "Auth handler", "Failed to remove lock file %s", rl.lockPath())
+	}
+}
+
+func (rl *RevocationList) lockPath() string {
+	return rl.path + ".lock"
+}
+
+// List gives all revoked tokens in the order of revocation
+func (rl *RevocationList) List() ([]RevokedToken, error) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	return rl.read()
+}
+
+func (rl *RevocationList) read() ([]RevokedToken, error) {
+	revokedTokens := []RevokedToken{}
+
+	content, err := ioutil.ReadFile(rl.path)
+	if os.IsNotExist(err) {
+		return revokedTokens, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(content, &revokedTokens)
+	if err != nil {
+		return nil, err
+	}
+
+	return revokedTokens, nil
+}
+
+// write replaces the file by renaming a temporary one, so that the server never reads a partially written list
+func (rl *RevocationList) write(revokedTokens []RevokedToken) error {
+	content, err := json.MarshalIndent(revokedTokens, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(rl.path), filepath.Base(rl.path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmpFile.Write(content)
+	if e := tmpFile.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), rl.path)
+}
+
+// generateTokenID gives a random id for the jti claim
+func generateTokenID() (string, error) {
+	id := make([]byte, tokenIDBytes)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
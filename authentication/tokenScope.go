@@ -0,0 +1,106 @@
+package authentication
+
+import (
+	"context"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	ScopeUpload = "upload"
+	ScopeDelete = "delete"
+	ScopeAdmin  = "admin"
+)
+
+// TokenScopeContextKey keeps the TokenScope of the authenticated request
+const TokenScopeContextKey ContextKey = "token_scope"
+
+// TokenScope lists permissions of a token, tokens without scopes have full access,
+// tokens with folders are allowed only to change images in folders starting with one of them
+type TokenScope struct {
+	Scopes  []string
+	Folders []string
+	// isMalformed denies everything, so that a claim which can't be read doesn't give full access
+	isMalformed bool
+}
+
+// NewTokenScopeFromClaims reads the space separated "scope" claim and the "folders" list claim,
+// only a token without the "scope" claim has full access, empty or malformed claims deny everything
+func NewTokenScopeFromClaims(claims jwt.MapClaims) TokenScope {
+	tokenScope := TokenScope{}
+
+	if rawScope, ok := claims["scope"]; ok {
+		scope, _ := rawScope.(string)
+		tokenScope.Scopes = strings.Fields(scope)
+		tokenScope.isMalformed = len(tokenScope.Scopes) == 0
+	}
+
+	if rawFolders, ok := claims["folders"]; ok {
+		folders, _ := rawFolders.([]interface{})
+		tokenScope.isMalformed = tokenScope.isMalformed || len(folders) == 0
+		for _, rawFolder := range folders {
+			folder, _ := rawFolder.(string)
+			if folder == "" {
+				tokenScope.isMalformed = true
+				continue
+			}
+			tokenScope.Folders = append(tokenScope.Folders, folder)
+		}
+	}
+
+	return tokenScope
+}
+
+// Claims gives claims to be added to a token, no claims are given for a token with full access
+func (ts TokenScope) Claims() jwt.MapClaims {
+	claims := jwt.MapClaims{}
+	if len(ts.Scopes) > 0 {
+		claims["scope"] = strings.Join(ts.Scopes, " ")
+	}
+	if len(ts.Folders) > 0 {
+		claims["folders"] = ts.Folders
+	}
+
+	return claims
+}
+
+// Allows tells if the token has the scope for the folder, an empty folder means a new folder generated by the service
+func (ts TokenScope) Allows(scope, folder string) bool {
+	return !ts.isMalformed && ts.hasScope(scope) && ts.allowsFolder(folder)
+}
+
+func (ts TokenScope) hasScope(scope string) bool {
+	if len(ts.Scopes) == 0 {
+		return true
+	}
+
+	for _, tokenScope := range ts.Scopes {
+		if tokenScope == scope || tokenScope == ScopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ts TokenScope) allowsFolder(folder string) bool {
+	if len(ts.Folders) == 0 {
+		return true
+	}
+
+	for _, folderPrefix := range ts.Folders {
+		if folder != "" && strings.HasPrefix(folder, folderPrefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsAllowed tells if the request is authenticated with a token having the scope for the folder
+func IsAllowed(ctx context.Context, scope, folder string) bool {
+	tokenScope, ok := ctx.Value(TokenScopeContextKey).(TokenScope)
+
+	return ok && tokenScope.Allows(scope, folder)
+}
@@ -0,0 +1,189 @@
+package authentication
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/breathbath/go_utils/utils/env"
+	"github.com/breathbath/go_utils/utils/io"
+	"github.com/breathbath/media-library/filesystem"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const uploadTokenAudience = "media_service_upload"
+
+const (
+	// usedUploadTokensFolder keeps an empty marker file for each used token, the cache folder isn't used for images,
+	// markers are grouped in folders by the hour when the tokens expire, so that folders of expired tokens are removed
+	usedUploadTokensFolder = "cache/used_upload_tokens"
+	// usedUploadTokensPruneInterval limits how often the folders of expired tokens are looked for
+	usedUploadTokensPruneInterval = time.Hour
+)
+
+var ErrUploadTokenUsed = errors.New("upload token is already used")
+
+// UploadPermit restricts uploads authorized by a presigned upload url, empty formats allow all supported formats
+type UploadPermit struct {
+	ID            string
+	MaxFileSizeMb float64
+	Formats       []string
+	MaxFiles      int
+	ExpiresAt     time.Time
+}
+
+// UploadTokenManager issues short-lived single-use upload tokens, which can be given to browsers instead of JWT tokens,
+// used tokens are marked in the images storage, so that several instances of the service sharing it accept a token once
+type UploadTokenManager struct {
+	issuer            string
+	secret            []byte
+	fileSystemManager filesystem.Manager
+	pruneLock         *sync.Mutex
+	prunedAt          time.Time
+}
+
+func NewUploadTokenManager(fileSystemManager filesystem.Manager) (*UploadTokenManager, error) {
+	secret := env.ReadEnv("UPLOAD_URL_SECRET", "")
+	if secret != "" && secret == env.ReadEnv("TOKEN_SECRET", "") {
+		return nil, errors.New("UPLOAD_URL_SECRET should differ from TOKEN_SECRET")
+	}
+
+	return &UploadTokenManager{
+		issuer:            env.ReadEnv("TOKEN_ISSUER", ""),
+		secret:            []byte(secret),
+		fileSystemManager: fileSystemManager,
+		pruneLock:         &sync.Mutex{},
+	}, nil
+}
+
+func (utm *UploadTokenManager) IsEnabled() bool {
+	return len(utm.secret) > 0
+}
+
+// GenerateToken signs the permit, a random ID is assigned to it
+func (utm *UploadTokenManager) GenerateToken(permit UploadPermit) (string, error) {
+	id, err := generateTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	formats := make([]interface{}, 0, len(permit.Formats))
+	for _, format := range permit.Formats {
+		formats = append(formats, format)
+	}
+
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Claims = jwt.MapClaims{
+		"jti":         id,
+		"exp":         permit.ExpiresAt.Unix(),
+		"iat":         time.Now().UTC().Unix(),
+		"iss":         utm.issuer,
+		"aud":         uploadTokenAudience,
+		"max_size_mb": permit.MaxFileSizeMb,
+		"formats":     formats,
+		"max_files":   permit.MaxFiles,
+	}
+
+	return token.SignedString(utm.secret)
+}
+
+// ParseToken checks the signature, expiry and audience of the token and gives its permit
+func (utm *UploadTokenManager) ParseToken(rawToken string) (UploadPermit, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(rawToken, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		return utm.secret, nil
+	})
+	if err != nil {
+		return UploadPermit{}, err
+	}
+
+	if !claims.VerifyAudience(uploadTokenAudience, true) || !claims.VerifyIssuer(utm.issuer, true) {
+		return UploadPermit{}, errors.New("upload token is issued for another service")
+	}
+
+	id, _ := claims["jti"].(string)
+	expiry, _ := claims["exp"].(float64)
+	maxFileSizeMb, _ := claims["max_size_mb"].(float64)
+	maxFiles, _ := claims["max_files"].(float64)
+	rawFormats, _ := claims["formats"].([]interface{})
+	if !regexp.MustCompile(`^[0-9a-f]+$`).MatchString(id) || expiry == 0 {
+		return UploadPermit{}, errors.New("upload token has no valid id or expiry")
+	}
+
+	formats := make([]string, 0, len(rawFormats))
+	for _, rawFormat := range rawFormats {
+		if format, ok := rawFormat.(string); ok {
+			formats = append(formats, format)
+		}
+	}
+
+	return UploadPermit{
+		ID:            id,
+		MaxFileSizeMb: maxFileSizeMb,
+		Formats:       formats,
+		MaxFiles:      int(maxFiles),
+		ExpiresAt:     time.Unix(int64(expiry), 0),
+	}, nil
+}
+
+// Consume marks the permit as used with a single atomic write to the storage, ErrUploadTokenUsed is returned
+// if it was used before
+func (utm *UploadTokenManager) Consume(permit UploadPermit) error {
+	utm.pruneIfDue(time.Now())
+
+	markerPath := path.Join(usedUploadTokensFolder, buildExpiryFolderName(permit.ExpiresAt), permit.ID)
+	isCreated, err := utm.fileSystemManager.CreateMarker(markerPath)
+	if err != nil {
+		return err
+	}
+
+	if !isCreated {
+		return ErrUploadTokenUsed
+	}
+
+	return nil
+}
+
+// buildExpiryFolderName gives the unix time of the hour end, when the token expires, expired tokens are rejected,
+// so their markers aren't needed once the hour ended
+func buildExpiryFolderName(expiresAt time.Time) string {
+	return strconv.FormatInt(expiresAt.Truncate(time.Hour).Add(time.Hour).Unix(), 10)
+}
+
+// pruneIfDue removes the marker folders of expired tokens at most once per prune interval,
+// failures are only logged, since they don't affect the token check
+func (utm *UploadTokenManager) pruneIfDue(now time.Time) {
+	utm.pruneLock.Lock()
+	defer utm.pruneLock.Unlock()
+
+	if now.Sub(utm.prunedAt) < usedUploadTokensPruneInterval {
+		return
+	}
+	utm.prunedAt = now
+
+	folderNames, err := utm.fileSystemManager.ListMarkerFolders(usedUploadTokensFolder)
+	if err != nil {
+		io.OutputError(err, "", "Failed to list used upload tokens")
+		return
+	}
+
+	for _, folderName := range folderNames {
+		expiresAt, e := strconv.ParseInt(folderName, 10, 64)
+		if e != nil || expiresAt > now.Unix() {
+			continue
+		}
+
+		e = utm.fileSystemManager.RemoveMarkerFolder(path.Join(usedUploadTokensFolder, folderName))
+		if e != nil {
+			io.OutputError(e, "", "Failed to remove used upload tokens expired at %d", expiresAt)
+		}
+	}
+}
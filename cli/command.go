@@ -2,25 +2,44 @@ package cli
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
+	"github.com/breathbath/go_utils/utils/env"
 	"github.com/breathbath/go_utils/utils/errs"
+	"github.com/breathbath/media-library/assets"
 	"github.com/breathbath/media-library/authentication"
 	"github.com/breathbath/media-library/http"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 func Start() {
+	scopes := []string{authentication.ScopeUpload, authentication.ScopeDelete, authentication.ScopeAdmin}
 	var (
 		app = kingpin.New("media", "Media service")
 
-		tokenGenerator = app.Command("token", "Generates new token")
-		appName        = tokenGenerator.Arg("app", "Application name").Required().String()
+		tokenCommand    = app.Command("token", "Manages tokens")
+		tokenGenerator  = tokenCommand.Command("generate", "Generates new token").Default()
+		appName         = tokenGenerator.Arg("app", "Application name").Required().String()
+		tokenScopes     = tokenGenerator.Flag("scope", "Allowed operation, can be repeated, full access if not set").Enums(scopes...)
+		tokenFolders    = tokenGenerator.Flag("folder", "Allowed folder prefix, can be repeated, all folders if not set").Strings()
+		tokenTTL        = tokenGenerator.Flag("ttl", "Token validity, e.g. 24h, by default TOKEN_DURATION_DAYS").Duration()
+		tokenRevoker    = tokenCommand.Command("revoke", "Adds a token id to TOKEN_REVOCATION_LIST_PATH")
+		tokenIDToRevoke = tokenRevoker.Arg("jti", "Token id from the jti claim").Required().String()
+		tokenExpiration = tokenRevoker.Flag("exp", "Unix time from the exp claim, the id is removed once the token expires").Int64()
+		revokedLister   = tokenCommand.Command("list-revoked", "Lists revoked token ids")
+		tokenInspector  = tokenCommand.Command("inspect", "Prints claims of a token and checks if it's accepted")
+		tokenToInspect  = tokenInspector.Arg("token", "Token to inspect").Required().String()
 
-		mediaServer = app.Command("server", "Starts media server")
+		urlSigner    = app.Command("sign", "Signs an image url, required for resized images if URL_SIGNING_SECRET is set")
+		pathToSign   = urlSigner.Arg("path", "Image path, e.g. 200x200/5d489b785c7a8/photo.jpg").Required().String()
+		signatureTTL = urlSigner.Flag("ttl", "Signature validity, e.g. 720h, by default the signature never expires").Duration()
+		mediaServer  = app.Command("server", "Starts media server")
 	)
 
 	kingpin.Version("1.0.0")
@@ -31,10 +50,69 @@ func Start() {
 		jwtManager, err := authentication.NewJwtManager()
 		errs.FailOnError(err)
 
-		token, err := jwtManager.GenerateToken(*appName)
+		token, err := jwtManager.GenerateScopedToken(
+			*appName,
+			authentication.TokenScope{Scopes: *tokenScopes, Folders: *tokenFolders},
+			*tokenTTL,
+		)
 		errs.FailOnError(err)
 
 		fmt.Println(token)
+	case tokenRevoker.FullCommand():
+		expiresAt := time.Time{}
+		if *tokenExpiration > 0 {
+			expiresAt = time.Unix(*tokenExpiration, 0)
+		}
+
+		isRevoked, err := readRevocationList().Revoke(*tokenIDToRevoke, expiresAt, time.Now())
+		errs.FailOnError(err)
+
+		if !isRevoked {
+			fmt.Printf("Token %s is already revoked\n", *tokenIDToRevoke)
+			return
+		}
+		fmt.Printf("Token %s is revoked\n", *tokenIDToRevoke)
+	case revokedLister.FullCommand():
+		revokedTokens, err := readRevocationList().List()
+		errs.FailOnError(err)
+
+		for _, revokedToken := range revokedTokens {
+			expiresAt := "-"
+			if revokedToken.ExpiresAt > 0 {
+				expiresAt = time.Unix(revokedToken.ExpiresAt, 0).UTC().Format(time.RFC3339)
+			}
+			fmt.Printf("%s\t%s\t%s\n", revokedToken.ID, revokedToken.RevokedAt.Format(time.RFC3339), expiresAt)
+		}
+	case tokenInspector.FullCommand():
+		jwtManager, err := authentication.NewJwtManager()
+		errs.FailOnError(err)
+
+		claims, err := jwtManager.InspectToken(*tokenToInspect)
+		if claims != nil {
+			claimsJSON, e := json.MarshalIndent(claims, "", "  ")
+			errs.FailOnError(e)
+			fmt.Println(string(claimsJSON))
+		}
+		if err != nil {
+			fmt.Printf("Token is invalid: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Token is valid")
+	case urlSigner.FullCommand():
+		signer := assets.NewURLSigner()
+		if !signer.IsEnabled() {
+			errs.FailOnError(errors.New("URL_SIGNING_SECRET is not set"))
+		}
+
+		urlPrefix := strings.Trim(env.ReadEnv("URL_PREFIX", "/media/images/"), "/")
+		path := strings.TrimPrefix(strings.Trim(*pathToSign, "/"), urlPrefix+"/")
+
+		expiresAt := time.Time{}
+		if *signatureTTL > 0 {
+			expiresAt = time.Now().Add(*signatureTTL)
+		}
+
+		fmt.Println("/" + urlPrefix + "/" + signer.Sign(path, expiresAt))
 	case mediaServer.FullCommand():
 		serverRunner := http.NewServerRunner()
 		srv, err := serverRunner.Run()
@@ -51,3 +129,15 @@ func Start() {
 		cancelFunc()
 	}
 }
+
+func readRevocationList() *authentication.RevocationList {
+	revocationList := authentication.NewRevocationList(
+		env.ReadEnv("TOKEN_REVOCATION_LIST_PATH", ""),
+		time.Duration(env.ReadEnvInt("TOKEN_LEEWAY_SECONDS", 0))*time.Second,
+	)
+	if !revocationList.IsEnabled() {
+		errs.FailOnError(errors.New("TOKEN_REVOCATION_LIST_PATH is not set"))
+	}
+
+	return revocationList
+}
@@ -1,8 +1,8 @@
 package error
 
 type StatusError struct {
-	Status         int
-	Error          error
-	Text           string
-	ValidationErrs ValidationErrors
+	Status     int
+	Error      error
+	Text       string
+	Violations []Violation
 }
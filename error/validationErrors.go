@@ -15,3 +15,24 @@ func (ves ValidationErrors) Merge(ves2 ValidationErrors) {
 		ves[field] = append(ves[field], ve...)
 	}
 }
+
+// AddViolations appends messages of violated rules to the field errors
+func (ves ValidationErrors) AddViolations(field string, violations []Violation) {
+	for _, violation := range violations {
+		ves[field] = append(ves[field], violation.Message)
+	}
+}
+
+// Violation is a failed validation rule, the code is stable, so that clients can localize the message
+type Violation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// FileValidationError lists all violated rules of an uploaded file
+type FileValidationError struct {
+	Index      int         `json:"index"`
+	Filename   string      `json:"filename"`
+	Field      string      `json:"field"`
+	Violations []Violation `json:"violations"`
+}
@@ -4,6 +4,7 @@ import (
 	"image"
 	"io"
 	"net/http"
+	"os"
 )
 
 type Manager interface {
@@ -11,9 +12,38 @@ type Manager interface {
 	IsNonExistingPathError(err error) bool
 	IsImageDirEmpty(imgPath *ImagePath, isResized bool) (bool, error)
 	RemoveDir(imgPath *ImagePath, isResizedDir, isResizedParentDir bool) error
-	CreateNonResizedFileWriter(folderName, imageName string) (io.WriteCloser, error)
+	SaveNonResizedImage(folderName, imageName string, encodedImage io.Reader) error
 	FileExists(imgPath *ImagePath, isResized bool) (bool, error)
 	CreateFileReader(imgPath *ImagePath, isResized bool) (http.File, error)
 	OpenNonResizedImage(imgPath *ImagePath) (image.Image, error)
-	SaveResizedImage(imgPath *ImagePath, srcImage image.Image) (http.File, error)
+	SaveResizedImage(imgPath *ImagePath, encodedImage io.Reader) (http.File, error)
+	ListResizedImages(imgPath *ImagePath) ([]string, error)
+	// CreateMarker atomically creates an empty file unless it exists, false means it existed,
+	// so that concurrent service instances sharing the storage can claim a path once
+	CreateMarker(markerPath string) (bool, error)
+	// ListMarkerFolders gives names of the folders in the folder of markers
+	ListMarkerFolders(folderPath string) ([]string, error)
+	RemoveMarkerFolder(folderPath string) error
+}
+
+func collectFileNames(fileInfos []os.FileInfo) []string {
+	fileNames := make([]string, 0, len(fileInfos))
+	for _, fileInfo := range fileInfos {
+		if !fileInfo.IsDir() {
+			fileNames = append(fileNames, fileInfo.Name())
+		}
+	}
+
+	return fileNames
+}
+
+func collectFolderNames(fileInfos []os.FileInfo) []string {
+	folderNames := make([]string, 0, len(fileInfos))
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() {
+			folderNames = append(folderNames, fileInfo.Name())
+		}
+	}
+
+	return folderNames
 }
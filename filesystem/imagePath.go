@@ -1,24 +1,34 @@
 package filesystem
 
-import "path/filepath"
+import (
+	"path/filepath"
+)
 
 type ImagePath struct {
 	FolderName       string
 	ImageFile        string
 	ImageName        string
 	ImageExt         string
+	OutputExt        string
 	RawResizedFolder string
+	PresetName       string
 	Width            int
 	Height           int
+	Mode             string
+	Quality          int
+	Background       string
+	Gravity          string
 	IsValid          bool
 }
 
+// GetResizedFolderPath keeps the extension of the image file, since the output format of resized images
+// can differ from the source one, so that e.g. img.png and img.jpg of one folder don't share resized images
 func (ip *ImagePath) GetResizedFolderPath() string {
 	return filepath.Join(
 		"cache",
 		"resized_image",
 		ip.FolderName,
-		ip.ImageName,
+		ip.ImageFile,
 	)
 }
 
@@ -31,7 +41,7 @@ func (ip *ImagePath) GetResizedParentFolderPath() string {
 }
 
 func (ip *ImagePath) GetResizedImagePath() string {
-	resizedImage := ip.RawResizedFolder + "." + ip.ImageExt
+	resizedImage := ip.RawResizedFolder + "." + ip.GetResizedImageExt()
 
 	return filepath.Join(ip.GetResizedFolderPath(), resizedImage)
 }
@@ -43,3 +53,12 @@ func (ip *ImagePath) GetNonResizedImagePath() string {
 func (ip *ImagePath) GetNonResizedFolderPath() string {
 	return filepath.Join(ip.FolderName)
 }
+
+// GetResizedImageExt gives the extension of the resized image, which differs from the original one if another output format is requested
+func (ip *ImagePath) GetResizedImageExt() string {
+	if ip.OutputExt != "" {
+		return ip.OutputExt
+	}
+
+	return ip.ImageExt
+}
@@ -3,16 +3,17 @@ package filesystem
 import (
 	"image"
 	io2 "io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
 
 	"github.com/breathbath/go_utils/utils/io"
-	"github.com/disintegration/imaging"
 )
 
 type LocalFileSystemManager struct {
-	AssetsPath string
+	AssetsPath     string
+	MaxImagePixels int64
 }
 
 func (lfsm LocalFileSystemManager) IsNonExistingPathError(err error) bool {
@@ -24,31 +25,68 @@ func (lfsm LocalFileSystemManager) RemoveNonResizedImage(imgPath *ImagePath) err
 	return os.Remove(filepath.Join(lfsm.AssetsPath, nonResizedFilePath))
 }
 
-func (lfsm LocalFileSystemManager) CreateNonResizedFileWriter(folderName, imageName string) (io2.WriteCloser, error) {
-	err := os.MkdirAll(filepath.Join(lfsm.AssetsPath, folderName), os.ModePerm)
+// SaveNonResizedImage writes a temporary file and renames it, so that a failed save keeps the existing image
+func (lfsm LocalFileSystemManager) SaveNonResizedImage(folderName, imageName string, encodedImage io2.Reader) error {
+	folderPath := filepath.Join(lfsm.AssetsPath, folderName)
+	err := os.MkdirAll(folderPath, os.ModePerm)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	imgPath := filepath.Join(lfsm.AssetsPath, folderName, imageName)
-	io.OutputInfo("", "Will save image under '%s'", filepath.Join(lfsm.AssetsPath, folderName, imageName))
-	outfile, err := os.Create(imgPath)
+	imgPath := filepath.Join(folderPath, imageName)
+	io.OutputInfo("", "Will save image under '%s'", imgPath)
+	tmpFile, err := ioutil.TempFile(folderPath, "."+imageName+".*.tmp")
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return outfile, nil
+	_, err = io2.Copy(tmpFile, encodedImage)
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpFile.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), imgPath)
+	}
+
+	if err != nil {
+		removeErr := os.Remove(tmpFile.Name())
+		if removeErr != nil && !os.IsNotExist(removeErr) {
+			io.OutputError(removeErr, "", "Failed to remove incomplete image '%s'", tmpFile.Name())
+		}
+		return err
+	}
+
+	return nil
 }
 
-func (lfsm LocalFileSystemManager) SaveResizedImage(imgPath *ImagePath, srcImage image.Image) (http.File, error) {
+func (lfsm LocalFileSystemManager) SaveResizedImage(imgPath *ImagePath, encodedImage io2.Reader) (http.File, error) {
 	err := os.MkdirAll(filepath.Join(lfsm.AssetsPath, imgPath.GetResizedFolderPath()), os.ModePerm)
 	if err != nil {
 		return nil, err
 	}
 
 	resizedPath := filepath.Join(lfsm.AssetsPath, imgPath.GetResizedImagePath())
-	err = imaging.Save(srcImage, resizedPath)
+	resizedFile, err := os.Create(resizedPath)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io2.Copy(resizedFile, encodedImage)
+	closeErr := resizedFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+
 	if err != nil {
+		// incomplete file would be served as cached resized image otherwise
+		removeErr := os.Remove(resizedPath)
+		if removeErr != nil {
+			io.OutputError(removeErr, "", "Failed to remove incomplete resized image '%s'", resizedPath)
+		}
 		return nil, err
 	}
 
@@ -129,12 +167,18 @@ func (lfsm LocalFileSystemManager) OpenNonResizedImage(imgPath *ImagePath) (imag
 		return nil, err
 	}
 
-	src, err := imaging.Open(nonResizedImagePath)
+	f, err := os.Open(nonResizedImagePath)
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		e := f.Close()
+		if e != nil {
+			io.OutputError(e, "", "Failed to close file '%s'", imgPath.ImageFile)
+		}
+	}()
 
-	return src, nil
+	return decodeWithinPixelBudget(f, lfsm.MaxImagePixels)
 }
 
 func (lfsm LocalFileSystemManager) RemoveDir(imgPath *ImagePath, isResizedDir, isResizedParentDir bool) error {
@@ -147,3 +191,50 @@ func (lfsm LocalFileSystemManager) RemoveDir(imgPath *ImagePath, isResizedDir, i
 	}
 	return os.RemoveAll(filepath.Join(lfsm.AssetsPath, dirToDelete))
 }
+
+// ListResizedImages gives file names of all cached resized variants of the image
+func (lfsm LocalFileSystemManager) ListResizedImages(imgPath *ImagePath) ([]string, error) {
+	fileInfos, err := ioutil.ReadDir(filepath.Join(lfsm.AssetsPath, imgPath.GetResizedFolderPath()))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return collectFileNames(fileInfos), nil
+}
+
+func (lfsm LocalFileSystemManager) CreateMarker(markerPath string) (bool, error) {
+	fullPath := filepath.Join(lfsm.AssetsPath, markerPath)
+	err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm)
+	if err != nil {
+		return false, err
+	}
+
+	markerFile, err := os.OpenFile(fullPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, markerFile.Close()
+}
+
+func (lfsm LocalFileSystemManager) ListMarkerFolders(folderPath string) ([]string, error) {
+	fileInfos, err := ioutil.ReadDir(filepath.Join(lfsm.AssetsPath, folderPath))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return collectFolderNames(fileInfos), nil
+}
+
+func (lfsm LocalFileSystemManager) RemoveMarkerFolder(folderPath string) error {
+	return os.RemoveAll(filepath.Join(lfsm.AssetsPath, folderPath))
+}
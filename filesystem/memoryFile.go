@@ -0,0 +1,67 @@
+package filesystem
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// memoryFile exposes a fully loaded file content as http.File
+type memoryFile struct {
+	*bytes.Reader
+	info memoryFileInfo
+}
+
+type memoryFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func newMemoryFile(name string, content []byte, modTime time.Time) *memoryFile {
+	return &memoryFile{
+		Reader: bytes.NewReader(content),
+		info: memoryFileInfo{
+			name:    filepath.Base(name),
+			size:    int64(len(content)),
+			modTime: modTime,
+		},
+	}
+}
+
+func (mf *memoryFile) Close() error {
+	return nil
+}
+
+func (mf *memoryFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: mf.info.name, Err: os.ErrInvalid}
+}
+
+func (mf *memoryFile) Stat() (os.FileInfo, error) {
+	return mf.info, nil
+}
+
+func (mfi memoryFileInfo) Name() string {
+	return mfi.name
+}
+
+func (mfi memoryFileInfo) Size() int64 {
+	return mfi.size
+}
+
+func (mfi memoryFileInfo) Mode() os.FileMode {
+	return 0444
+}
+
+func (mfi memoryFileInfo) ModTime() time.Time {
+	return mfi.modTime
+}
+
+func (mfi memoryFileInfo) IsDir() bool {
+	return false
+}
+
+func (mfi memoryFileInfo) Sys() interface{} {
+	return nil
+}
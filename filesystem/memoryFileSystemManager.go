@@ -0,0 +1,233 @@
+package filesystem
+
+import (
+	"image"
+	io2 "io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/breathbath/go_utils/utils/io"
+	"github.com/spf13/afero"
+)
+
+// MemoryFileSystemManager keeps all images in memory, the state is lost on restart,
+// so it's meant for tests and ephemeral environments
+type MemoryFileSystemManager struct {
+	fs             afero.Fs
+	maxImagePixels int64
+	markerLock     *sync.Mutex
+}
+
+func NewMemoryFileSystemManager() MemoryFileSystemManager {
+	return NewMemoryFileSystemManagerWithFs(afero.NewMemMapFs())
+}
+
+// NewMemoryFileSystemManagerWithFs keeps images in the given fs, so that its owner can inspect them, paths are rooted at "/"
+func NewMemoryFileSystemManagerWithFs(fs afero.Fs) MemoryFileSystemManager {
+	return MemoryFileSystemManager{fs: fs, maxImagePixels: ReadMaxImagePixels(), markerLock: &sync.Mutex{}}
+}
+
+func (mfsm MemoryFileSystemManager) IsNonExistingPathError(err error) bool {
+	return os.IsNotExist(err)
+}
+
+func (mfsm MemoryFileSystemManager) RemoveNonResizedImage(imgPath *ImagePath) error {
+	return mfsm.fs.Remove(mfsm.buildPath(imgPath.GetNonResizedImagePath()))
+}
+
+// SaveNonResizedImage writes a temporary file and renames it, so that a failed save keeps the existing image
+func (mfsm MemoryFileSystemManager) SaveNonResizedImage(folderName, imageName string, encodedImage io2.Reader) error {
+	err := mfsm.fs.MkdirAll(mfsm.buildPath(folderName), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	imgPath := mfsm.buildPath(filepath.Join(folderName, imageName))
+	io.OutputInfo("", "Will save image in memory under '%s'", imgPath)
+
+	tmpPath := mfsm.buildPath(filepath.Join(folderName, "."+imageName+".tmp"))
+	err = afero.WriteReader(mfsm.fs, tmpPath, encodedImage)
+	if err == nil {
+		err = mfsm.fs.Rename(tmpPath, imgPath)
+	}
+	if err != nil {
+		_ = mfsm.fs.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+func (mfsm MemoryFileSystemManager) SaveResizedImage(imgPath *ImagePath, encodedImage io2.Reader) (http.File, error) {
+	err := mfsm.fs.MkdirAll(mfsm.buildPath(imgPath.GetResizedFolderPath()), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	resizedPath := mfsm.buildPath(imgPath.GetResizedImagePath())
+	err = afero.WriteReader(mfsm.fs, resizedPath, encodedImage)
+	if err != nil {
+		return nil, err
+	}
+
+	return mfsm.fs.Open(resizedPath)
+}
+
+func (mfsm MemoryFileSystemManager) IsImageDirEmpty(imgPath *ImagePath, isResized bool) (bool, error) {
+	name := mfsm.buildPath(imgPath.GetNonResizedFolderPath())
+	if isResized {
+		name = mfsm.buildPath(imgPath.GetResizedParentFolderPath())
+	}
+
+	f, err := mfsm.fs.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil {
+			io.OutputError(e, "", "Failed to close directory '%s'", name)
+		}
+	}()
+
+	_, err = f.Readdir(1)
+	if err == io2.EOF {
+		return true, nil
+	}
+	return false, err
+}
+
+func (mfsm MemoryFileSystemManager) FileExists(imgPath *ImagePath, isResized bool) (bool, error) {
+	filePath := imgPath.GetNonResizedImagePath()
+	if isResized {
+		filePath = imgPath.GetResizedImagePath()
+	}
+
+	info, err := mfsm.fs.Stat(mfsm.buildPath(filePath))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return !info.IsDir(), nil
+}
+
+func (mfsm MemoryFileSystemManager) CreateFileReader(imgPath *ImagePath, isResized bool) (http.File, error) {
+	filePath := imgPath.GetNonResizedImagePath()
+	if isResized {
+		filePath = imgPath.GetResizedImagePath()
+	}
+
+	return mfsm.fs.Open(mfsm.buildPath(filePath))
+}
+
+func (mfsm MemoryFileSystemManager) OpenNonResizedImage(imgPath *ImagePath) (image.Image, error) {
+	f, err := mfsm.fs.Open(mfsm.buildPath(imgPath.GetNonResizedImagePath()))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		e := f.Close()
+		if e != nil {
+			io.OutputError(e, "", "Failed to close file '%s'", imgPath.ImageFile)
+		}
+	}()
+
+	return decodeWithinPixelBudget(f, mfsm.maxImagePixels)
+}
+
+func (mfsm MemoryFileSystemManager) RemoveDir(imgPath *ImagePath, isResizedDir, isResizedParentDir bool) error {
+	dirToDelete := imgPath.GetNonResizedFolderPath()
+	if isResizedDir {
+		dirToDelete = imgPath.GetResizedFolderPath()
+	}
+	if isResizedParentDir {
+		dirToDelete = imgPath.GetResizedParentFolderPath()
+	}
+	return mfsm.removeAll(mfsm.buildPath(dirToDelete))
+}
+
+// removeAll deletes the directory tree item by item, since MemMapFs.RemoveAll also deletes
+// siblings which names start with the deleted directory name
+func (mfsm MemoryFileSystemManager) removeAll(dirPath string) error {
+	pathsToDelete := []string{}
+	err := afero.Walk(mfsm.fs, dirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		pathsToDelete = append(pathsToDelete, path)
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// children are listed after their parents, so deleting in reverse order keeps directories empty before removal
+	for i := len(pathsToDelete) - 1; i >= 0; i-- {
+		err = mfsm.fs.Remove(pathsToDelete[i])
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ListResizedImages gives file names of all cached resized variants of the image
+func (mfsm MemoryFileSystemManager) ListResizedImages(imgPath *ImagePath) ([]string, error) {
+	fileInfos, err := afero.ReadDir(mfsm.fs, mfsm.buildPath(imgPath.GetResizedFolderPath()))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return collectFileNames(fileInfos), nil
+}
+
+// CreateMarker checks and creates the file under a lock, since the in-memory file system ignores O_EXCL
+func (mfsm MemoryFileSystemManager) CreateMarker(markerPath string) (bool, error) {
+	mfsm.markerLock.Lock()
+	defer mfsm.markerLock.Unlock()
+
+	fullPath := mfsm.buildPath(markerPath)
+	isExisting, err := afero.Exists(mfsm.fs, fullPath)
+	if err != nil || isExisting {
+		return false, err
+	}
+
+	err = mfsm.fs.MkdirAll(filepath.Dir(fullPath), os.ModePerm)
+	if err != nil {
+		return false, err
+	}
+
+	return true, afero.WriteFile(mfsm.fs, fullPath, []byte{}, 0644)
+}
+
+func (mfsm MemoryFileSystemManager) ListMarkerFolders(folderPath string) ([]string, error) {
+	fileInfos, err := afero.ReadDir(mfsm.fs, mfsm.buildPath(folderPath))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return collectFolderNames(fileInfos), nil
+}
+
+func (mfsm MemoryFileSystemManager) RemoveMarkerFolder(folderPath string) error {
+	return mfsm.removeAll(mfsm.buildPath(folderPath))
+}
+
+func (mfsm MemoryFileSystemManager) buildPath(relPath string) string {
+	return filepath.Join(string(filepath.Separator), relPath)
+}
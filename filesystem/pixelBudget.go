@@ -0,0 +1,180 @@
+package filesystem
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io"
+
+	"github.com/breathbath/go_utils/utils/env"
+	"github.com/disintegration/imaging"
+)
+
+// DefaultMaxImagePixels allows images up to 100 megapixels, which take about 400Mb of memory when decoded
+const DefaultMaxImagePixels = 100000000
+
+// gif blocks read to count frames, the flags are the last byte of the header and of the image descriptor
+const (
+	gifHeaderSize          = 13
+	gifImageDescriptorSize = 9
+	gifColorTableFlag      = 0x80
+	gifColorTableSizeMask  = 0x07
+	gifExtensionIntroducer = 0x21
+	gifImageSeparator      = 0x2C
+	gifTrailer             = 0x3B
+)
+
+// ImageTooLargeError is returned for images which would exceed the pixel budget if decoded,
+// frames of animated gifs are decoded all together, so they count as separate images
+type ImageTooLargeError struct {
+	Width     int
+	Height    int
+	Frames    int
+	MaxPixels int64
+}
+
+func (itle ImageTooLargeError) Error() string {
+	if itle.Frames > 1 {
+		return fmt.Sprintf(
+			"the image of %dx%d pixels and %d frames exceeds the limit of %d pixels",
+			itle.Width,
+			itle.Height,
+			itle.Frames,
+			itle.MaxPixels,
+		)
+	}
+
+	return fmt.Sprintf(
+		"the image of %dx%d pixels exceeds the limit of %d pixels",
+		itle.Width,
+		itle.Height,
+		itle.MaxPixels,
+	)
+}
+
+// ReadMaxImagePixels gives the MAX_IMAGE_PIXELS budget of decoded images, 0 means no limit
+func ReadMaxImagePixels() int64 {
+	return env.ReadEnvInt("MAX_IMAGE_PIXELS", DefaultMaxImagePixels)
+}
+
+// CheckPixelBudget reads image sizes from the header without decoding pixels, frames of gif images are counted
+// by skipping their data, the source is rewound afterwards
+func CheckPixelBudget(source io.ReadSeeker, maxPixels int64) error {
+	_, err := source.Seek(0, io.SeekStart)
+	if err != nil || maxPixels <= 0 {
+		return err
+	}
+
+	imgConfig, format, err := image.DecodeConfig(source)
+	if err != nil {
+		return err
+	}
+
+	_, err = source.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	frames := 1
+	if format == "gif" {
+		frames, err = countGifFrames(source)
+		if err != nil {
+			return err
+		}
+
+		_, err = source.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+	}
+
+	if int64(imgConfig.Width)*int64(imgConfig.Height)*int64(frames) > maxPixels {
+		return ImageTooLargeError{Width: imgConfig.Width, Height: imgConfig.Height, Frames: frames, MaxPixels: maxPixels}
+	}
+
+	return nil
+}
+
+// countGifFrames walks the blocks of a gif image skipping their data, a truncated image gives the frames read so far
+func countGifFrames(source io.Reader) (int, error) {
+	reader := bufio.NewReader(source)
+	header := make([]byte, gifHeaderSize)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return 0, err
+	}
+	err = skipGifColorTable(reader, header[gifHeaderSize-3])
+	if err != nil {
+		return 0, err
+	}
+
+	frames := 0
+	for {
+		blockType, err := reader.ReadByte()
+		if err != nil {
+			return frames, nil
+		}
+
+		switch blockType {
+		case gifExtensionIntroducer:
+			_, err = reader.ReadByte()
+		case gifImageSeparator:
+			frames++
+			descriptor := make([]byte, gifImageDescriptorSize)
+			_, err = io.ReadFull(reader, descriptor)
+			if err == nil {
+				err = skipGifColorTable(reader, descriptor[gifImageDescriptorSize-1])
+			}
+			if err == nil {
+				// the minimal code size of the compressed data
+				_, err = reader.ReadByte()
+			}
+		case gifTrailer:
+			return frames, nil
+		default:
+			return 0, fmt.Errorf("unknown gif block type 0x%x", blockType)
+		}
+		if err != nil {
+			return frames, nil
+		}
+
+		err = skipGifSubBlocks(reader)
+		if err != nil {
+			return frames, nil
+		}
+	}
+}
+
+// skipGifColorTable skips the color table following the header or the image descriptor with the flags
+func skipGifColorTable(reader *bufio.Reader, flags byte) error {
+	if flags&gifColorTableFlag == 0 {
+		return nil
+	}
+
+	_, err := reader.Discard(3 * (1 << (1 + flags&gifColorTableSizeMask)))
+
+	return err
+}
+
+func skipGifSubBlocks(reader *bufio.Reader) error {
+	for {
+		blockSize, err := reader.ReadByte()
+		if err != nil || blockSize == 0 {
+			return err
+		}
+
+		_, err = reader.Discard(int(blockSize))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func decodeWithinPixelBudget(source io.ReadSeeker, maxPixels int64) (image.Image, error) {
+	err := CheckPixelBudget(source, maxPixels)
+	if err != nil {
+		return nil, err
+	}
+
+	return imaging.Decode(source)
+}
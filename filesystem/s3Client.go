@@ -0,0 +1,365 @@
+package filesystem
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	io2 "io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3SigningAlgorithm = "AWS4-HMAC-SHA256"
+	s3Service          = "s3"
+	s3AmzDateFormat    = "20060102T150405Z"
+	s3ShortDateFormat  = "20060102"
+)
+
+// s3Client is a minimal S3-compatible REST client signing requests with AWS Signature Version 4,
+// it covers only the object operations needed by S3FileSystemManager
+type s3Client struct {
+	endpoint   *url.URL
+	region     string
+	bucket     string
+	accessKey  string
+	secretKey  string
+	pathStyle  bool
+	httpClient *http.Client
+}
+
+type s3Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	Body         []byte
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+type s3ErrorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (c *s3Client) putObject(key string, body []byte, contentType string) error {
+	headers := http.Header{}
+	if contentType != "" {
+		headers.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.do(http.MethodPut, key, nil, headers, body)
+	if err != nil {
+		return err
+	}
+
+	return c.closeResponse(resp, key)
+}
+
+// putObjectIfAbsent creates the object with a conditional write, false means the object already exists
+func (c *s3Client) putObjectIfAbsent(key string, body []byte) (bool, error) {
+	resp, err := c.do(http.MethodPut, key, nil, http.Header{"If-None-Match": {"*"}}, body)
+	if err != nil {
+		return false, err
+	}
+
+	// 409 is given if a concurrent conditional write of the same key is in progress
+	if resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusConflict {
+		c.drain(resp)
+		return false, nil
+	}
+
+	err = c.closeResponse(resp, key)
+
+	return err == nil, err
+}
+
+func (c *s3Client) getObject(key string) (*s3Object, error) {
+	resp, err := c.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.drain(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, c.buildError(resp, key)
+	}
+
+	body, err := io2.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := c.objectFromHeaders(key, resp.Header)
+	obj.Body = body
+	obj.Size = int64(len(body))
+
+	return obj, nil
+}
+
+func (c *s3Client) headObject(key string) (*s3Object, error) {
+	resp, err := c.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.drain(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, c.buildError(resp, key)
+	}
+
+	return c.objectFromHeaders(key, resp.Header), nil
+}
+
+func (c *s3Client) deleteObject(key string) error {
+	resp, err := c.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return c.closeResponse(resp, key)
+}
+
+// listObjects returns a single page of objects under the prefix, nextToken is empty for the last page
+func (c *s3Client) listObjects(prefix string, maxKeys int, continuationToken string) (objects []s3Object, nextToken string, err error) {
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", prefix)
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	if continuationToken != "" {
+		query.Set("continuation-token", continuationToken)
+	}
+
+	resp, err := c.do(http.MethodGet, "", query, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer c.drain(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", c.buildError(resp, prefix)
+	}
+
+	listResult := s3ListBucketResult{}
+	err = xml.NewDecoder(resp.Body).Decode(&listResult)
+	if err != nil {
+		return nil, "", err
+	}
+
+	objects = make([]s3Object, 0, len(listResult.Contents))
+	for _, content := range listResult.Contents {
+		objects = append(objects, s3Object{
+			Key:          content.Key,
+			Size:         content.Size,
+			LastModified: content.LastModified,
+		})
+	}
+
+	if listResult.IsTruncated {
+		nextToken = listResult.NextContinuationToken
+	}
+
+	return objects, nextToken, nil
+}
+
+func (c *s3Client) objectFromHeaders(key string, headers http.Header) *s3Object {
+	obj := &s3Object{Key: key}
+	obj.Size, _ = strconv.ParseInt(headers.Get("Content-Length"), 10, 64)
+	obj.LastModified, _ = http.ParseTime(headers.Get("Last-Modified"))
+
+	return obj
+}
+
+func (c *s3Client) closeResponse(resp *http.Response, key string) error {
+	defer c.drain(resp)
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return c.buildError(resp, key)
+	}
+
+	return nil
+}
+
+func (c *s3Client) drain(resp *http.Response) {
+	_, _ = io2.Copy(io2.Discard, resp.Body)
+	_ = resp.Body.Close()
+}
+
+func (c *s3Client) buildError(resp *http.Response, key string) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return &os.PathError{Op: "open", Path: key, Err: os.ErrNotExist}
+	}
+
+	errResp := s3ErrorResponse{}
+	if resp.Request.Method != http.MethodHead {
+		_ = xml.NewDecoder(resp.Body).Decode(&errResp)
+	}
+
+	return fmt.Errorf(
+		"s3 request %s '%s' failed with status %d: %s %s",
+		resp.Request.Method,
+		key,
+		resp.StatusCode,
+		errResp.Code,
+		errResp.Message,
+	)
+}
+
+func (c *s3Client) buildURL(key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	objectPath := "/" + key
+	if c.pathStyle {
+		objectPath = "/" + c.bucket + objectPath
+	} else {
+		u.Host = c.bucket + "." + u.Host
+	}
+
+	u.Path = strings.TrimRight(c.endpoint.Path, "/") + objectPath
+	u.RawPath = strings.TrimRight(c.endpoint.EscapedPath(), "/") + s3EscapePath(objectPath)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	return &u
+}
+
+func (c *s3Client) do(method, key string, query url.Values, headers http.Header, body []byte) (*http.Response, error) {
+	reqURL := c.buildURL(key, query)
+	req, err := http.NewRequest(method, reqURL.String(), bytes.NewReader(body)) // nolint: noctx
+	if err != nil {
+		return nil, err
+	}
+
+	for headerName, headerValues := range headers {
+		req.Header[headerName] = headerValues
+	}
+	req.ContentLength = int64(len(body))
+
+	c.sign(req, body, time.Now().UTC())
+
+	return c.httpClient.Do(req)
+}
+
+func (c *s3Client) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	payloadHashHex := hex.EncodeToString(payloadHash[:])
+	amzDate := now.Format(s3AmzDateFormat)
+	shortDate := now.Format(s3ShortDateFormat)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHashHex)
+
+	signedHeaderValues := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHashHex,
+		"x-amz-date":           amzDate,
+	}
+	if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		signedHeaderValues["content-type"] = contentType
+	}
+
+	signedHeaderNames := make([]string, 0, len(signedHeaderValues))
+	for headerName := range signedHeaderValues {
+		signedHeaderNames = append(signedHeaderNames, headerName)
+	}
+	sort.Strings(signedHeaderNames)
+
+	canonicalHeaders := ""
+	for _, headerName := range signedHeaderNames {
+		canonicalHeaders += headerName + ":" + strings.TrimSpace(signedHeaderValues[headerName]) + "\n"
+	}
+	signedHeaders := strings.Join(signedHeaderNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHashHex,
+	}, "\n")
+
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := strings.Join([]string{shortDate, c.region, s3Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		s3SigningAlgorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	signingKey := s3Hmac([]byte("AWS4"+c.secretKey), shortDate)
+	signingKey = s3Hmac(signingKey, c.region)
+	signingKey = s3Hmac(signingKey, s3Service)
+	signingKey = s3Hmac(signingKey, "aws4_request")
+	signature := hex.EncodeToString(s3Hmac(signingKey, stringToSign))
+
+	req.Header.Set(
+		"Authorization",
+		fmt.Sprintf(
+			"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+			s3SigningAlgorithm,
+			c.accessKey,
+			scope,
+			signedHeaders,
+			signature,
+		),
+	)
+}
+
+func s3Hmac(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape applies the RFC 3986 encoding required by the V4 signature
+func s3Escape(value string) string {
+	return strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+}
+
+func s3EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	if len(query) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, s3Escape(key)+"="+s3Escape(value))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
@@ -0,0 +1,277 @@
+package filesystem
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	io2 "io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/breathbath/go_utils/utils/env"
+	"github.com/breathbath/go_utils/utils/io"
+)
+
+// S3FileSystemManager stores images as objects of an S3-compatible bucket, folders are mapped to key prefixes
+type S3FileSystemManager struct {
+	client         *s3Client
+	keyPrefix      string
+	maxImagePixels int64
+}
+
+func NewS3FileSystemManager() (*S3FileSystemManager, error) {
+	rawEndpoint, err := env.ReadEnvOrError("S3_ENDPOINT")
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint, err := url.Parse(rawEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT '%s', expected format is http(s)://host[:port]", rawEndpoint)
+	}
+
+	bucket, err := env.ReadEnvOrError("S3_BUCKET")
+	if err != nil {
+		return nil, err
+	}
+
+	accessKey, err := env.ReadEnvOrError("S3_ACCESS_KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	secretKey, err := env.ReadEnvOrError("S3_SECRET_KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	const defaultTimeoutSeconds = 30
+	timeout := env.ReadEnvInt("S3_TIMEOUT_SECONDS", defaultTimeoutSeconds)
+
+	return &S3FileSystemManager{
+		client: &s3Client{
+			endpoint:   endpoint,
+			region:     env.ReadEnv("S3_REGION", "us-east-1"),
+			bucket:     bucket,
+			accessKey:  accessKey,
+			secretKey:  secretKey,
+			pathStyle:  env.ReadEnv("S3_PATH_STYLE", "true") == "true",
+			httpClient: &http.Client{Timeout: time.Duration(timeout) * time.Second},
+		},
+		keyPrefix:      strings.Trim(env.ReadEnv("S3_PREFIX", ""), "/"),
+		maxImagePixels: ReadMaxImagePixels(),
+	}, nil
+}
+
+func (s3m S3FileSystemManager) buildKey(relPath string) string {
+	return path.Join(s3m.keyPrefix, filepath.ToSlash(relPath))
+}
+
+// buildDirPrefix gives a prefix matching all keys in a "directory", the trailing slash protects from matching
+// siblings with the same name beginning
+func (s3m S3FileSystemManager) buildDirPrefix(relPath string) string {
+	return s3m.buildKey(relPath) + "/"
+}
+
+func (s3m S3FileSystemManager) IsNonExistingPathError(err error) bool {
+	return os.IsNotExist(err)
+}
+
+func (s3m S3FileSystemManager) RemoveNonResizedImage(imgPath *ImagePath) error {
+	key := s3m.buildKey(imgPath.GetNonResizedImagePath())
+
+	// S3 deletes are idempotent, so the existence is checked explicitly to report missing images
+	_, err := s3m.client.headObject(key)
+	if err != nil {
+		return err
+	}
+
+	return s3m.client.deleteObject(key)
+}
+
+// SaveNonResizedImage uploads the image with a single PUT, so the existing object is replaced only by a complete image
+func (s3m S3FileSystemManager) SaveNonResizedImage(folderName, imageName string, encodedImage io2.Reader) error {
+	key := s3m.buildKey(filepath.Join(folderName, imageName))
+	io.OutputInfo("", "Will save image under s3 key '%s'", key)
+
+	content, err := io2.ReadAll(encodedImage)
+	if err != nil {
+		return err
+	}
+
+	return s3m.client.putObject(key, content, mime.TypeByExtension(filepath.Ext(imageName)))
+}
+
+func (s3m S3FileSystemManager) SaveResizedImage(imgPath *ImagePath, encodedImage io2.Reader) (http.File, error) {
+	content, err := io2.ReadAll(encodedImage)
+	if err != nil {
+		return nil, err
+	}
+
+	resizedPath := imgPath.GetResizedImagePath()
+	err = s3m.client.putObject(s3m.buildKey(resizedPath), content, mime.TypeByExtension("."+imgPath.GetResizedImageExt()))
+	if err != nil {
+		return nil, err
+	}
+
+	return newMemoryFile(resizedPath, content, time.Now()), nil
+}
+
+func (s3m S3FileSystemManager) IsImageDirEmpty(imgPath *ImagePath, isResized bool) (bool, error) {
+	dirPath := imgPath.GetNonResizedFolderPath()
+	if isResized {
+		dirPath = imgPath.GetResizedParentFolderPath()
+	}
+
+	objects, _, err := s3m.client.listObjects(s3m.buildDirPrefix(dirPath), 1, "")
+	if err != nil {
+		return false, err
+	}
+
+	return len(objects) == 0, nil
+}
+
+func (s3m S3FileSystemManager) FileExists(imgPath *ImagePath, isResized bool) (bool, error) {
+	filePath := imgPath.GetNonResizedImagePath()
+	if isResized {
+		filePath = imgPath.GetResizedImagePath()
+	}
+
+	_, err := s3m.client.headObject(s3m.buildKey(filePath))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s3m S3FileSystemManager) CreateFileReader(imgPath *ImagePath, isResized bool) (http.File, error) {
+	filePath := imgPath.GetNonResizedImagePath()
+	if isResized {
+		filePath = imgPath.GetResizedImagePath()
+	}
+
+	obj, err := s3m.client.getObject(s3m.buildKey(filePath))
+	if err != nil {
+		return nil, err
+	}
+
+	return newMemoryFile(filePath, obj.Body, obj.LastModified), nil
+}
+
+func (s3m S3FileSystemManager) OpenNonResizedImage(imgPath *ImagePath) (image.Image, error) {
+	obj, err := s3m.client.getObject(s3m.buildKey(imgPath.GetNonResizedImagePath()))
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeWithinPixelBudget(bytes.NewReader(obj.Body), s3m.maxImagePixels)
+}
+
+func (s3m S3FileSystemManager) RemoveDir(imgPath *ImagePath, isResizedDir, isResizedParentDir bool) error {
+	dirToDelete := imgPath.GetNonResizedFolderPath()
+	if isResizedDir {
+		dirToDelete = imgPath.GetResizedFolderPath()
+	}
+	if isResizedParentDir {
+		dirToDelete = imgPath.GetResizedParentFolderPath()
+	}
+
+	return s3m.removeObjects(s3m.buildDirPrefix(dirToDelete))
+}
+
+// removeObjects deletes all objects with the prefix page by page
+func (s3m S3FileSystemManager) removeObjects(prefix string) error {
+	continuationToken := ""
+	for {
+		objects, nextToken, err := s3m.client.listObjects(prefix, 0, continuationToken)
+		if err != nil {
+			return err
+		}
+
+		for i := range objects {
+			err = s3m.client.deleteObject(objects[i].Key)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		if nextToken == "" {
+			return nil
+		}
+		continuationToken = nextToken
+	}
+}
+
+// ListResizedImages gives file names of all cached resized variants of the image
+func (s3m S3FileSystemManager) ListResizedImages(imgPath *ImagePath) ([]string, error) {
+	prefix := s3m.buildDirPrefix(imgPath.GetResizedFolderPath())
+	fileNames := []string{}
+	continuationToken := ""
+	for {
+		objects, nextToken, err := s3m.client.listObjects(prefix, 0, continuationToken)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range objects {
+			fileName := strings.TrimPrefix(objects[i].Key, prefix)
+			if fileName != "" && !strings.Contains(fileName, "/") {
+				fileNames = append(fileNames, fileName)
+			}
+		}
+
+		if nextToken == "" {
+			return fileNames, nil
+		}
+		continuationToken = nextToken
+	}
+}
+
+func (s3m S3FileSystemManager) CreateMarker(markerPath string) (bool, error) {
+	return s3m.client.putObjectIfAbsent(s3m.buildKey(markerPath), []byte{})
+}
+
+// ListMarkerFolders gives the folder names from the keys of the markers, since S3 has no folders
+func (s3m S3FileSystemManager) ListMarkerFolders(folderPath string) ([]string, error) {
+	prefix := s3m.buildDirPrefix(folderPath)
+	folderNames := []string{}
+	isListed := map[string]bool{}
+	continuationToken := ""
+	for {
+		objects, nextToken, err := s3m.client.listObjects(prefix, 0, continuationToken)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range objects {
+			folderName := strings.SplitN(strings.TrimPrefix(objects[i].Key, prefix), "/", 2)
+			if len(folderName) == 2 && folderName[0] != "" && !isListed[folderName[0]] {
+				isListed[folderName[0]] = true
+				folderNames = append(folderNames, folderName[0])
+			}
+		}
+
+		if nextToken == "" {
+			return folderNames, nil
+		}
+		continuationToken = nextToken
+	}
+}
+
+func (s3m S3FileSystemManager) RemoveMarkerFolder(folderPath string) error {
+	return s3m.removeObjects(s3m.buildDirPrefix(folderPath))
+}
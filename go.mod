@@ -4,6 +4,7 @@ go 1.19
 
 require (
 	github.com/breathbath/go_utils v0.0.0-20190211130746-62379d8df36c
+	github.com/chai2010/webp v1.4.0
 	github.com/codegangsta/negroni v1.0.0
 	github.com/disintegration/imaging v1.6.0
 	github.com/gabriel-vasile/mimetype v0.3.16
@@ -11,6 +12,7 @@ require (
 	github.com/gorilla/mux v1.7.0
 	github.com/spf13/afero v1.2.2
 	github.com/stretchr/testify v1.3.0
+	golang.org/x/image v0.7.0
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
 )
 
@@ -19,6 +21,5 @@ require (
 	github.com/alecthomas/units v0.0.0-20190717042225-c3de453c63f4 // indirect
 	github.com/davecgh/go-spew v1.1.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/image v0.7.0 // indirect
 	golang.org/x/text v0.9.0 // indirect
 )
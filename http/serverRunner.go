@@ -1,6 +1,8 @@
 package http
 
 import (
+	"fmt"
+	"net"
 	"net/http"
 	"strings"
 
@@ -14,6 +16,8 @@ import (
 )
 
 type ServerRunner struct {
+	// FileSystemManager replaces the storage configured by STORAGE_DRIVER, if set
+	FileSystemManager filesystem.Manager
 }
 
 func NewServerRunner() ServerRunner {
@@ -26,9 +30,12 @@ func (sr ServerRunner) Run() (*http.Server, error) {
 		return nil, err
 	}
 
-	assetsPath, err := env.ReadEnvOrError("ASSETS_PATH")
-	if err != nil {
-		return nil, err
+	fileSystemHandler := sr.FileSystemManager
+	if fileSystemHandler == nil {
+		fileSystemHandler, err = sr.createFileSystemManager()
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	urlPrefix := env.ReadEnv("URL_PREFIX", "/media/images/")
@@ -50,19 +57,75 @@ func (sr ServerRunner) Run() (*http.Server, error) {
 
 	router := mux.NewRouter()
 
-	fileSystemHandler := filesystem.LocalFileSystemManager{AssetsPath: assetsPath}
+	presets, err := assets.LoadPresets(env.ReadEnv("PRESETS_CONFIG_PATH", ""))
+	if err != nil {
+		return nil, err
+	}
+
+	resizeLimits, err := assets.NewResizeLimits()
+	if err != nil {
+		return nil, err
+	}
+
+	imageMetaHandler := assets.ImageMetaHandler{
+		FileSystemManager: fileSystemHandler,
+	}
+	// registered before the file server, which would match the same path
+	router.HandleFunc(strings.TrimRight(urlPrefix, "/")+"/{folder}/{image}/meta", imageMetaHandler.HandleMeta).Methods(http.MethodGet)
 
-	fileSystemManager := assets.NewImageReadHandler(fileSystemHandler)
-	fileServerHandler := http.FileServer(fileSystemManager)
+	fileSystemManager := assets.NewImageReadHandler(fileSystemHandler, presets, resizeLimits)
+	fileServerHandler := assets.NewSignedURLHandler(
+		assets.NewURLSigner(),
+		assets.NewFormatNegotiationHandler(presets, assets.NewImageFileServer(fileSystemManager)),
+	)
 	router.PathPrefix(urlPrefix).Handler(http.StripPrefix(urlPrefix, fileServerHandler)).Methods(http.MethodGet)
 
+	imageSaver, err := assets.NewImageSaver(fileSystemHandler)
+	if err != nil {
+		return nil, err
+	}
+
+	uploadRules, err := assets.NewUploadRules()
+	if err != nil {
+		return nil, err
+	}
+	uploadTokenManager, err := authentication.NewUploadTokenManager(fileSystemHandler)
+	if err != nil {
+		return nil, err
+	}
+	postHandler := assets.NewImagePostHandler(imageSaver, uploadRules, uploadTokenManager)
+
+	uploadURLHandler := assets.NewUploadURLHandler(postHandler, uploadTokenManager)
+	router.HandleFunc(
+		strings.TrimRight(urlPrefix, "/")+"/"+assets.UploadURLsPath,
+		uploadURLHandler.HandleCreate,
+	).Methods(http.MethodPost)
+
+	tusUploadHandler, err := assets.NewTusUploadHandler(postHandler)
+	if err != nil {
+		return nil, err
+	}
+	// registered before the image delete route, which would match the same path
+	tusUploadsPath := strings.TrimRight(urlPrefix, "/") + "/" + assets.TusUploadsPath
+	router.HandleFunc(tusUploadsPath, tusUploadHandler.HandleOptions).Methods(http.MethodOptions)
+	router.HandleFunc(tusUploadsPath, tusUploadHandler.HandleCreate).Methods(http.MethodPost)
+	router.HandleFunc(tusUploadsPath+"/{id}", tusUploadHandler.HandleOptions).Methods(http.MethodOptions)
+	router.HandleFunc(tusUploadsPath+"/{id}", tusUploadHandler.HandleHead).Methods(http.MethodHead)
+	router.HandleFunc(tusUploadsPath+"/{id}", tusUploadHandler.HandlePatch).Methods(http.MethodPatch)
+	router.HandleFunc(tusUploadsPath+"/{id}", tusUploadHandler.HandleDelete).Methods(http.MethodDelete)
+
 	imageDeleteHandler := assets.ImageDeleteHandler{
 		FileSystemManager: fileSystemHandler,
 	}
 	router.HandleFunc(strings.TrimRight(urlPrefix, "/")+"/{folder}/{image}", imageDeleteHandler.HandleDelete).Methods(http.MethodDelete)
+	router.HandleFunc(strings.TrimRight(urlPrefix, "/")+"/{folder}/{image}", postHandler.HandlePut).Methods(http.MethodPut)
+
+	remoteUploadHandler := assets.NewRemoteUploadHandler(postHandler)
+	router.HandleFunc(
+		strings.TrimRight(urlPrefix, "/")+"/"+assets.RemoteUploadPath,
+		remoteUploadHandler.HandlePost,
+	).Methods(http.MethodPost)
 
-	imageSaver := assets.NewImageSaver(fileSystemHandler)
-	postHandler := assets.NewImagePostHandler(imageSaver)
 	router.HandleFunc(strings.TrimRight(urlPrefix, "/"), postHandler.HandlePost).Methods(http.MethodPost)
 	router.HandleFunc(strings.TrimRight(urlPrefix, "/")+"/", postHandler.HandlePost).Methods(http.MethodPost)
 
@@ -71,13 +134,38 @@ func (sr ServerRunner) Run() (*http.Server, error) {
 	io.OutputInfo("", "Starting server at %s behind official host %s", host, host)
 
 	srv := &http.Server{Addr: host, Handler: serverHandler}
+	srv.RegisterOnShutdown(tusUploadHandler.Close)
+
+	// binding synchronously so the server accepts connections once Run returns
+	listener, err := net.Listen("tcp", host)
+	if err != nil {
+		return nil, err
+	}
 
 	go func() {
 		// returns ErrServerClosed on graceful close
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		if err := srv.Serve(listener); err != http.ErrServerClosed {
 			io.OutputError(err, "", "")
 		}
 	}()
 
 	return srv, nil
 }
+
+func (sr ServerRunner) createFileSystemManager() (filesystem.Manager, error) {
+	storageDriver := env.ReadEnv("STORAGE_DRIVER", "local")
+	switch storageDriver {
+	case "local":
+		assetsPath, err := env.ReadEnvOrError("ASSETS_PATH")
+		if err != nil {
+			return nil, err
+		}
+		return filesystem.LocalFileSystemManager{AssetsPath: assetsPath, MaxImagePixels: filesystem.ReadMaxImagePixels()}, nil
+	case "s3":
+		return filesystem.NewS3FileSystemManager()
+	case "memory":
+		return filesystem.NewMemoryFileSystemManager(), nil
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_DRIVER '%s', supported values are local, s3, memory", storageDriver)
+	}
+}
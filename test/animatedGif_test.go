@@ -0,0 +1,94 @@
+package test
+
+import (
+	"bytes"
+	"image/gif"
+	http2 "net/http"
+	"os"
+	"testing"
+
+	"github.com/breathbath/go_utils/utils/errs"
+	"github.com/breathbath/media-library/test/helper"
+	"github.com/stretchr/testify/assert"
+)
+
+const animatedServerURL = "http://localhost:9934/images"
+
+func TestAnimatedGif(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	err := helper.PrepareFileServer(
+		"animated",
+		"/tmp/animatedassets",
+		map[string]string{
+			"STORAGE_DRIVER":         "memory",
+			"HOST":                   ":9934",
+			"TOKEN_ISSUER":           "media-service-test",
+			"TOKEN_SECRET":           "12345678",
+			"URL_PREFIX":             "/images",
+			"MAX_UPLOADED_FILE_MB":   "0.1",
+			"HORIZ_MAX_IMAGE_HEIGHT": "50",
+		},
+	)
+	errs.FailOnError(err)
+	defer func() {
+		helper.ShutdownFileServers()
+		errs.FailOnError(helper.SetEnvs(map[string]string{"STORAGE_DRIVER": "local"}))
+		errs.FailOnError(os.Unsetenv("HORIZ_MAX_IMAGE_HEIGHT"))
+	}()
+
+	delays := []int{10, 20, 30}
+	disposals := []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalPrevious}
+	gifImage, err := helper.CreateAnimatedGif(200, 100, delays, disposals)
+	assert.NoError(t, err)
+
+	var filesResp filesResponse
+	statusCode, err := makeTestingPostTo(
+		animatedServerURL,
+		&filesResp,
+		helper.UploadedFile{FieldName: "files[]", FileName: "animated.gif", File: gifImage},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusOK, statusCode)
+	if !assert.Len(t, filesResp.FilesToReturn, 1) {
+		return
+	}
+	imagePath := filesResp.FilesToReturn[0]
+
+	testCases := []struct {
+		url            string
+		expectedWidth  int
+		expectedHeight int
+	}{
+		// downscaled on upload
+		{animatedServerURL + "/" + imagePath, 100, 50},
+		{animatedServerURL + "/x20/" + imagePath, 40, 20},
+		{animatedServerURL + "/w_30,h_30,c_pad,bg_ff0000/" + imagePath, 30, 30},
+	}
+
+	testClient := helper.NewTestClient()
+	for _, testCase := range testCases {
+		statusCode, body, err := testClient.MakeGet(testCase.url)
+		assert.NoError(t, err, testCase.url)
+		if !assert.Equal(t, http2.StatusOK, statusCode, testCase.url) {
+			continue
+		}
+
+		resultGif, err := gif.DecodeAll(bytes.NewBufferString(body))
+		if !assert.NoError(t, err, testCase.url) {
+			continue
+		}
+
+		assert.Len(t, resultGif.Image, len(delays), testCase.url)
+		assert.Equal(t, delays, resultGif.Delay, testCase.url)
+		assert.Equal(t, disposals, resultGif.Disposal, testCase.url)
+		assert.Equal(t, testCase.expectedWidth, resultGif.Config.Width, testCase.url)
+		assert.Equal(t, testCase.expectedHeight, resultGif.Config.Height, testCase.url)
+		for _, frame := range resultGif.Image {
+			assert.Equal(t, testCase.expectedWidth, frame.Bounds().Dx(), testCase.url)
+			assert.Equal(t, testCase.expectedHeight, frame.Bounds().Dy(), testCase.url)
+		}
+	}
+}
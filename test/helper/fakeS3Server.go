@@ -0,0 +1,193 @@
+package helper
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	http2 "net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeS3Server is an in-process stand-in for an S3-compatible storage supporting path-style
+// object CRUD and ListObjectsV2 requests
+type FakeS3Server struct {
+	*httptest.Server
+	Bucket  string
+	mu      sync.RWMutex
+	objects map[string]fakeS3Object
+}
+
+type fakeS3Object struct {
+	body        []byte
+	contentType string
+	modTime     time.Time
+}
+
+type fakeS3ListResult struct {
+	XMLName     xml.Name            `xml:"ListBucketResult"`
+	Contents    []fakeS3ListContent `xml:"Contents"`
+	KeyCount    int                 `xml:"KeyCount"`
+	IsTruncated bool                `xml:"IsTruncated"`
+}
+
+type fakeS3ListContent struct {
+	Key          string    `xml:"Key"`
+	Size         int       `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+func NewFakeS3Server(bucket string) *FakeS3Server {
+	fakeS3 := &FakeS3Server{
+		Bucket:  bucket,
+		objects: map[string]fakeS3Object{},
+	}
+	fakeS3.Server = httptest.NewServer(fakeS3)
+
+	return fakeS3
+}
+
+// ObjectExists tells if an object with the exact key is stored
+func (fs *FakeS3Server) ObjectExists(key string) bool {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	_, ok := fs.objects[key]
+	return ok
+}
+
+// Keys gives sorted keys of all stored objects
+func (fs *FakeS3Server) Keys() []string {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	keys := make([]string, 0, len(fs.objects))
+	for key := range fs.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func (fs *FakeS3Server) ServeHTTP(rw http2.ResponseWriter, r *http2.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=") {
+		rw.WriteHeader(http2.StatusForbidden)
+		return
+	}
+
+	pathItems := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if pathItems[0] != fs.Bucket {
+		rw.WriteHeader(http2.StatusNotFound)
+		return
+	}
+
+	key := ""
+	if len(pathItems) > 1 {
+		key = pathItems[1]
+	}
+
+	switch {
+	case key == "" && r.Method == http2.MethodGet:
+		fs.list(rw, r)
+	case r.Method == http2.MethodPut:
+		fs.put(rw, r, key)
+	case r.Method == http2.MethodGet || r.Method == http2.MethodHead:
+		fs.get(rw, r, key)
+	case r.Method == http2.MethodDelete:
+		fs.mu.Lock()
+		delete(fs.objects, key)
+		fs.mu.Unlock()
+		rw.WriteHeader(http2.StatusNoContent)
+	default:
+		rw.WriteHeader(http2.StatusMethodNotAllowed)
+	}
+}
+
+func (fs *FakeS3Server) put(rw http2.ResponseWriter, r *http2.Request, key string) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		rw.WriteHeader(http2.StatusBadRequest)
+		return
+	}
+
+	bodyHash := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(bodyHash[:]) {
+		rw.WriteHeader(http2.StatusBadRequest)
+		return
+	}
+
+	fs.mu.Lock()
+	if _, ok := fs.objects[key]; ok && r.Header.Get("If-None-Match") == "*" {
+		fs.mu.Unlock()
+		rw.WriteHeader(http2.StatusPreconditionFailed)
+		return
+	}
+	fs.objects[key] = fakeS3Object{
+		body:        body,
+		contentType: r.Header.Get("Content-Type"),
+		modTime:     time.Now().UTC(),
+	}
+	fs.mu.Unlock()
+
+	rw.WriteHeader(http2.StatusOK)
+}
+
+func (fs *FakeS3Server) get(rw http2.ResponseWriter, r *http2.Request, key string) {
+	fs.mu.RLock()
+	obj, ok := fs.objects[key]
+	fs.mu.RUnlock()
+
+	if !ok {
+		rw.WriteHeader(http2.StatusNotFound)
+		return
+	}
+
+	rw.Header().Set("Content-Length", strconv.Itoa(len(obj.body)))
+	rw.Header().Set("Content-Type", obj.contentType)
+	rw.Header().Set("Last-Modified", obj.modTime.Format(http2.TimeFormat))
+	rw.WriteHeader(http2.StatusOK)
+
+	if r.Method == http2.MethodGet {
+		_, _ = rw.Write(obj.body)
+	}
+}
+
+func (fs *FakeS3Server) list(rw http2.ResponseWriter, r *http2.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	maxKeys, err := strconv.Atoi(r.URL.Query().Get("max-keys"))
+	if err != nil || maxKeys <= 0 {
+		maxKeys = 1000
+	}
+
+	result := fakeS3ListResult{}
+	for _, key := range fs.Keys() {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		if len(result.Contents) == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+
+		fs.mu.RLock()
+		obj := fs.objects[key]
+		fs.mu.RUnlock()
+
+		result.Contents = append(result.Contents, fakeS3ListContent{
+			Key:          key,
+			Size:         len(obj.body),
+			LastModified: obj.modTime,
+		})
+	}
+	result.KeyCount = len(result.Contents)
+
+	rw.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(rw).Encode(result)
+}
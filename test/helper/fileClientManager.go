@@ -15,6 +15,7 @@ import (
 type TestClient struct {
 	body        *bytes.Buffer
 	contentType string
+	headers     http2.Header
 }
 
 type UploadedFile struct {
@@ -24,11 +25,28 @@ type UploadedFile struct {
 }
 
 func NewTestClient() *TestClient {
-	return &TestClient{body: &bytes.Buffer{}}
+	return &TestClient{body: &bytes.Buffer{}, headers: http2.Header{}}
+}
+
+// SetHeader adds a header to all requests of the client
+func (tc *TestClient) SetHeader(key, value string) {
+	tc.headers.Set(key, value)
 }
 
 func (tc *TestClient) AddFiles(files ...UploadedFile) error {
+	return tc.AddFieldsAndFiles(nil, files...)
+}
+
+// AddFieldsAndFiles writes form fields before the files
+func (tc *TestClient) AddFieldsAndFiles(fields map[string]string, files ...UploadedFile) error {
 	writer := multipart.NewWriter(tc.body)
+	for fieldName, value := range fields {
+		err := writer.WriteField(fieldName, value)
+		if err != nil {
+			return err
+		}
+	}
+
 	for _, uploadedFile := range files {
 		part, err := writer.CreateFormFile(uploadedFile.FieldName, uploadedFile.FileName)
 		if err != nil {
@@ -60,8 +78,19 @@ func (tc *TestClient) GenerateValidToken() (string, error) {
 	return jwtManager.GenerateToken("test")
 }
 
+// GenerateScopedToken gives a token with limited permissions
+func (tc *TestClient) GenerateScopedToken(tokenScope authentication.TokenScope) (string, error) {
+	jwtManager, err := authentication.NewJwtManager()
+	if err != nil {
+		return "", err
+	}
+
+	return jwtManager.GenerateScopedToken("test", tokenScope, 0)
+}
+
 func (tc *TestClient) MakePost(token, url string) (statusCode int, body string, err error) {
 	r, _ := http2.NewRequestWithContext(context.Background(), "POST", url, tc.body)
+	r.Header = tc.headers.Clone()
 	if tc.contentType != "" {
 		r.Header.Add("Content-Type", tc.contentType)
 	}
@@ -83,6 +112,28 @@ func (tc *TestClient) MakePost(token, url string) (statusCode int, body string,
 	return resp.StatusCode, string(respBody), nil
 }
 
+// MakeRequest sends the body with headers of the client and gives the response with the read body
+func (tc *TestClient) MakeRequest(method, token, url string, body []byte) (resp *http2.Response, respBody string, err error) {
+	r, _ := http2.NewRequestWithContext(context.Background(), method, url, bytes.NewReader(body))
+	r.Header = tc.headers.Clone()
+
+	if token != "" {
+		r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+
+	client := &http2.Client{}
+	resp, err = client.Do(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer resp.Body.Close()
+
+	rawRespBody, err := ioutil.ReadAll(resp.Body)
+
+	return resp, string(rawRespBody), err
+}
+
 func (tc *TestClient) MakeDelete(token, url string) (statusCode int, err error) {
 	r, _ := http2.NewRequestWithContext(context.Background(), "DELETE", url, &bytes.Buffer{})
 
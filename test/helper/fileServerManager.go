@@ -6,7 +6,9 @@ import (
 	"os"
 
 	"github.com/breathbath/go_utils/utils/errs"
+	"github.com/breathbath/media-library/filesystem"
 	"github.com/breathbath/media-library/http"
+	"github.com/spf13/afero"
 )
 
 var srvs map[string]*http2.Server
@@ -44,6 +46,25 @@ func PrepareFileServer(name, assetsPath string, envs map[string]string) error {
 	return nil
 }
 
+// PrepareMemoryFileServer starts a server with the memory storage, the returned fs gives access to its files
+// by paths relative to the storage root
+func PrepareMemoryFileServer(name string, envs map[string]string) (afero.Fs, error) {
+	err := SetEnvs(envs)
+	if err != nil {
+		return nil, err
+	}
+
+	memoryFs := afero.NewMemMapFs()
+	serverRunner := http.NewServerRunner()
+	serverRunner.FileSystemManager = filesystem.NewMemoryFileSystemManagerWithFs(memoryFs)
+	srvs[name], err = serverRunner.Run()
+	if err != nil {
+		return nil, err
+	}
+
+	return afero.NewBasePathFs(memoryFs, "/"), nil
+}
+
 func ShutdownFileServers() {
 	errc := errs.NewErrorContainer()
 	for _, srv := range srvs {
@@ -61,4 +82,7 @@ func ShutdownFileServers() {
 		}
 	}
 	errs.FailOnError(errc.Result(" "))
+
+	srvs = make(map[string]*http2.Server)
+	assetsPaths = []string{}
 }
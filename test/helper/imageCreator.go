@@ -2,13 +2,21 @@ package helper
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"image"
 	"image/color"
 	"image/draw"
+	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
+	"io/ioutil"
+
+	"github.com/chai2010/webp"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
 )
 
 const JPG = "jpg"
@@ -69,9 +77,125 @@ func CreateImage(imgSpec ImageSpec) (io.Reader, error) {
 		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: imgSpec.Quality})
 	case "png":
 		err = png.Encode(buf, img)
+	case "bmp":
+		err = bmp.Encode(buf, img)
+	case "tiff":
+		err = tiff.Encode(buf, img, nil)
+	case "webp":
+		err = webp.Encode(buf, img, &webp.Options{Quality: float32(imgSpec.Quality)})
 	default:
 		return buf, fmt.Errorf("unknown format '%s'", imgSpec.Format)
 	}
 
 	return buf, err
 }
+
+// CreateAnimatedGif generates a gif with frames of different colors, each frame covers a part of the canvas
+func CreateAnimatedGif(width, height int, delays []int, disposals []byte) (io.Reader, error) {
+	palette := color.Palette{color.Black, color.White, color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}}
+	gifImg := &gif.GIF{
+		Delay:    delays,
+		Disposal: disposals,
+		Config:   image.Config{ColorModel: palette, Width: width, Height: height},
+	}
+
+	for i := range delays {
+		frame := image.NewPaletted(image.Rect(0, 0, width/(i+1), height/(i+1)), palette)
+		draw.Draw(frame, frame.Bounds(), &image.Uniform{palette[i%len(palette)]}, image.Point{}, draw.Src)
+		gifImg.Image = append(gifImg.Image, frame)
+	}
+
+	buf := &bytes.Buffer{}
+	err := gif.EncodeAll(buf, gifImg)
+
+	return buf, err
+}
+
+// CreateJpegWithExif generates a jpeg with exif data containing the orientation, camera make, f-number and gps latitude
+func CreateJpegWithExif(width, height int, orientation uint16) (io.Reader, error) {
+	img, err := CreateImage(ImageSpec{Format: JPG, Width: width, Height: height})
+	if err != nil {
+		return nil, err
+	}
+
+	encodedImg, err := ioutil.ReadAll(img)
+	if err != nil {
+		return nil, err
+	}
+
+	le := binary.LittleEndian
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+
+	// IFD0 at offset 8 with make, orientation, exif and gps pointers, followed by the make value at 62
+	ifd0 := make([]byte, 54)
+	le.PutUint16(ifd0[0:], 4)
+	putExifEntry(ifd0[2:], 0x010F, 2, 8, 62)
+	putExifEntry(ifd0[14:], 0x0112, 3, 1, uint32(orientation))
+	putExifEntry(ifd0[26:], 0x8769, 4, 1, 70)
+	putExifEntry(ifd0[38:], 0x8825, 4, 1, 96)
+	tiff = append(tiff, ifd0...)
+	tiff = append(tiff, []byte("TestCam\x00")...)
+
+	// exif IFD at offset 70 with the f-number, followed by its value at 88
+	exifIfd := make([]byte, 18)
+	le.PutUint16(exifIfd[0:], 1)
+	putExifEntry(exifIfd[2:], 0x829D, 5, 1, 88)
+	tiff = append(tiff, exifIfd...)
+	fNumber := make([]byte, 8)
+	le.PutUint32(fNumber[0:], 28)
+	le.PutUint32(fNumber[4:], 10)
+	tiff = append(tiff, fNumber...)
+
+	// GPS IFD at offset 96 with latitude ref and latitude, followed by the latitude value at 126
+	gpsIfd := make([]byte, 30)
+	le.PutUint16(gpsIfd[0:], 2)
+	putExifEntry(gpsIfd[2:], 0x0001, 2, 2, uint32('N'))
+	putExifEntry(gpsIfd[14:], 0x0002, 5, 3, 126)
+	tiff = append(tiff, gpsIfd...)
+	latitude := make([]byte, 24)
+	for i, val := range []uint32{52, 1, 31, 1, 12, 1} {
+		le.PutUint32(latitude[i*4:], val)
+	}
+	tiff = append(tiff, latitude...)
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segmentHeader := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segmentHeader[2:], uint16(len(payload)+2))
+
+	buf := &bytes.Buffer{}
+	buf.Write(encodedImg[:2])
+	buf.Write(segmentHeader)
+	buf.Write(payload)
+	buf.Write(encodedImg[2:])
+
+	return buf, nil
+}
+
+// CreatePngWithDeclaredSize generates a small png which header declares the given sizes, like in decompression bombs
+func CreatePngWithDeclaredSize(width, height uint32) (io.Reader, error) {
+	img, err := CreateImage(ImageSpec{Format: "png", Width: 10, Height: 10})
+	if err != nil {
+		return nil, err
+	}
+
+	encodedImg, err := ioutil.ReadAll(img)
+	if err != nil {
+		return nil, err
+	}
+
+	// the IHDR chunk follows the 8 bytes signature: length, type, width, height, other fields and the crc of type and data
+	const ihdrTypeOffset, ihdrDataLength = 12, 13
+	binary.BigEndian.PutUint32(encodedImg[ihdrTypeOffset+4:], width)
+	binary.BigEndian.PutUint32(encodedImg[ihdrTypeOffset+8:], height)
+	crcOffset := ihdrTypeOffset + 4 + ihdrDataLength
+	binary.BigEndian.PutUint32(encodedImg[crcOffset:], crc32.ChecksumIEEE(encodedImg[ihdrTypeOffset:crcOffset]))
+
+	return bytes.NewReader(encodedImg), nil
+}
+
+func putExifEntry(entry []byte, tag, fieldType uint16, count, value uint32) {
+	binary.LittleEndian.PutUint16(entry[0:], tag)
+	binary.LittleEndian.PutUint16(entry[2:], fieldType)
+	binary.LittleEndian.PutUint32(entry[4:], count)
+	binary.LittleEndian.PutUint32(entry[8:], value)
+}
@@ -0,0 +1,109 @@
+package test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	http2 "net/http"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/breathbath/go_utils/utils/errs"
+	"github.com/breathbath/media-library/assets"
+	"github.com/breathbath/media-library/test/helper"
+	"github.com/stretchr/testify/assert"
+)
+
+const metaServerURL = "http://localhost:9938/images"
+
+func TestImageMeta(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	err := helper.PrepareFileServer(
+		"meta",
+		"/tmp/metaassets",
+		map[string]string{
+			"STORAGE_DRIVER":         "memory",
+			"HOST":                   ":9938",
+			"TOKEN_ISSUER":           "media-service-test",
+			"TOKEN_SECRET":           "12345678",
+			"URL_PREFIX":             "/images",
+			"MAX_UPLOADED_FILE_MB":   "0.1",
+			"UPLOAD_METADATA_POLICY": "keep",
+		},
+	)
+	errs.FailOnError(err)
+	defer func() {
+		helper.ShutdownFileServers()
+		errs.FailOnError(helper.SetEnvs(map[string]string{"STORAGE_DRIVER": "local"}))
+		errs.FailOnError(os.Unsetenv("UPLOAD_METADATA_POLICY"))
+	}()
+
+	jpegImage, err := helper.CreateJpegWithExif(200, 100, 6)
+	assert.NoError(t, err)
+
+	var filesResp filesResponse
+	statusCode, err := makeTestingPostTo(
+		metaServerURL,
+		&filesResp,
+		helper.UploadedFile{FieldName: "files[]", FileName: "meta.jpg", File: jpegImage},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusOK, statusCode)
+	if !assert.Len(t, filesResp.FilesToReturn, 1) {
+		return
+	}
+	imagePath := filesResp.FilesToReturn[0]
+
+	testClient := helper.NewTestClient()
+	statusCode, body, err := testClient.MakeGet(metaServerURL + "/" + imagePath)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusOK, statusCode)
+	expectedHash := sha256.Sum256([]byte(body))
+
+	for _, resizeURL := range []string{"/x50/" + imagePath, "/x50/" + imagePath + ".webp", "/w_20,f_png/" + imagePath} {
+		statusCode, _, err = testClient.MakeGet(metaServerURL + resizeURL)
+		assert.NoError(t, err)
+		assert.Equal(t, http2.StatusOK, statusCode)
+	}
+
+	statusCode, metaBody, err := testClient.MakeGet(metaServerURL + "/" + imagePath + "/meta")
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusOK, statusCode)
+
+	var imageMeta assets.ImageMeta
+	err = json.Unmarshal([]byte(metaBody), &imageMeta)
+	assert.NoError(t, err)
+
+	assert.Equal(t, imagePath, imageMeta.Path)
+	assert.Equal(t, 100, imageMeta.Width)
+	assert.Equal(t, 200, imageMeta.Height)
+	assert.Equal(t, int64(len(body)), imageMeta.Size)
+	assert.Equal(t, "image/jpeg", imageMeta.Mime)
+	assert.Equal(t, hex.EncodeToString(expectedHash[:]), imageMeta.Sha256)
+	assert.WithinDuration(t, time.Now(), imageMeta.Created, time.Minute)
+	assert.Equal(t, map[string]string{"make": "TestCam", "f_number": "28/10", "orientation": "1"}, imageMeta.Exif)
+
+	variantPaths := []string{}
+	for _, variant := range imageMeta.Variants {
+		variantPaths = append(variantPaths, variant.Path)
+
+		statusCode, _, err = testClient.MakeGet(metaServerURL + "/" + variant.Path)
+		assert.NoError(t, err)
+		assert.Equal(t, http2.StatusOK, statusCode, variant.Path)
+	}
+	sort.Strings(variantPaths)
+	assert.Equal(
+		t,
+		[]string{"h_50,c_fill/" + imagePath, "h_50,c_fill/" + imagePath + ".webp", "w_20,c_fill,f_png/" + imagePath},
+		variantPaths,
+	)
+
+	statusCode, _, err = testClient.MakeGet(metaServerURL + "/abc/missing.jpg/meta")
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusNotFound, statusCode)
+}
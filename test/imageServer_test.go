@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"image"
+	_ "image/png"
 	"io"
 	"io/ioutil"
 	http2 "net/http"
@@ -14,8 +15,8 @@ import (
 	"testing"
 
 	"github.com/breathbath/go_utils/utils/errs"
-	"github.com/breathbath/go_utils/utils/fs"
 	"github.com/breathbath/media-library/test/helper"
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -42,6 +43,9 @@ func TestHandlers(t *testing.T) {
 	t.Run("testReadNonExistingImage", testReadNonExistingImage)
 	t.Run("testGettingResizedImage", testGettingResizedImage)
 	t.Run("testGettingCachedResizedImage", testGettingCachedResizedImage)
+	t.Run("testTransformations", testTransformations)
+	t.Run("testPresets", testPresets)
+	t.Run("testResizingImagesOfSameName", testResizingImagesOfSameName)
 
 	t.Run("testProxyMatch", testProxyMatch)
 }
@@ -72,10 +76,10 @@ func testImageSaved(t *testing.T) {
 	assert.Len(t, filesResp.FilesToReturn, 2)
 
 	assert.Regexp(t, `[\w]+/some_Image.jpg`, filesResp.FilesToReturn[0])
-	assert.FileExists(t, filepath.Join(helper.AssetsPath, filesResp.FilesToReturn[0]))
+	assert.True(t, fileExists(assetsFs, filesResp.FilesToReturn[0]))
 
 	assert.Regexp(t, `[\w]+/someImage.png`, filesResp.FilesToReturn[1])
-	assert.FileExists(t, filepath.Join(helper.AssetsPath, filesResp.FilesToReturn[1]))
+	assert.True(t, fileExists(assetsFs, filesResp.FilesToReturn[1]))
 
 	pngImage2, err := helper.CreateImage(helper.ImageSpec{Format: "png"})
 	assert.NoError(t, err)
@@ -92,7 +96,7 @@ func testImageSaved(t *testing.T) {
 	assert.Equal(t, http2.StatusOK, statusCode2)
 	assert.NoError(t, err)
 	assert.Len(t, filesResp2.FilesToReturn, 1)
-	assert.FileExists(t, filepath.Join(helper.AssetsPath, filesResp2.FilesToReturn[0]))
+	assert.True(t, fileExists(assetsFs, filesResp2.FilesToReturn[0]))
 
 	// asserting that each upload saves files with same names to different locations
 	assert.NotEqual(t, filesResp.FilesToReturn[1], filesResp2.FilesToReturn[0])
@@ -122,12 +126,7 @@ func testTooLargeFile(t *testing.T) {
 	assert.Len(t, filesError.Files, 1)
 
 	if len(filesError.Files) > 0 {
-		expectedOutput := fmt.Sprintf(
-			"The file is too large (%d bytes). Allowed maximum size is %v Mb",
-			len(bodyBytes),
-			0.1,
-		)
-		assert.Equal(t, expectedOutput, filesError.Files[0])
+		assert.Equal(t, "The file is larger than 0.1 Mb, which is the allowed maximum size", filesError.Files[0])
 	}
 }
 
@@ -151,7 +150,7 @@ func testWrongMime(t *testing.T) {
 	assert.Len(t, filesError.Files, 1)
 
 	if len(filesError.Files) > 0 {
-		assert.Equal(t, "Not supported image type 'text/plain', supported types are jpg|jpeg|png|gif", filesError.Files[0])
+		assert.Equal(t, "Not supported image type 'text/plain', supported types are jpg|jpeg|png|gif|webp|bmp|tiff|tif", filesError.Files[0])
 	}
 }
 
@@ -181,10 +180,10 @@ func testNoExtension(t *testing.T) {
 	assert.Len(t, filesResp.FilesToReturn, 2)
 
 	assert.Regexp(t, `[\w]+/someJpgImg.jpg`, filesResp.FilesToReturn[0])
-	assert.FileExists(t, filepath.Join(helper.AssetsPath, filesResp.FilesToReturn[0]))
+	assert.True(t, fileExists(assetsFs, filesResp.FilesToReturn[0]))
 
 	assert.Regexp(t, `[\w]+/somePngImg.png`, filesResp.FilesToReturn[1])
-	assert.FileExists(t, filepath.Join(helper.AssetsPath, filesResp.FilesToReturn[1]))
+	assert.True(t, fileExists(assetsFs, filesResp.FilesToReturn[1]))
 }
 
 func testTooBigDimension(t *testing.T) {
@@ -209,10 +208,11 @@ func testTooBigDimension(t *testing.T) {
 		return
 	}
 
-	filePath := filepath.Join(helper.AssetsPath, filesResp.FilesToReturn[0])
-
-	file, err := os.Open(filePath)
-	assert.NoError(t, err)
+	file, err := assetsFs.Open(filesResp.FilesToReturn[0])
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer file.Close()
 
 	imgConfig, _, err := image.DecodeConfig(file)
 	assert.NoError(t, err)
@@ -224,23 +224,23 @@ func testInvalidTokenForPosting(t *testing.T) {
 	testClient := helper.NewTestClient()
 	statusCode, _, err := testClient.MakePost("", "http://localhost:9925/images")
 	assert.NoError(t, err)
-	assert.Equal(t, http2.StatusForbidden, statusCode)
+	assert.Equal(t, http2.StatusUnauthorized, statusCode)
 }
 
 func testInvalidTokenForDeleting(t *testing.T) {
 	testClient := helper.NewTestClient()
 	statusCode, err := testClient.MakeDelete("", "http://localhost:9925/images/lala/mama")
 	assert.NoError(t, err)
-	assert.Equal(t, http2.StatusForbidden, statusCode)
+	assert.Equal(t, http2.StatusUnauthorized, statusCode)
 }
 
 func testDelete(t *testing.T) {
-	err := saveImage(helper.AssetsPath, "lsls", "someImg.png", "png", 10, 10)
+	err := saveImage(assetsFs, "lsls", "someImg.png", "png", 10, 10)
 	assert.NoError(t, err)
 
 	err = saveImage(
-		helper.AssetsPath,
-		filepath.Join("cache", "resized_image", "lsls", "someImg"),
+		assetsFs,
+		filepath.Join("cache", "resized_image", "lsls", "someImg.png"),
 		"5x5.png",
 		"png",
 		5,
@@ -258,16 +258,16 @@ func testDelete(t *testing.T) {
 
 	assert.NoError(t, err)
 	assert.Equal(t, http2.StatusOK, statusCode)
-	assert.False(t, fs.FileExists(filepath.Join(helper.AssetsPath, "lsls")))
-	assert.False(t, fs.FileExists(filepath.Join(helper.AssetsPath, "lsls", "someImg.png")))
-	assert.False(t, fs.FileExists(filepath.Join(helper.AssetsPath, "cache", "resized_image", "lsls", "someImg", "5x5.png")))
-	assert.False(t, fs.FileExists(filepath.Join(helper.AssetsPath, "cache", "resized_image", "lsls", "someImg")))
-	assert.False(t, fs.FileExists(filepath.Join(helper.AssetsPath, "cache", "resized_image", "lsls")))
+	assert.False(t, fileExists(assetsFs, filepath.Join("lsls")))
+	assert.False(t, fileExists(assetsFs, filepath.Join("lsls", "someImg.png")))
+	assert.False(t, fileExists(assetsFs, filepath.Join("cache", "resized_image", "lsls", "someImg.png", "5x5.png")))
+	assert.False(t, fileExists(assetsFs, filepath.Join("cache", "resized_image", "lsls", "someImg.png")))
+	assert.False(t, fileExists(assetsFs, filepath.Join("cache", "resized_image", "lsls")))
 }
 
 func testRead(t *testing.T) {
 	err := saveImage(
-		helper.AssetsPath,
+		assetsFs,
 		"imagesToRead",
 		"someImg.png",
 		"png",
@@ -282,14 +282,17 @@ func testRead(t *testing.T) {
 	assert.Equal(t, http2.StatusOK, statusCode)
 	assertSameImage(
 		t,
-		filepath.Join(helper.AssetsPath, "imagesToRead", "someImg.png"),
+		assetsFs,
+		filepath.Join("imagesToRead", "someImg.png"),
 		body,
 	)
 }
 
-func assertSameImage(t *testing.T, sourceImgPath, body string) {
-	sourceFile, err := os.Open(sourceImgPath)
-	assert.NoError(t, err)
+func assertSameImage(t *testing.T, storage afero.Fs, sourceImgPath, body string) {
+	sourceFile, err := storage.Open(sourceImgPath)
+	if !assert.NoError(t, err) {
+		return
+	}
 	defer sourceFile.Close()
 
 	savedFileHash := md5.New()
@@ -308,7 +311,7 @@ func assertSameImage(t *testing.T, sourceImgPath, body string) {
 
 func testGettingCachedResizedImage(t *testing.T) {
 	err := saveImage(
-		helper.AssetsPath,
+		assetsFs,
 		"imagesToResizeAndCache",
 		"someImg.png",
 		"png",
@@ -321,10 +324,10 @@ func testGettingCachedResizedImage(t *testing.T) {
 		"cache",
 		"resized_image",
 		"imagesToResizeAndCache",
-		"someImg",
+		"someImg.png",
 	)
 
-	err = saveImage(helper.AssetsPath, filePath, "100x100.png", "png", 500, 250)
+	err = saveImage(assetsFs, filePath, "w_100,h_100,c_fill.png", "png", 500, 250)
 	assert.NoError(t, err)
 
 	testClient := helper.NewTestClient()
@@ -346,7 +349,7 @@ func testGettingCachedResizedImage(t *testing.T) {
 
 func testGettingResizedImage(t *testing.T) {
 	err := saveImage(
-		helper.AssetsPath,
+		assetsFs,
 		"imagesToResize",
 		"someImg.png",
 		"png",
@@ -363,19 +366,25 @@ func testGettingResizedImage(t *testing.T) {
 	}{
 		{
 			"100x",
-			"100x.png",
+			"w_100,c_fill.png",
 			100,
 			0,
 		},
 		{
 			"x200",
-			"x200.png",
+			"h_200,c_fill.png",
 			0,
 			200,
 		},
 		{
 			"300x150",
-			"300x150.png",
+			"w_300,h_150,c_fill.png",
+			300,
+			150,
+		},
+		{
+			"0300x150",
+			"w_300,h_150,c_fill.png",
 			300,
 			150,
 		},
@@ -391,14 +400,13 @@ func testGettingResizedImage(t *testing.T) {
 		assert.Equal(t, http2.StatusOK, statusCode)
 
 		filePath := filepath.Join(
-			helper.AssetsPath,
 			"cache",
 			"resized_image",
 			"imagesToResize",
-			"someImg",
+			"someImg.png",
 			testCase.resizedFileName,
 		)
-		assert.FileExists(t, filePath)
+		assert.True(t, fileExists(assetsFs, filePath))
 
 		bodyBuffer := bytes.NewBuffer([]byte(body))
 		imgConfig, _, err := image.DecodeConfig(bodyBuffer)
@@ -413,9 +421,108 @@ func testGettingResizedImage(t *testing.T) {
 	}
 }
 
+func testTransformations(t *testing.T) {
+	err := saveImage(
+		assetsFs,
+		"imagesToTransform",
+		"someImg.png",
+		"png",
+		500,
+		250,
+	)
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		transformation  string
+		resizedFileName string
+		expectedWidth   int
+		expectedHeight  int
+	}{
+		{"w_100,h_100,c_fit", "w_100,h_100,c_fit.png", 100, 50},
+		{"h_100,w_100,c_pad,bg_FF0000", "w_100,h_100,c_pad,bg_ff0000.png", 100, 100},
+		{"w_50,h_40,c_crop,g_northwest", "w_50,h_40,c_crop,g_northwest.png", 50, 40},
+		{"h_50,w_60,c_fill,g_center,q_70", "w_60,h_50,c_fill,q_70.png", 60, 50},
+		{"w_250", "w_250,c_fill.png", 250, 125},
+	}
+
+	testClient := helper.NewTestClient()
+
+	for _, testCase := range testCases {
+		statusCode, body, err := testClient.MakeGet(
+			fmt.Sprintf("http://localhost:9925/images/%s/imagesToTransform/someImg.png", testCase.transformation),
+		)
+		assert.NoError(t, err)
+		assert.Equal(t, http2.StatusOK, statusCode, testCase.transformation)
+
+		assert.True(t, fileExists(assetsFs, filepath.Join(
+			"cache",
+			"resized_image",
+			"imagesToTransform",
+			"someImg.png",
+			testCase.resizedFileName,
+		)))
+
+		img, _, err := image.Decode(bytes.NewBuffer([]byte(body)))
+		if !assert.NoError(t, err, testCase.transformation) {
+			continue
+		}
+		assert.Equal(t, testCase.expectedWidth, img.Bounds().Dx(), testCase.transformation)
+		assert.Equal(t, testCase.expectedHeight, img.Bounds().Dy(), testCase.transformation)
+
+		if testCase.resizedFileName == "w_100,h_100,c_pad,bg_ff0000.png" {
+			// the image is letterboxed, so the top padding is filled with the background color
+			r, g, b, _ := img.At(50, 5).RGBA()
+			assert.Equal(t, []uint32{0xffff, 0, 0}, []uint32{r, g, b})
+		}
+	}
+
+	for _, invalidTransformation := range []string{"w_100,c_stretch", "w_abc", "w_100,w_200", "c_fit", "w_100,bg_red", "w_0"} {
+		statusCode, _, err := testClient.MakeGet(
+			fmt.Sprintf("http://localhost:9925/images/%s/imagesToTransform/someImg.png", invalidTransformation),
+		)
+		assert.NoError(t, err)
+		assert.Equal(t, http2.StatusNotFound, statusCode, invalidTransformation)
+	}
+}
+
+func testPresets(t *testing.T) {
+	err := saveImage(
+		assetsFs,
+		"imagesWithPresets",
+		"someImg.png",
+		"png",
+		500,
+		250,
+	)
+	assert.NoError(t, err)
+
+	testClient := helper.NewTestClient()
+	statusCode, body, err := testClient.MakeGet("http://localhost:9925/images/thumb/imagesWithPresets/someImg.png")
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusOK, statusCode)
+
+	imgConfig, _, err := image.DecodeConfig(bytes.NewBuffer([]byte(body)))
+	assert.NoError(t, err)
+	assert.Equal(t, 40, imgConfig.Width)
+	assert.Equal(t, 20, imgConfig.Height)
+
+	// preset variants are cached under the resolved params, so changing the preset doesn't reuse stale images
+	assert.True(t, fileExists(assetsFs, filepath.Join(
+		"cache",
+		"resized_image",
+		"imagesWithPresets",
+		"someImg.png",
+		"w_40,h_30,c_fit.png",
+	)))
+
+	statusCode, _, err = testClient.MakeGet("http://localhost:9925/images/unknownPreset/imagesWithPresets/someImg.png")
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusNotFound, statusCode)
+}
+
 func testProxyMatch(t *testing.T) {
 	err := saveImage(
-		helper.ProxyAssetsPath,
+		proxyAssetsFs,
 		"imageToProxy",
 		"someImg.jpg",
 		"jpg",
@@ -425,9 +532,9 @@ func testProxyMatch(t *testing.T) {
 	assert.NoError(t, err)
 
 	err = saveImage(
-		helper.ProxyAssetsPath,
-		filepath.Join("cache", "resized_image", "imageToProxy", "someImg"),
-		"10x10.jpg",
+		proxyAssetsFs,
+		filepath.Join("cache", "resized_image", "imageToProxy", "someImg.jpg"),
+		"w_10,h_10,c_fill.jpg",
 		"jpg",
 		10,
 		10,
@@ -441,7 +548,8 @@ func testProxyMatch(t *testing.T) {
 
 	assertSameImage(
 		t,
-		filepath.Join(helper.ProxyAssetsPath, "imageToProxy", "someImg.jpg"),
+		proxyAssetsFs,
+		filepath.Join("imageToProxy", "someImg.jpg"),
 		body,
 	)
 
@@ -453,7 +561,8 @@ func testProxyMatch(t *testing.T) {
 
 	assertSameImage(
 		t,
-		filepath.Join(helper.ProxyAssetsPath, "cache", "resized_image", "imageToProxy", "someImg", "10x10.jpg"),
+		proxyAssetsFs,
+		filepath.Join("cache", "resized_image", "imageToProxy", "someImg.jpg", "w_10,h_10,c_fill.jpg"),
 		bodyResized,
 	)
 }
@@ -466,31 +575,62 @@ func testReadNonExistingImage(t *testing.T) {
 	assert.Equal(t, "404 page not found\n", body)
 }
 
-func saveImage(rootPath, folderPath, imageName, format string, width, height int) error {
-	img, err := helper.CreateImage(helper.ImageSpec{Format: format, Width: width, Height: height})
-	if err != nil {
-		return err
-	}
+// testResizingImagesOfSameName checks that images differing only by extension don't share resized images,
+// even if they are converted to the same format
+func testResizingImagesOfSameName(t *testing.T) {
+	assert.NoError(t, saveImage(assetsFs, "imagesOfSameName", "img.png", "png", 200, 100))
+	assert.NoError(t, saveImage(assetsFs, "imagesOfSameName", "img.jpg", "jpg", 100, 200))
 
-	err = os.MkdirAll(filepath.Join(rootPath, folderPath), os.ModePerm)
-	if err != nil {
-		return err
+	testCases := []struct {
+		url            string
+		expectedFormat string
+		expectedHeight int
+	}{
+		{"w_50/imagesOfSameName/img.png.webp", "webp", 25},
+		{"w_50/imagesOfSameName/img.jpg.webp", "webp", 100},
+		{"w_50,f_jpg/imagesOfSameName/img.png", "jpeg", 25},
+		{"w_50/imagesOfSameName/img.jpg", "jpeg", 100},
+		{"w_50/imagesOfSameName/img.png", "png", 25},
 	}
 
-	f, err := os.Create(filepath.Join(rootPath, folderPath, imageName))
-	if err != nil {
-		return err
+	testClient := helper.NewTestClient()
+	// the second round reads the cached images
+	for i := 0; i < 2; i++ {
+		for _, testCase := range testCases {
+			statusCode, body, err := testClient.MakeGet("http://localhost:9925/images/" + testCase.url)
+			assert.NoError(t, err)
+			assert.Equal(t, http2.StatusOK, statusCode, testCase.url)
+
+			imgConfig, format, err := image.DecodeConfig(bytes.NewBufferString(body))
+			if !assert.NoError(t, err, testCase.url) {
+				continue
+			}
+			assert.Equal(t, testCase.expectedFormat, format, testCase.url)
+			assert.Equal(t, 50, imgConfig.Width, testCase.url)
+			assert.Equal(t, testCase.expectedHeight, imgConfig.Height, testCase.url)
+		}
 	}
+}
 
-	_, err = io.Copy(f, img)
+func saveImage(storage afero.Fs, folderPath, imageName, format string, width, height int) error {
+	img, err := helper.CreateImage(helper.ImageSpec{Format: format, Width: width, Height: height})
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return afero.WriteReader(storage, filepath.Join(folderPath, imageName), img)
+}
+
+func fileExists(storage afero.Fs, filePath string) bool {
+	isExisting, err := afero.Exists(storage, filePath)
+	return err == nil && isExisting
 }
 
 func makeTestingPost(target interface{}, files ...helper.UploadedFile) (statusCode int, err error) {
+	return makeTestingPostTo("http://localhost:9925/images", target, files...)
+}
+
+func makeTestingPostTo(url string, target interface{}, files ...helper.UploadedFile) (statusCode int, err error) {
 	testClient := helper.NewTestClient()
 	err = testClient.AddFiles(files...)
 	if err != nil {
@@ -502,7 +642,7 @@ func makeTestingPost(target interface{}, files ...helper.UploadedFile) (statusCo
 		return
 	}
 
-	statusCode, body, err := testClient.MakePost(validToken, "http://localhost:9925/images")
+	statusCode, body, err := testClient.MakePost(validToken, url)
 	if err != nil {
 		return
 	}
@@ -516,33 +656,38 @@ func makeTestingPost(target interface{}, files ...helper.UploadedFile) (statusCo
 	return
 }
 
+const presetsConfigPath = "/tmp/media-presets.json"
+
+// the suite runs on the memory storage, the files of the servers are accessed with assetsFs and proxyAssetsFs
+var assetsFs, proxyAssetsFs afero.Fs
+
 func setup() {
 	err := os.Setenv("PROXY_URL", "http://localhost:9926")
 	errs.FailOnError(err)
 
-	err = helper.PrepareFileServer(
+	err = ioutil.WriteFile(presetsConfigPath, []byte(`{"thumb": "w_40,h_30,c_fit"}`), 0600)
+	errs.FailOnError(err)
+
+	assetsFs, err = helper.PrepareMemoryFileServer(
 		"media",
-		helper.AssetsPath,
 		map[string]string{
-			"ASSETS_PATH":            helper.AssetsPath,
 			"HOST":                   ":9925",
 			"TOKEN_ISSUER":           "media-service-test",
 			"TOKEN_SECRET":           "12345678",
 			"URL_PREFIX":             "/images",
 			"MAX_UPLOADED_FILE_MB":   "0.1",
 			"HORIZ_MAX_IMAGE_HEIGHT": "500",
+			"PRESETS_CONFIG_PATH":    presetsConfigPath,
 		},
 	)
 	errs.FailOnError(err)
 
 	err = os.Unsetenv("PROXY_URL")
 	errs.FailOnError(err)
-	err = helper.PrepareFileServer(
+	proxyAssetsFs, err = helper.PrepareMemoryFileServer(
 		"proxy",
-		helper.ProxyAssetsPath,
 		map[string]string{
-			"ASSETS_PATH": helper.ProxyAssetsPath,
-			"HOST":        ":9926",
+			"HOST": ":9926",
 		},
 	)
 	errs.FailOnError(err)
@@ -550,4 +695,6 @@ func setup() {
 
 func cleanup() {
 	helper.ShutdownFileServers()
+	errs.FailOnError(os.Remove(presetsConfigPath))
+	errs.FailOnError(os.Unsetenv("PRESETS_CONFIG_PATH"))
 }
@@ -0,0 +1,142 @@
+package test
+
+import (
+	"bytes"
+	"image"
+	http2 "net/http"
+	"testing"
+
+	"github.com/breathbath/go_utils/utils/errs"
+	"github.com/breathbath/media-library/test/helper"
+	"github.com/stretchr/testify/assert"
+)
+
+const memoryServerURL = "http://localhost:9928/images"
+
+func TestMemoryStorage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	err := helper.PrepareFileServer(
+		"memory",
+		"/tmp/memoryassets",
+		map[string]string{
+			"STORAGE_DRIVER":       "memory",
+			"HOST":                 ":9928",
+			"TOKEN_ISSUER":         "media-service-test",
+			"TOKEN_SECRET":         "12345678",
+			"URL_PREFIX":           "/images",
+			"MAX_UPLOADED_FILE_MB": "0.1",
+		},
+	)
+	errs.FailOnError(err)
+	defer func() {
+		helper.ShutdownFileServers()
+		errs.FailOnError(helper.SetEnvs(map[string]string{"STORAGE_DRIVER": "local"}))
+	}()
+
+	t.Run("group", func(t *testing.T) {
+		t.Run("testMemoryReadResized", testMemoryReadResized)
+		t.Run("testMemoryDelete", testMemoryDelete)
+		t.Run("testMemoryDeleteKeepsSiblings", testMemoryDeleteKeepsSiblings)
+	})
+}
+
+func uploadToMemory(t *testing.T, fileNames ...string) []string {
+	uploadedFiles := make([]helper.UploadedFile, 0, len(fileNames))
+	for _, fileName := range fileNames {
+		pngImage, err := helper.CreateImage(helper.ImageSpec{Format: "png", Width: 200, Height: 100})
+		assert.NoError(t, err)
+
+		uploadedFiles = append(uploadedFiles, helper.UploadedFile{
+			FieldName: "files[]",
+			FileName:  fileName,
+			File:      pngImage,
+		})
+	}
+
+	var filesResp filesResponse
+	statusCode, err := makeTestingPostTo(memoryServerURL, &filesResp, uploadedFiles...)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusOK, statusCode)
+	assert.Len(t, filesResp.FilesToReturn, len(fileNames))
+
+	return filesResp.FilesToReturn
+}
+
+func assertImageSize(t *testing.T, url string, expectedWidth, expectedHeight int) {
+	statusCode, body, err := helper.NewTestClient().MakeGet(url)
+	assert.NoError(t, err)
+	if !assert.Equal(t, http2.StatusOK, statusCode) {
+		return
+	}
+
+	imgConfig, _, err := image.DecodeConfig(bytes.NewBufferString(body))
+	assert.NoError(t, err)
+	assert.Equal(t, expectedWidth, imgConfig.Width)
+	assert.Equal(t, expectedHeight, imgConfig.Height)
+}
+
+func testMemoryReadResized(t *testing.T) {
+	t.Parallel()
+
+	files := uploadToMemory(t, "toResize.png")
+	if len(files) == 0 {
+		return
+	}
+
+	assertImageSize(t, memoryServerURL+"/"+files[0], 200, 100)
+	assertImageSize(t, memoryServerURL+"/x50/"+files[0], 100, 50)
+	// second request is served from the resized cache
+	assertImageSize(t, memoryServerURL+"/x50/"+files[0], 100, 50)
+}
+
+func testMemoryDelete(t *testing.T) {
+	t.Parallel()
+
+	files := uploadToMemory(t, "toDelete.png")
+	if len(files) == 0 {
+		return
+	}
+
+	assertImageSize(t, memoryServerURL+"/50x50/"+files[0], 50, 50)
+
+	testClient := helper.NewTestClient()
+	validToken, err := testClient.GenerateValidToken()
+	assert.NoError(t, err)
+
+	statusCode, err := testClient.MakeDelete(validToken, memoryServerURL+"/"+files[0])
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusOK, statusCode)
+
+	for _, url := range []string{memoryServerURL + "/" + files[0], memoryServerURL + "/50x50/" + files[0]} {
+		statusCode, _, err = testClient.MakeGet(url)
+		assert.NoError(t, err)
+		assert.Equal(t, http2.StatusNotFound, statusCode)
+	}
+}
+
+func testMemoryDeleteKeepsSiblings(t *testing.T) {
+	t.Parallel()
+
+	// both files are saved in the same folder, so their resized folders are siblings with a common name prefix
+	files := uploadToMemory(t, "sibling.png", "siblingOther.png")
+	if len(files) != 2 {
+		return
+	}
+
+	assertImageSize(t, memoryServerURL+"/20x20/"+files[0], 20, 20)
+	assertImageSize(t, memoryServerURL+"/20x20/"+files[1], 20, 20)
+
+	testClient := helper.NewTestClient()
+	validToken, err := testClient.GenerateValidToken()
+	assert.NoError(t, err)
+
+	statusCode, err := testClient.MakeDelete(validToken, memoryServerURL+"/"+files[0])
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusOK, statusCode)
+
+	assertImageSize(t, memoryServerURL+"/"+files[1], 200, 100)
+	assertImageSize(t, memoryServerURL+"/20x20/"+files[1], 20, 20)
+}
@@ -0,0 +1,142 @@
+package test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	http2 "net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/breathbath/go_utils/utils/errs"
+	"github.com/breathbath/media-library/assets"
+	error2 "github.com/breathbath/media-library/error"
+	"github.com/breathbath/media-library/test/helper"
+	"github.com/stretchr/testify/assert"
+)
+
+const budgetServerURL = "http://localhost:9942/images"
+const budgetAssetsPath = "/tmp/budgetassets"
+
+func TestPixelBudget(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	err := helper.PrepareFileServer(
+		"budget",
+		budgetAssetsPath,
+		map[string]string{
+			"STORAGE_DRIVER":       "local",
+			"ASSETS_PATH":          budgetAssetsPath,
+			"HOST":                 ":9942",
+			"TOKEN_ISSUER":         "media-service-test",
+			"TOKEN_SECRET":         "12345678",
+			"URL_PREFIX":           "/images",
+			"MAX_UPLOADED_FILE_MB": "5",
+			"MAX_IMAGE_PIXELS":     "1000000",
+		},
+	)
+	errs.FailOnError(err)
+	defer func() {
+		helper.ShutdownFileServers()
+		errs.FailOnError(helper.SetEnvs(map[string]string{"ASSETS_PATH": helper.AssetsPath}))
+		errs.FailOnError(os.Unsetenv("MAX_IMAGE_PIXELS"))
+	}()
+
+	t.Run("testUploadOverPixelBudget", testUploadOverPixelBudget)
+	t.Run("testResizeOverPixelBudget", testResizeOverPixelBudget)
+	t.Run("testAnimatedGifOverPixelBudget", testAnimatedGifOverPixelBudget)
+}
+
+func testUploadOverPixelBudget(t *testing.T) {
+	bombImage, err := helper.CreatePngWithDeclaredSize(50000, 50000)
+	assert.NoError(t, err)
+
+	testClient := helper.NewTestClient()
+	assert.NoError(t, testClient.AddFiles(helper.UploadedFile{FieldName: "files[]", FileName: "bomb.png", File: bombImage}))
+	validToken, err := testClient.GenerateValidToken()
+	assert.NoError(t, err)
+
+	statusCode, body, err := testClient.MakePost(validToken, budgetServerURL+"?version=2")
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusBadRequest, statusCode)
+
+	var v2Errors struct {
+		Errors []error2.FileValidationError `json:"errors"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &v2Errors))
+	if assert.Len(t, v2Errors.Errors, 1) && assert.Len(t, v2Errors.Errors[0].Violations, 1) {
+		assert.Equal(t, assets.ViolationPixelBudgetExceeded, v2Errors.Errors[0].Violations[0].Code)
+		assert.Contains(t, v2Errors.Errors[0].Violations[0].Message, "50000x50000")
+	}
+
+	pngImage, err := helper.CreateImage(helper.ImageSpec{Format: "png", Width: 1000, Height: 1000})
+	assert.NoError(t, err)
+
+	var filesResp filesResponse
+	statusCode, err = makeTestingPostTo(
+		budgetServerURL,
+		&filesResp,
+		helper.UploadedFile{FieldName: "files[]", FileName: "allowed.png", File: pngImage},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusOK, statusCode)
+}
+
+func testResizeOverPixelBudget(t *testing.T) {
+	bombImage, err := helper.CreatePngWithDeclaredSize(50000, 50000)
+	assert.NoError(t, err)
+	bombData, err := ioutil.ReadAll(bombImage)
+	assert.NoError(t, err)
+
+	// the image is put to the storage directly, e.g. it was uploaded before the budget was lowered
+	assert.NoError(t, os.MkdirAll(filepath.Join(budgetAssetsPath, "bombfolder"), os.ModePerm))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(budgetAssetsPath, "bombfolder", "bomb.png"), bombData, 0600))
+
+	statusCode, _, err := helper.NewTestClient().MakeGet(budgetServerURL + "/100x100/bombfolder/bomb.png")
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusUnprocessableEntity, statusCode)
+	_, err = os.Stat(filepath.Join(budgetAssetsPath, "cache", "resized_image", "bombfolder", "bomb.png", "w_100,h_100,c_fill.png"))
+	assert.True(t, os.IsNotExist(err))
+
+	statusCode, _, err = helper.NewTestClient().MakeGet(budgetServerURL + "/bombfolder/bomb.png")
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusOK, statusCode)
+}
+
+func testAnimatedGifOverPixelBudget(t *testing.T) {
+	// every frame fits the budget, all 12 frames of 1000x100 pixels don't
+	gifImage, err := helper.CreateAnimatedGif(1000, 100, make([]int, 12), make([]byte, 12))
+	assert.NoError(t, err)
+
+	testClient := helper.NewTestClient()
+	assert.NoError(t, testClient.AddFiles(helper.UploadedFile{FieldName: "files[]", FileName: "frames.gif", File: gifImage}))
+	validToken, err := testClient.GenerateValidToken()
+	assert.NoError(t, err)
+
+	statusCode, body, err := testClient.MakePost(validToken, budgetServerURL+"?version=2")
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusBadRequest, statusCode)
+
+	var v2Errors struct {
+		Errors []error2.FileValidationError `json:"errors"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &v2Errors))
+	if assert.Len(t, v2Errors.Errors, 1) && assert.Len(t, v2Errors.Errors[0].Violations, 1) {
+		assert.Equal(t, assets.ViolationPixelBudgetExceeded, v2Errors.Errors[0].Violations[0].Code)
+		assert.Contains(t, v2Errors.Errors[0].Violations[0].Message, "12 frames")
+	}
+
+	shortGifImage, err := helper.CreateAnimatedGif(1000, 100, make([]int, 5), make([]byte, 5))
+	assert.NoError(t, err)
+
+	var filesResp filesResponse
+	statusCode, err = makeTestingPostTo(
+		budgetServerURL,
+		&filesResp,
+		helper.UploadedFile{FieldName: "files[]", FileName: "short.gif", File: shortGifImage},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusOK, statusCode)
+}
@@ -0,0 +1,183 @@
+package test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	http2 "net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/breathbath/go_utils/utils/errs"
+	"github.com/breathbath/media-library/test/helper"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	publicKeyServerURL = "http://localhost:9951/images"
+	publicKeyPemPath   = "/tmp/publickeyassets/public.pem"
+	publicKeyJwksPath  = "/tmp/publickeyassets/jwks.json"
+)
+
+var (
+	firstRsaKey  *rsa.PrivateKey
+	secondRsaKey *rsa.PrivateKey
+	ecdsaKey     *ecdsa.PrivateKey
+)
+
+func TestPublicKeyToken(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	var err error
+	firstRsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	errs.FailOnError(err)
+	secondRsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	errs.FailOnError(err)
+	ecdsaKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	errs.FailOnError(err)
+
+	errs.FailOnError(os.MkdirAll("/tmp/publickeyassets", os.ModePerm))
+	publicKeyDer, err := x509.MarshalPKIXPublicKey(&ecdsaKey.PublicKey)
+	errs.FailOnError(err)
+	errs.FailOnError(ioutil.WriteFile(
+		publicKeyPemPath,
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyDer}),
+		0600,
+	))
+	errs.FailOnError(writeJwks(map[string]*rsa.PublicKey{"rsa-1": &firstRsaKey.PublicKey}))
+
+	err = helper.PrepareFileServer(
+		"publickey",
+		"/tmp/publickeyassets",
+		map[string]string{
+			"STORAGE_DRIVER":            "memory",
+			"HOST":                      ":9951",
+			"TOKEN_ISSUER":              "media-service-test",
+			"TOKEN_SECRET":              "",
+			"TOKEN_PUBLIC_KEY_PATH":     publicKeyPemPath,
+			"TOKEN_JWKS_PATH":           publicKeyJwksPath,
+			"TOKEN_JWKS_RELOAD_SECONDS": "1",
+			"URL_PREFIX":                "/images",
+			"MAX_UPLOADED_FILE_MB":      "5",
+		},
+	)
+	errs.FailOnError(err)
+	defer func() {
+		helper.ShutdownFileServers()
+		errs.FailOnError(helper.SetEnvs(map[string]string{"STORAGE_DRIVER": "local"}))
+		errs.FailOnError(os.Unsetenv("TOKEN_PUBLIC_KEY_PATH"))
+		errs.FailOnError(os.Unsetenv("TOKEN_JWKS_PATH"))
+		errs.FailOnError(os.Unsetenv("TOKEN_JWKS_RELOAD_SECONDS"))
+	}()
+
+	t.Run("testJwksSignedToken", testJwksSignedToken)
+	t.Run("testPemSignedToken", testPemSignedToken)
+	t.Run("testHmacTokenWithoutSecret", testHmacTokenWithoutSecret)
+	t.Run("testJwksKeyRotation", testJwksKeyRotation)
+}
+
+// writeJwks writes the RSA keys and an Ed25519 key, which should be skipped by the server
+func writeJwks(keys map[string]*rsa.PublicKey) error {
+	jwks := []map[string]string{{
+		"kid": "ed25519-1",
+		"kty": "OKP",
+		"crv": "Ed25519",
+		"x":   "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo",
+	}}
+	for kid, key := range keys {
+		jwks = append(jwks, map[string]string{
+			"kid": kid,
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+
+	content, err := json.Marshal(map[string]interface{}{"keys": jwks})
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(publicKeyJwksPath, content, 0600)
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key crypto.PrivateKey) string {
+	token := jwt.NewWithClaims(method, jwt.MapClaims{
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+		"sub": "identity-service",
+		"iss": "media-service-test",
+		"aud": "media_service",
+	})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	rawToken, err := token.SignedString(key)
+	assert.NoError(t, err)
+
+	return rawToken
+}
+
+func postPublicKeyImage(t *testing.T, token string) int {
+	testClient := helper.NewTestClient()
+	assert.NoError(t, testClient.AddFiles(createPngFile(t, "image.png")))
+
+	statusCode, _, err := testClient.MakePost(token, publicKeyServerURL)
+	assert.NoError(t, err)
+
+	return statusCode
+}
+
+func testJwksSignedToken(t *testing.T) {
+	assert.Equal(t, http2.StatusOK, postPublicKeyImage(t, signToken(t, jwt.SigningMethodRS256, "rsa-1", firstRsaKey)))
+	assert.Equal(t, http2.StatusUnauthorized, postPublicKeyImage(t, signToken(t, jwt.SigningMethodRS256, "rsa-2", secondRsaKey)))
+	assert.Equal(t, http2.StatusUnauthorized, postPublicKeyImage(t, signToken(t, jwt.SigningMethodRS256, "rsa-1", secondRsaKey)))
+}
+
+func testPemSignedToken(t *testing.T) {
+	assert.Equal(t, http2.StatusOK, postPublicKeyImage(t, signToken(t, jwt.SigningMethodES256, "", ecdsaKey)))
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusUnauthorized, postPublicKeyImage(t, signToken(t, jwt.SigningMethodES256, "", otherKey)))
+}
+
+func testHmacTokenWithoutSecret(t *testing.T) {
+	hmacToken := signToken(t, jwt.SigningMethodHS256, "", []byte("12345678"))
+	assert.Equal(t, http2.StatusUnauthorized, postPublicKeyImage(t, hmacToken))
+}
+
+func testJwksKeyRotation(t *testing.T) {
+	firstToken := signToken(t, jwt.SigningMethodRS256, "rsa-1", firstRsaKey)
+	secondToken := signToken(t, jwt.SigningMethodRS256, "rsa-2", secondRsaKey)
+
+	assert.NoError(t, writeJwks(map[string]*rsa.PublicKey{
+		"rsa-1": &firstRsaKey.PublicKey,
+		"rsa-2": &secondRsaKey.PublicKey,
+	}))
+	// the file is checked at most once per TOKEN_JWKS_RELOAD_SECONDS
+	time.Sleep(1100 * time.Millisecond)
+	assert.Equal(t, http2.StatusOK, postPublicKeyImage(t, firstToken))
+	assert.Equal(t, http2.StatusOK, postPublicKeyImage(t, secondToken))
+
+	assert.NoError(t, writeJwks(map[string]*rsa.PublicKey{"rsa-2": &secondRsaKey.PublicKey}))
+	assert.Equal(t, http2.StatusOK, postPublicKeyImage(t, firstToken))
+	time.Sleep(1100 * time.Millisecond)
+	assert.Equal(t, http2.StatusUnauthorized, postPublicKeyImage(t, firstToken))
+	assert.Equal(t, http2.StatusOK, postPublicKeyImage(t, secondToken))
+}
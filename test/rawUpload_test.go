@@ -0,0 +1,250 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"io/ioutil"
+	http2 "net/http"
+	"sync"
+	"testing"
+
+	"github.com/breathbath/go_utils/utils/errs"
+	"github.com/breathbath/media-library/assets"
+	"github.com/breathbath/media-library/test/helper"
+	"github.com/stretchr/testify/assert"
+)
+
+const rawServerURL = "http://localhost:9947/images"
+
+func TestRawUpload(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	err := helper.PrepareFileServer(
+		"raw",
+		"/tmp/rawassets",
+		map[string]string{
+			"STORAGE_DRIVER":       "memory",
+			"HOST":                 ":9947",
+			"TOKEN_ISSUER":         "media-service-test",
+			"TOKEN_SECRET":         "12345678",
+			"URL_PREFIX":           "/images",
+			"MAX_UPLOADED_FILE_MB": "5",
+		},
+	)
+	errs.FailOnError(err)
+	defer func() {
+		helper.ShutdownFileServers()
+		errs.FailOnError(helper.SetEnvs(map[string]string{"STORAGE_DRIVER": "local"}))
+	}()
+
+	t.Run("testPutCreatesAndReplacesImage", testPutCreatesAndReplacesImage)
+	t.Run("testPutInvalidPaths", testPutInvalidPaths)
+	t.Run("testPutInvalidImage", testPutInvalidImage)
+	t.Run("testFailedPutKeepsImage", testFailedPutKeepsImage)
+	t.Run("testConcurrentPutsWithoutReplacing", testConcurrentPutsWithoutReplacing)
+	t.Run("testFailedPutWithoutReplacing", testFailedPutWithoutReplacing)
+	t.Run("testPostRawBody", testPostRawBody)
+}
+
+func createPngData(t *testing.T, width, height int) []byte {
+	pngImage, err := helper.CreateImage(helper.ImageSpec{Format: "png", Width: width, Height: height})
+	assert.NoError(t, err)
+	pngData, err := ioutil.ReadAll(pngImage)
+	assert.NoError(t, err)
+
+	return pngData
+}
+
+func makeRawRequest(t *testing.T, method, url string, headers map[string]string, body []byte) (*http2.Response, string) {
+	testClient := helper.NewTestClient()
+	for key, value := range headers {
+		testClient.SetHeader(key, value)
+	}
+
+	validToken, err := testClient.GenerateValidToken()
+	assert.NoError(t, err)
+
+	resp, respBody, err := testClient.MakeRequest(method, validToken, url, body)
+	errs.FailOnError(err)
+
+	return resp, respBody
+}
+
+func assertStoredImageWidth(t *testing.T, url string, expectedWidth int) {
+	statusCode, body, err := helper.NewTestClient().MakeGet(url)
+	assert.NoError(t, err)
+	if !assert.Equal(t, http2.StatusOK, statusCode) {
+		return
+	}
+
+	imgConfig, _, err := image.DecodeConfig(bytes.NewBufferString(body))
+	assert.NoError(t, err)
+	assert.Equal(t, expectedWidth, imgConfig.Width)
+}
+
+func testPutCreatesAndReplacesImage(t *testing.T) {
+	imageURL := rawServerURL + "/catalog/cover.png"
+
+	resp, body := makeRawRequest(t, http2.MethodPut, imageURL, nil, createPngData(t, 100, 50))
+	assert.Equal(t, http2.StatusCreated, resp.StatusCode)
+
+	var filesResp filesResponse
+	assert.NoError(t, json.Unmarshal([]byte(body), &filesResp))
+	assert.Equal(t, []string{"catalog/cover.png"}, filesResp.FilesToReturn)
+	assertStoredImageWidth(t, imageURL, 100)
+
+	resp, _ = makeRawRequest(t, http2.MethodPut, imageURL, map[string]string{"If-None-Match": "*"}, createPngData(t, 40, 20))
+	assert.Equal(t, http2.StatusPreconditionFailed, resp.StatusCode)
+	assertStoredImageWidth(t, imageURL, 100)
+
+	resp, _ = makeRawRequest(t, http2.MethodPut, imageURL, nil, createPngData(t, 40, 20))
+	assert.Equal(t, http2.StatusOK, resp.StatusCode)
+	assertStoredImageWidth(t, imageURL, 40)
+
+	// other images can be added to the existing folder
+	resp, _ = makeRawRequest(
+		t,
+		http2.MethodPut,
+		rawServerURL+"/catalog/back.png",
+		map[string]string{"If-None-Match": "*"},
+		createPngData(t, 30, 30),
+	)
+	assert.Equal(t, http2.StatusCreated, resp.StatusCode)
+	assertStoredImageWidth(t, rawServerURL+"/catalog/back.png", 30)
+	assertStoredImageWidth(t, imageURL, 40)
+
+	resp, _, err := helper.NewTestClient().MakeRequest(http2.MethodPut, "", imageURL, createPngData(t, 40, 20))
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusUnauthorized, resp.StatusCode)
+}
+
+func testPutInvalidPaths(t *testing.T) {
+	testCases := []struct {
+		path          string
+		expectedField string
+	}{
+		{"/cache/cover.png", "folder"},
+		{"/catalog-2/cover.png", "folder"},
+		{"/catalog/cover%20photo.png", assets.RawUploadFieldName},
+		{"/catalog/cover", assets.RawUploadFieldName},
+		{"/catalog/cover.txt", assets.RawUploadFieldName},
+	}
+
+	for _, testCase := range testCases {
+		resp, body := makeRawRequest(t, http2.MethodPut, rawServerURL+testCase.path, nil, createPngData(t, 10, 10))
+		assert.Equal(t, http2.StatusBadRequest, resp.StatusCode, testCase.path)
+
+		var fieldErrors map[string][]string
+		assert.NoError(t, json.Unmarshal([]byte(body), &fieldErrors))
+		assert.Len(t, fieldErrors[testCase.expectedField], 1, testCase.path)
+	}
+}
+
+func testPutInvalidImage(t *testing.T) {
+	resp, body := makeRawRequest(t, http2.MethodPut, rawServerURL+"/catalog/notes.png", nil, []byte("some text"))
+	assert.Equal(t, http2.StatusBadRequest, resp.StatusCode)
+
+	var fieldErrors map[string][]string
+	assert.NoError(t, json.Unmarshal([]byte(body), &fieldErrors))
+	assert.Len(t, fieldErrors[assets.RawUploadFieldName], 1)
+
+	statusCode, _, err := helper.NewTestClient().MakeGet(rawServerURL + "/catalog/notes.png")
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusNotFound, statusCode)
+}
+
+func testFailedPutKeepsImage(t *testing.T) {
+	imageURL := rawServerURL + "/catalog/kept.png"
+
+	resp, _ := makeRawRequest(t, http2.MethodPut, imageURL, nil, createPngData(t, 60, 30))
+	assert.Equal(t, http2.StatusCreated, resp.StatusCode)
+
+	// the header of the truncated image is valid, so it fails only on encoding
+	pngData := createPngData(t, 80, 40)
+	resp, _ = makeRawRequest(t, http2.MethodPut, imageURL, nil, pngData[:len(pngData)/2])
+	assert.True(t, resp.StatusCode >= http2.StatusBadRequest, resp.StatusCode)
+	assertStoredImageWidth(t, imageURL, 60)
+}
+
+// testConcurrentPutsWithoutReplacing creates the image once, even if the requests pass the existence check at the same time
+func testConcurrentPutsWithoutReplacing(t *testing.T) {
+	const requestsCount = 10
+	statusCodes := make([]int, requestsCount)
+	wg := sync.WaitGroup{}
+	for i := 0; i < requestsCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, _ := makeRawRequest(
+				t,
+				http2.MethodPut,
+				rawServerURL+"/catalog/concurrent.PNG",
+				map[string]string{"If-None-Match": "*"},
+				createPngData(t, 10+i, 10),
+			)
+			statusCodes[i] = resp.StatusCode
+		}(i)
+	}
+	wg.Wait()
+
+	createdWidth := 0
+	for i, statusCode := range statusCodes {
+		if statusCode == http2.StatusCreated {
+			assert.Zero(t, createdWidth, "the image is created by several requests")
+			createdWidth = 10 + i
+			continue
+		}
+		assert.Equal(t, http2.StatusPreconditionFailed, statusCode)
+	}
+	if assert.NotZero(t, createdWidth) {
+		assertStoredImageWidth(t, rawServerURL+"/catalog/concurrent.png", createdWidth)
+	}
+}
+
+// testFailedPutWithoutReplacing removes the empty image created for the failed request, so the image can be created later
+func testFailedPutWithoutReplacing(t *testing.T) {
+	imageURL := rawServerURL + "/catalog/created.png"
+	headers := map[string]string{"If-None-Match": "*"}
+
+	pngData := createPngData(t, 80, 40)
+	resp, _ := makeRawRequest(t, http2.MethodPut, imageURL, headers, pngData[:len(pngData)/2])
+	assert.Equal(t, http2.StatusInternalServerError, resp.StatusCode)
+
+	statusCode, _, err := helper.NewTestClient().MakeGet(imageURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusNotFound, statusCode)
+
+	resp, _ = makeRawRequest(t, http2.MethodPut, imageURL, headers, []byte("some text"))
+	assert.Equal(t, http2.StatusBadRequest, resp.StatusCode)
+
+	resp, _ = makeRawRequest(t, http2.MethodPut, imageURL, headers, pngData)
+	assert.Equal(t, http2.StatusCreated, resp.StatusCode)
+	assertStoredImageWidth(t, imageURL, 80)
+}
+
+func testPostRawBody(t *testing.T) {
+	resp, body := makeRawRequest(t, http2.MethodPost, rawServerURL, map[string]string{
+		"Content-Type":        "image/png",
+		"Content-Disposition": `attachment; filename="raw photo.png"`,
+	}, createPngData(t, 20, 20))
+	assert.Equal(t, http2.StatusOK, resp.StatusCode)
+
+	var filesResp filesResponse
+	assert.NoError(t, json.Unmarshal([]byte(body), &filesResp))
+	if assert.Len(t, filesResp.FilesToReturn, 1) {
+		assert.Regexp(t, `^\w+/raw_photo\.png$`, filesResp.FilesToReturn[0])
+	}
+
+	resp, body = makeRawRequest(t, http2.MethodPost, rawServerURL, map[string]string{
+		"Content-Type":        "image/png",
+		"Content-Disposition": "attachment",
+	}, createPngData(t, 20, 20))
+	assert.Equal(t, http2.StatusBadRequest, resp.StatusCode)
+
+	var fieldErrors map[string][]string
+	assert.NoError(t, json.Unmarshal([]byte(body), &fieldErrors))
+	assert.Equal(t, []string{"Content-Disposition header should contain the file name"}, fieldErrors[assets.RawUploadFieldName])
+}
@@ -0,0 +1,252 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	http2 "net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/breathbath/go_utils/utils/errs"
+	"github.com/breathbath/media-library/assets"
+	error2 "github.com/breathbath/media-library/error"
+	"github.com/breathbath/media-library/test/helper"
+	"github.com/stretchr/testify/assert"
+)
+
+const remoteServerURL = "http://localhost:9945/images"
+const guardedRemoteServerURL = "http://localhost:9946/images"
+
+var remoteUploadEnvs = []string{
+	"REMOTE_UPLOAD_ALLOW_PRIVATE_NETWORKS",
+	"REMOTE_UPLOAD_MAX_REDIRECTS",
+	"REMOTE_UPLOAD_MAX_URLS",
+}
+
+func TestRemoteUpload(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	sourceServer := newRemoteSourceServer(t)
+	defer sourceServer.Close()
+
+	envs := map[string]string{
+		"STORAGE_DRIVER":                       "memory",
+		"HOST":                                 ":9945",
+		"TOKEN_ISSUER":                         "media-service-test",
+		"TOKEN_SECRET":                         "12345678",
+		"URL_PREFIX":                           "/images",
+		"MAX_UPLOADED_FILE_MB":                 "0.1",
+		"REMOTE_UPLOAD_ALLOW_PRIVATE_NETWORKS": "true",
+		"REMOTE_UPLOAD_MAX_REDIRECTS":          "2",
+		"REMOTE_UPLOAD_MAX_URLS":               "4",
+	}
+	errs.FailOnError(helper.PrepareFileServer("remote", "/tmp/remoteassets", envs))
+
+	envs["HOST"] = ":9946"
+	envs["REMOTE_UPLOAD_ALLOW_PRIVATE_NETWORKS"] = "false"
+	errs.FailOnError(helper.PrepareFileServer("remoteguarded", "/tmp/remoteassets", envs))
+
+	defer func() {
+		helper.ShutdownFileServers()
+		errs.FailOnError(helper.SetEnvs(map[string]string{"STORAGE_DRIVER": "local"}))
+		for _, envName := range remoteUploadEnvs {
+			errs.FailOnError(os.Unsetenv(envName))
+		}
+	}()
+
+	t.Run("testRemoteUploadSaved", func(t *testing.T) { testRemoteUploadSaved(t, sourceServer.URL) })
+	t.Run("testRemoteUploadViolations", func(t *testing.T) { testRemoteUploadViolations(t, sourceServer.URL) })
+	t.Run("testRemoteUploadPartialMode", func(t *testing.T) { testRemoteUploadPartialMode(t, sourceServer.URL) })
+	t.Run("testRemoteUploadInvalidRequests", testRemoteUploadInvalidRequests)
+	t.Run("testRemoteUploadPrivateNetwork", func(t *testing.T) { testRemoteUploadPrivateNetwork(t, sourceServer.URL) })
+}
+
+// newRemoteSourceServer serves images to be uploaded by url, /redirect/{n} redirects n times before giving an image
+func newRemoteSourceServer(t *testing.T) *httptest.Server {
+	pngImage, err := helper.CreateImage(helper.ImageSpec{Format: "png"})
+	errs.FailOnError(err)
+	pngData, err := ioutil.ReadAll(pngImage)
+	errs.FailOnError(err)
+
+	mux := http2.NewServeMux()
+	mux.HandleFunc("/photo.png", func(rw http2.ResponseWriter, r *http2.Request) {
+		_, _ = rw.Write(pngData)
+	})
+	mux.HandleFunc("/large.png", func(rw http2.ResponseWriter, r *http2.Request) {
+		_, _ = rw.Write(append(pngData, make([]byte, 150000)...))
+	})
+	mux.HandleFunc("/notes.txt", func(rw http2.ResponseWriter, r *http2.Request) {
+		_, _ = rw.Write([]byte("some text"))
+	})
+	mux.HandleFunc("/redirect/", func(rw http2.ResponseWriter, r *http2.Request) {
+		redirectsLeft, e := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/redirect/"))
+		if e != nil {
+			http2.NotFound(rw, r)
+			return
+		}
+		if redirectsLeft == 0 {
+			_, _ = rw.Write(pngData)
+			return
+		}
+		http2.Redirect(rw, r, fmt.Sprintf("/redirect/%d", redirectsLeft-1), http2.StatusFound)
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func postRemoteURLs(t *testing.T, url string, body string) (int, string) {
+	testClient := helper.NewTestClient()
+	testClient.SetHeader("Content-Type", "application/json")
+	validToken, err := testClient.GenerateValidToken()
+	assert.NoError(t, err)
+
+	resp, respBody, err := testClient.MakeRequest(http2.MethodPost, validToken, url, []byte(body))
+	errs.FailOnError(err)
+
+	return resp.StatusCode, respBody
+}
+
+func buildRemoteUploadBody(urls ...string) string {
+	body, err := json.Marshal(map[string][]string{"urls": urls})
+	errs.FailOnError(err)
+
+	return string(body)
+}
+
+func testRemoteUploadSaved(t *testing.T, sourceURL string) {
+	statusCode, body := postRemoteURLs(
+		t,
+		remoteServerURL+"/remote",
+		buildRemoteUploadBody(sourceURL+"/photo.png", sourceURL+"/redirect/2"),
+	)
+	assert.Equal(t, http2.StatusOK, statusCode)
+
+	var filesResp filesResponse
+	assert.NoError(t, json.Unmarshal([]byte(body), &filesResp))
+	if !assert.Len(t, filesResp.FilesToReturn, 2) {
+		return
+	}
+	assert.Regexp(t, `^\w+/photo\.png$`, filesResp.FilesToReturn[0])
+	assert.Regexp(t, `^\w+/2\.png$`, filesResp.FilesToReturn[1])
+
+	for _, filePath := range filesResp.FilesToReturn {
+		statusCode, _, err := helper.NewTestClient().MakeGet(remoteServerURL + "/" + filePath)
+		assert.NoError(t, err)
+		assert.Equal(t, http2.StatusOK, statusCode)
+	}
+}
+
+func testRemoteUploadViolations(t *testing.T, sourceURL string) {
+	statusCode, body := postRemoteURLs(
+		t,
+		remoteServerURL+"/remote?version=2",
+		buildRemoteUploadBody(
+			sourceURL+"/missing.png",
+			sourceURL+"/large.png",
+			sourceURL+"/redirect/3",
+			sourceURL+"/notes.txt",
+		),
+	)
+	assert.Equal(t, http2.StatusBadRequest, statusCode)
+
+	var v2Errors struct {
+		Errors []error2.FileValidationError `json:"errors"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &v2Errors))
+	if !assert.Len(t, v2Errors.Errors, 4) {
+		return
+	}
+
+	expectedErrors := []struct {
+		filename string
+		code     string
+	}{
+		{"missing.png", assets.ViolationDownloadFailed},
+		{"large.png", assets.ViolationFileTooLarge},
+		{"3", assets.ViolationDownloadFailed},
+		{"notes.txt", assets.ViolationUnsupportedMimeType},
+	}
+	for i, expectedError := range expectedErrors {
+		fileErr := v2Errors.Errors[i]
+		assert.Equal(t, i, fileErr.Index)
+		assert.Equal(t, expectedError.filename, fileErr.Filename)
+		assert.Equal(t, assets.RemoteUploadFieldName, fileErr.Field)
+		if assert.Len(t, fileErr.Violations, 1) {
+			assert.Equal(t, expectedError.code, fileErr.Violations[0].Code)
+		}
+	}
+	// failure details aren't given to clients
+	assert.Equal(t, "The file cannot be downloaded", v2Errors.Errors[0].Violations[0].Message)
+	assert.Equal(t, "The file cannot be downloaded", v2Errors.Errors[2].Violations[0].Message)
+}
+
+func testRemoteUploadPartialMode(t *testing.T, sourceURL string) {
+	statusCode, body := postRemoteURLs(
+		t,
+		remoteServerURL+"/remote?upload_mode="+assets.UploadModePartial,
+		buildRemoteUploadBody(sourceURL+"/photo.png", sourceURL+"/missing.png"),
+	)
+	assert.Equal(t, http2.StatusMultiStatus, statusCode)
+
+	var partialResp struct {
+		Files []assets.UploadFileStatus `json:"files"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &partialResp))
+	if assert.Len(t, partialResp.Files, 2) {
+		assert.Equal(t, assets.UploadStatusSaved, partialResp.Files[0].Status)
+		assert.Equal(t, assets.UploadStatusRejected, partialResp.Files[1].Status)
+	}
+}
+
+func testRemoteUploadInvalidRequests(t *testing.T) {
+	resp, _, err := helper.NewTestClient().MakeRequest(
+		http2.MethodPost,
+		"",
+		remoteServerURL+"/remote",
+		[]byte(buildRemoteUploadBody("http://example.com/photo.png")),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusUnauthorized, resp.StatusCode)
+
+	testCases := []struct {
+		body          string
+		expectedError string
+	}{
+		{"not json", "Should be a JSON object with the list of image urls"},
+		{buildRemoteUploadBody(), "Should contain at least 1 element"},
+		{buildRemoteUploadBody("a", "b", "c", "d", "e"), "Should contain at most 4 elements"},
+	}
+
+	for _, testCase := range testCases {
+		statusCode, body := postRemoteURLs(t, remoteServerURL+"/remote", testCase.body)
+		assert.Equal(t, http2.StatusBadRequest, statusCode)
+
+		var fieldErrors map[string][]string
+		assert.NoError(t, json.Unmarshal([]byte(body), &fieldErrors))
+		assert.Equal(t, []string{testCase.expectedError}, fieldErrors[assets.RemoteUploadFieldName])
+	}
+}
+
+func testRemoteUploadPrivateNetwork(t *testing.T, sourceURL string) {
+	statusCode, body := postRemoteURLs(
+		t,
+		guardedRemoteServerURL+"/remote?version=2",
+		buildRemoteUploadBody(sourceURL+"/photo.png"),
+	)
+	assert.Equal(t, http2.StatusBadRequest, statusCode)
+
+	var v2Errors struct {
+		Errors []error2.FileValidationError `json:"errors"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &v2Errors))
+	if assert.Len(t, v2Errors.Errors, 1) && assert.Len(t, v2Errors.Errors[0].Violations, 1) {
+		assert.Equal(t, assets.ViolationDownloadFailed, v2Errors.Errors[0].Violations[0].Code)
+		assert.Equal(t, "The file cannot be downloaded", v2Errors.Errors[0].Violations[0].Message)
+	}
+}
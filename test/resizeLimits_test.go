@@ -0,0 +1,91 @@
+package test
+
+import (
+	http2 "net/http"
+	"os"
+	"testing"
+
+	"github.com/breathbath/go_utils/utils/errs"
+	"github.com/breathbath/media-library/test/helper"
+	"github.com/stretchr/testify/assert"
+)
+
+const limitedServerURL = "http://localhost:9930/images"
+
+func TestResizeLimits(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	err := helper.PrepareFileServer(
+		"limited",
+		"/tmp/limitedassets",
+		map[string]string{
+			"STORAGE_DRIVER":       "memory",
+			"HOST":                 ":9930",
+			"TOKEN_ISSUER":         "media-service-test",
+			"TOKEN_SECRET":         "12345678",
+			"URL_PREFIX":           "/images",
+			"MAX_UPLOADED_FILE_MB": "0.1",
+			"RESIZE_ALLOWED_SIZES": "50x50, 40x,x1000",
+			"RESIZE_MAX_HEIGHT":    "500",
+		},
+	)
+	errs.FailOnError(err)
+	defer func() {
+		helper.ShutdownFileServers()
+		errs.FailOnError(helper.SetEnvs(map[string]string{"STORAGE_DRIVER": "local"}))
+		errs.FailOnError(os.Unsetenv("RESIZE_ALLOWED_SIZES"))
+		errs.FailOnError(os.Unsetenv("RESIZE_MAX_HEIGHT"))
+	}()
+
+	pngImage, err := helper.CreateImage(helper.ImageSpec{Format: "png"})
+	assert.NoError(t, err)
+
+	var filesResp filesResponse
+	statusCode, err := makeTestingPostTo(
+		limitedServerURL,
+		&filesResp,
+		helper.UploadedFile{FieldName: "files[]", FileName: "limited.png", File: pngImage},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusOK, statusCode)
+	if !assert.Len(t, filesResp.FilesToReturn, 1) {
+		return
+	}
+	imagePath := filesResp.FilesToReturn[0]
+
+	testCases := []struct {
+		transformation string
+		expectedStatus int
+	}{
+		{"50x50", http2.StatusOK},
+		{"40x", http2.StatusOK},
+		{"w_40,c_fit", http2.StatusOK},
+		{"w_50,h_50,c_pad", http2.StatusOK},
+		{"w_50,h_50,c_pad,bg_ffffff", http2.StatusOK},
+		// every quality and background would be cached separately
+		{"w_50,h_50,q_70", http2.StatusNotFound},
+		{"w_50,h_50,c_pad,bg_ff0000", http2.StatusNotFound},
+		// only exact legacy sizes are accepted
+		{"50x50x", http2.StatusNotFound},
+		{"a50x50", http2.StatusNotFound},
+		{"050x050", http2.StatusOK},
+		{"60x60", http2.StatusNotFound},
+		{"x40", http2.StatusNotFound},
+		{"40x40", http2.StatusNotFound},
+		// allowed, but exceeding RESIZE_MAX_HEIGHT
+		{"x1000", http2.StatusNotFound},
+	}
+
+	testClient := helper.NewTestClient()
+	for _, testCase := range testCases {
+		statusCode, _, err := testClient.MakeGet(limitedServerURL + "/" + testCase.transformation + "/" + imagePath)
+		assert.NoError(t, err, testCase.transformation)
+		assert.Equal(t, testCase.expectedStatus, statusCode, testCase.transformation)
+	}
+
+	statusCode, _, err = testClient.MakeGet(limitedServerURL + "/" + imagePath)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusOK, statusCode)
+}
@@ -0,0 +1,117 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	http2 "net/http"
+	"path"
+	"testing"
+
+	"github.com/breathbath/go_utils/utils/errs"
+	"github.com/breathbath/media-library/assets"
+	"github.com/breathbath/media-library/test/helper"
+	"github.com/stretchr/testify/assert"
+)
+
+const s3ServerURL = "http://localhost:9927/images"
+
+func TestS3Storage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	fakeS3 := helper.NewFakeS3Server("media")
+	defer fakeS3.Close()
+
+	err := helper.PrepareFileServer(
+		"s3",
+		"/tmp/s3assets",
+		map[string]string{
+			"STORAGE_DRIVER":       "s3",
+			"S3_ENDPOINT":          fakeS3.URL,
+			"S3_BUCKET":            fakeS3.Bucket,
+			"S3_ACCESS_KEY":        "access",
+			"S3_SECRET_KEY":        "secret",
+			"S3_PREFIX":            "images",
+			"HOST":                 ":9927",
+			"TOKEN_ISSUER":         "media-service-test",
+			"TOKEN_SECRET":         "12345678",
+			"URL_PREFIX":           "/images",
+			"MAX_UPLOADED_FILE_MB": "0.1",
+		},
+	)
+	errs.FailOnError(err)
+	defer func() {
+		helper.ShutdownFileServers()
+		errs.FailOnError(helper.SetEnvs(map[string]string{"STORAGE_DRIVER": "local"}))
+	}()
+
+	pngImage, err := helper.CreateImage(helper.ImageSpec{Format: "png", Width: 200, Height: 100})
+	assert.NoError(t, err)
+
+	var filesResp filesResponse
+	statusCode, err := makeTestingPostTo(
+		s3ServerURL,
+		&filesResp,
+		helper.UploadedFile{
+			FieldName: "files[]",
+			FileName:  "s3Image.png",
+			File:      pngImage,
+		},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusOK, statusCode)
+	if !assert.Len(t, filesResp.FilesToReturn, 1) {
+		return
+	}
+
+	imagePath := filesResp.FilesToReturn[0]
+	assert.True(t, fakeS3.ObjectExists(path.Join("images", imagePath)))
+
+	testClient := helper.NewTestClient()
+	statusCode, body, err := testClient.MakeGet(s3ServerURL + "/" + imagePath)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusOK, statusCode)
+
+	imgConfig, _, err := image.DecodeConfig(bytes.NewBufferString(body))
+	assert.NoError(t, err)
+	assert.Equal(t, 200, imgConfig.Width)
+	assert.Equal(t, 100, imgConfig.Height)
+
+	statusCode, body, err = testClient.MakeGet(s3ServerURL + "/50x/" + imagePath)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusOK, statusCode)
+
+	imgConfig, _, err = image.DecodeConfig(bytes.NewBufferString(body))
+	assert.NoError(t, err)
+	assert.Equal(t, 50, imgConfig.Width)
+	assert.Equal(t, 25, imgConfig.Height)
+
+	folderName, imageFile := path.Split(imagePath)
+	assert.True(
+		t,
+		fakeS3.ObjectExists(path.Join("images", "cache", "resized_image", folderName, "s3Image.png", "w_50,c_fill.png")),
+		"resized image is not cached, stored keys: %v", fakeS3.Keys(),
+	)
+	assert.Equal(t, imageFile, "s3Image.png")
+
+	statusCode, body, err = testClient.MakeGet(s3ServerURL + "/" + imagePath + "/meta")
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusOK, statusCode)
+	var imageMeta assets.ImageMeta
+	assert.NoError(t, json.Unmarshal([]byte(body), &imageMeta))
+	assert.Equal(t, []assets.ImageVariant{{Transformation: "w_50,c_fill", Format: "png", Path: "w_50,c_fill/" + imagePath}}, imageMeta.Variants)
+
+	validToken, err := testClient.GenerateValidToken()
+	assert.NoError(t, err)
+
+	statusCode, err = testClient.MakeDelete(validToken, s3ServerURL+"/"+imagePath)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusOK, statusCode)
+	assert.Empty(t, fakeS3.Keys())
+
+	statusCode, err = testClient.MakeDelete(validToken, s3ServerURL+"/"+imagePath)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusNotFound, statusCode)
+}
@@ -0,0 +1,95 @@
+package test
+
+import (
+	http2 "net/http"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/breathbath/go_utils/utils/errs"
+	"github.com/breathbath/media-library/assets"
+	"github.com/breathbath/media-library/test/helper"
+	"github.com/stretchr/testify/assert"
+)
+
+const signedServerURL = "http://localhost:9929/images"
+
+func TestSignedURLs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	err := helper.PrepareFileServer(
+		"signed",
+		"/tmp/signedassets",
+		map[string]string{
+			"STORAGE_DRIVER":       "memory",
+			"HOST":                 ":9929",
+			"TOKEN_ISSUER":         "media-service-test",
+			"TOKEN_SECRET":         "12345678",
+			"URL_PREFIX":           "/images",
+			"MAX_UPLOADED_FILE_MB": "0.1",
+			"URL_SIGNING_SECRET":   "signing-secret",
+		},
+	)
+	errs.FailOnError(err)
+	defer func() {
+		helper.ShutdownFileServers()
+		errs.FailOnError(helper.SetEnvs(map[string]string{"STORAGE_DRIVER": "local"}))
+		errs.FailOnError(os.Unsetenv("URL_SIGNING_SECRET"))
+	}()
+
+	pngImage, err := helper.CreateImage(helper.ImageSpec{Format: "png"})
+	assert.NoError(t, err)
+
+	var filesResp filesResponse
+	statusCode, err := makeTestingPostTo(
+		signedServerURL,
+		&filesResp,
+		helper.UploadedFile{FieldName: "files[]", FileName: "signed.png", File: pngImage},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusOK, statusCode)
+	if !assert.Len(t, filesResp.FilesToReturn, 1) {
+		return
+	}
+	imagePath := filesResp.FilesToReturn[0]
+
+	signer := assets.NewURLSigner()
+	testClient := helper.NewTestClient()
+
+	otherSizeURL, err := url.Parse(signer.Sign("50x50/"+imagePath, time.Time{}))
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name           string
+		url            string
+		expectedStatus int
+	}{
+		{"original without signature", signedServerURL + "/" + imagePath, http2.StatusOK},
+		{"resized without signature", signedServerURL + "/50x50/" + imagePath, http2.StatusForbidden},
+		{"resized with signature", signedServerURL + "/" + signer.Sign("50x50/"+imagePath, time.Time{}), http2.StatusOK},
+		{
+			"resized with not expired signature",
+			signedServerURL + "/" + signer.Sign("w_40,c_fit/"+imagePath, time.Now().Add(time.Hour)),
+			http2.StatusOK,
+		},
+		{
+			"resized with expired signature",
+			signedServerURL + "/" + signer.Sign("w_40,c_fit/"+imagePath, time.Now().Add(-time.Minute)),
+			http2.StatusForbidden,
+		},
+		{
+			"signature of other size",
+			signedServerURL + "/60x60/" + imagePath + "?" + otherSizeURL.RawQuery,
+			http2.StatusForbidden,
+		},
+	}
+
+	for _, testCase := range testCases {
+		statusCode, _, err := testClient.MakeGet(testCase.url)
+		assert.NoError(t, err, testCase.name)
+		assert.Equal(t, testCase.expectedStatus, statusCode, testCase.name)
+	}
+}
@@ -0,0 +1,156 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	http2 "net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/breathbath/go_utils/utils/errs"
+	"github.com/breathbath/media-library/assets"
+	"github.com/breathbath/media-library/test/helper"
+	"github.com/stretchr/testify/assert"
+)
+
+const streamingServerURL = "http://localhost:9943/images"
+const streamingAssetsPath = "/tmp/streamingassets"
+
+func TestStreamingUpload(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	err := helper.PrepareFileServer(
+		"streaming",
+		streamingAssetsPath,
+		map[string]string{
+			"STORAGE_DRIVER":        "local",
+			"ASSETS_PATH":           streamingAssetsPath,
+			"HOST":                  ":9943",
+			"TOKEN_ISSUER":          "media-service-test",
+			"TOKEN_SECRET":          "12345678",
+			"URL_PREFIX":            "/images",
+			"MAX_UPLOADED_FILE_MB":  "0.1",
+			"MAX_UPLOAD_REQUEST_MB": "0.25",
+		},
+	)
+	errs.FailOnError(err)
+	defer func() {
+		helper.ShutdownFileServers()
+		errs.FailOnError(helper.SetEnvs(map[string]string{"ASSETS_PATH": helper.AssetsPath}))
+		errs.FailOnError(os.Unsetenv("MAX_UPLOAD_REQUEST_MB"))
+	}()
+
+	t.Run("testFileOverSizeLimit", testFileOverSizeLimit)
+	t.Run("testRequestOverSizeLimit", testRequestOverSizeLimit)
+	t.Run("testFormFieldsBeforeFiles", testFormFieldsBeforeFiles)
+	t.Run("testFormFieldsAfterFiles", testFormFieldsAfterFiles)
+}
+
+// createPaddedPng generates a png which is padded after its end to the exact size
+func createPaddedPng(t *testing.T, size int) io.Reader {
+	pngImage, err := helper.CreateImage(helper.ImageSpec{Format: "png"})
+	assert.NoError(t, err)
+
+	pngData, err := ioutil.ReadAll(pngImage)
+	assert.NoError(t, err)
+
+	return bytes.NewReader(append(pngData, make([]byte, size-len(pngData))...))
+}
+
+func testFileOverSizeLimit(t *testing.T) {
+	var fieldErrors map[string][]string
+	statusCode, err := makeTestingPostTo(
+		streamingServerURL,
+		&fieldErrors,
+		helper.UploadedFile{FieldName: "files[]", FileName: "large.png", File: createPaddedPng(t, 150000)},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusBadRequest, statusCode)
+	assert.Equal(
+		t,
+		[]string{"The file is larger than 0.1 Mb, which is the allowed maximum size"},
+		fieldErrors[assets.SubmittedFileFieldName],
+	)
+}
+
+func testRequestOverSizeLimit(t *testing.T) {
+	var fieldErrors map[string][]string
+	statusCode, err := makeTestingPostTo(
+		streamingServerURL,
+		&fieldErrors,
+		helper.UploadedFile{FieldName: "files[]", FileName: "first.png", File: createPaddedPng(t, 100000)},
+		helper.UploadedFile{FieldName: "files[]", FileName: "second.png", File: createPaddedPng(t, 100000)},
+		helper.UploadedFile{FieldName: "files[]", FileName: "third.png", File: createPaddedPng(t, 100000)},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusRequestEntityTooLarge, statusCode)
+	assert.Equal(
+		t,
+		[]string{"The request is too large. Allowed maximum size is 0.25 Mb"},
+		fieldErrors[assets.SubmittedFileFieldName],
+	)
+
+	// files saved before the limit was reached are removed
+	savedFiles, err := filepath.Glob(filepath.Join(streamingAssetsPath, "*", "*.png"))
+	assert.NoError(t, err)
+	assert.Empty(t, savedFiles)
+}
+
+func testFormFieldsBeforeFiles(t *testing.T) {
+	pngImage, err := helper.CreateImage(helper.ImageSpec{Format: "png"})
+	assert.NoError(t, err)
+
+	testClient := helper.NewTestClient()
+	assert.NoError(t, testClient.AddFieldsAndFiles(
+		map[string]string{"upload_mode": assets.UploadModePartial},
+		helper.UploadedFile{FieldName: "files[]", FileName: "image.png", File: pngImage},
+		helper.UploadedFile{FieldName: "files[]", FileName: "notes.txt", File: bytes.NewBufferString("some text")},
+	))
+	validToken, err := testClient.GenerateValidToken()
+	assert.NoError(t, err)
+
+	statusCode, _, err := testClient.MakePost(validToken, streamingServerURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusMultiStatus, statusCode)
+}
+
+func testFormFieldsAfterFiles(t *testing.T) {
+	savedFilesBefore, err := filepath.Glob(filepath.Join(streamingAssetsPath, "*", "*.png"))
+	assert.NoError(t, err)
+
+	pngImage, err := helper.CreateImage(helper.ImageSpec{Format: "png"})
+	assert.NoError(t, err)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile(assets.SubmittedFileFieldName, "image.png")
+	assert.NoError(t, err)
+	_, err = io.Copy(part, pngImage)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.WriteField("upload_mode", assets.UploadModePartial))
+	assert.NoError(t, writer.Close())
+
+	testClient := helper.NewTestClient()
+	testClient.SetHeader("Content-Type", writer.FormDataContentType())
+	validToken, err := testClient.GenerateValidToken()
+	assert.NoError(t, err)
+
+	resp, respBody, err := testClient.MakeRequest(http2.MethodPost, validToken, streamingServerURL, body.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusBadRequest, resp.StatusCode)
+
+	var fieldErrors map[string][]string
+	assert.NoError(t, json.Unmarshal([]byte(respBody), &fieldErrors))
+	assert.Equal(t, []string{"Should be sent before the 'files[]' files"}, fieldErrors["upload_mode"])
+
+	// the file saved before the field is removed
+	savedFiles, err := filepath.Glob(filepath.Join(streamingAssetsPath, "*", "*.png"))
+	assert.NoError(t, err)
+	assert.Equal(t, savedFilesBefore, savedFiles)
+}
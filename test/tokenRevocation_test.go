@@ -0,0 +1,194 @@
+package test
+
+import (
+	"fmt"
+	http2 "net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/breathbath/go_utils/utils/errs"
+	"github.com/breathbath/media-library/authentication"
+	"github.com/breathbath/media-library/test/helper"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	revocationServerURL = "http://localhost:9950/images"
+	revocationListPath  = "/tmp/revocationassets/revoked.json"
+	prunedListPath      = "/tmp/revocationassets/pruned.json"
+)
+
+func TestTokenRevocation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	err := helper.PrepareFileServer(
+		"revocation",
+		"/tmp/revocationassets",
+		map[string]string{
+			"STORAGE_DRIVER":             "memory",
+			"HOST":                       ":9950",
+			"TOKEN_ISSUER":               "media-service-test",
+			"TOKEN_SECRET":               "12345678",
+			"URL_PREFIX":                 "/images",
+			"MAX_UPLOADED_FILE_MB":       "5",
+			"TOKEN_REVOCATION_LIST_PATH": revocationListPath,
+		},
+	)
+	errs.FailOnError(err)
+	defer func() {
+		helper.ShutdownFileServers()
+		errs.FailOnError(helper.SetEnvs(map[string]string{"STORAGE_DRIVER": "local"}))
+		errs.FailOnError(os.Unsetenv("TOKEN_REVOCATION_LIST_PATH"))
+	}()
+
+	t.Run("testRevokedTokenIsRejected", testRevokedTokenIsRejected)
+	t.Run("testInspectToken", testInspectToken)
+	t.Run("testExpiredRevocationsArePruned", testExpiredRevocationsArePruned)
+	t.Run("testConcurrentRevocations", testConcurrentRevocations)
+}
+
+func postRevocationImage(t *testing.T, token string) int {
+	testClient := helper.NewTestClient()
+	assert.NoError(t, testClient.AddFiles(createPngFile(t, "image.png")))
+
+	statusCode, _, err := testClient.MakePost(token, revocationServerURL)
+	assert.NoError(t, err)
+
+	return statusCode
+}
+
+func readTokenID(t *testing.T, rawToken string) string {
+	jwtManager, err := authentication.NewJwtManager()
+	assert.NoError(t, err)
+
+	token, err := jwtManager.ParseToken(rawToken)
+	assert.NoError(t, err)
+
+	id, _ := token.Claims.(jwt.MapClaims)["jti"].(string)
+	assert.NotEmpty(t, id)
+
+	return id
+}
+
+func testRevokedTokenIsRejected(t *testing.T) {
+	testClient := helper.NewTestClient()
+	revokedToken, err := testClient.GenerateValidToken()
+	assert.NoError(t, err)
+	otherToken, err := testClient.GenerateValidToken()
+	assert.NoError(t, err)
+
+	assert.Equal(t, http2.StatusOK, postRevocationImage(t, revokedToken))
+
+	revokedID := readTokenID(t, revokedToken)
+	assert.NotEqual(t, revokedID, readTokenID(t, otherToken))
+
+	revocationList := authentication.NewRevocationList(revocationListPath, 0)
+	isRevoked, err := revocationList.Revoke(revokedID, time.Now().Add(time.Hour), time.Now())
+	assert.NoError(t, err)
+	assert.True(t, isRevoked)
+
+	isRevoked, err = revocationList.Revoke(revokedID, time.Now().Add(time.Hour), time.Now())
+	assert.NoError(t, err)
+	assert.False(t, isRevoked)
+
+	// the server checks the file at most once per second
+	time.Sleep(1100 * time.Millisecond)
+	assert.Equal(t, http2.StatusUnauthorized, postRevocationImage(t, revokedToken))
+	assert.Equal(t, http2.StatusOK, postRevocationImage(t, otherToken))
+
+	revokedTokens, err := revocationList.List()
+	assert.NoError(t, err)
+	if assert.Len(t, revokedTokens, 1) {
+		assert.Equal(t, revokedID, revokedTokens[0].ID)
+	}
+}
+
+func testInspectToken(t *testing.T) {
+	jwtManager, err := authentication.NewJwtManager()
+	assert.NoError(t, err)
+
+	validToken, err := jwtManager.GenerateScopedToken(
+		"inspected",
+		authentication.TokenScope{Scopes: []string{authentication.ScopeUpload}},
+		time.Hour,
+	)
+	assert.NoError(t, err)
+
+	claims, err := jwtManager.InspectToken(validToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "inspected", claims["sub"])
+	assert.Equal(t, authentication.ScopeUpload, claims["scope"])
+
+	_, err = authentication.NewRevocationList(revocationListPath, 0).Revoke(
+		claims["jti"].(string),
+		time.Unix(int64(claims["exp"].(float64)), 0),
+		time.Now(),
+	)
+	assert.NoError(t, err)
+
+	time.Sleep(1100 * time.Millisecond)
+	claims, err = jwtManager.InspectToken(validToken)
+	assert.Equal(t, authentication.ErrTokenRevoked, err)
+	assert.Equal(t, "inspected", claims["sub"])
+
+	_, err = jwtManager.InspectToken("not a token")
+	assert.Error(t, err)
+}
+
+func testExpiredRevocationsArePruned(t *testing.T) {
+	assert.NoError(t, os.RemoveAll(prunedListPath))
+	now := time.Now()
+	revocationList := authentication.NewRevocationList(prunedListPath, time.Minute)
+
+	revocations := []struct {
+		id        string
+		expiresAt time.Time
+	}{
+		{"expired", now.Add(-2 * time.Minute)},
+		{"withinleeway", now.Add(-30 * time.Second)},
+		{"valid", now.Add(time.Hour)},
+		{"noexpiration", time.Time{}},
+	}
+	for _, revocation := range revocations {
+		isRevoked, err := revocationList.Revoke(revocation.id, revocation.expiresAt, now)
+		assert.NoError(t, err)
+		assert.True(t, isRevoked)
+	}
+
+	revokedTokens, err := revocationList.List()
+	assert.NoError(t, err)
+	revokedIDs := []string{}
+	for _, revokedToken := range revokedTokens {
+		revokedIDs = append(revokedIDs, revokedToken.ID)
+	}
+	assert.Equal(t, []string{"withinleeway", "valid", "noexpiration"}, revokedIDs)
+}
+
+func testConcurrentRevocations(t *testing.T) {
+	assert.NoError(t, os.RemoveAll(prunedListPath))
+
+	const revocationsCount = 20
+	wg := sync.WaitGroup{}
+	for i := 0; i < revocationsCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// separate lists act like separate processes, which are synchronized only by the lock file
+			_, err := authentication.NewRevocationList(prunedListPath, 0).Revoke(fmt.Sprintf("id%d", i), time.Time{}, time.Now())
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	revokedTokens, err := authentication.NewRevocationList(prunedListPath, 0).List()
+	assert.NoError(t, err)
+	assert.Len(t, revokedTokens, revocationsCount)
+
+	_, err = os.Stat(prunedListPath + ".lock")
+	assert.True(t, os.IsNotExist(err))
+}
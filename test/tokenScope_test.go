@@ -0,0 +1,171 @@
+package test
+
+import (
+	"encoding/json"
+	http2 "net/http"
+	"testing"
+
+	"github.com/breathbath/go_utils/utils/errs"
+	"github.com/breathbath/media-library/assets"
+	"github.com/breathbath/media-library/authentication"
+	"github.com/breathbath/media-library/test/helper"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+const scopeServerURL = "http://localhost:9949/images"
+
+func TestTokenScope(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	err := helper.PrepareFileServer(
+		"scope",
+		"/tmp/scopeassets",
+		map[string]string{
+			"STORAGE_DRIVER":       "memory",
+			"HOST":                 ":9949",
+			"TOKEN_ISSUER":         "media-service-test",
+			"TOKEN_SECRET":         "12345678",
+			"URL_PREFIX":           "/images",
+			"MAX_UPLOADED_FILE_MB": "5",
+		},
+	)
+	errs.FailOnError(err)
+	defer func() {
+		helper.ShutdownFileServers()
+		errs.FailOnError(helper.SetEnvs(map[string]string{"STORAGE_DRIVER": "local"}))
+	}()
+
+	t.Run("testUploadScope", testUploadScope)
+	t.Run("testDeleteScope", testDeleteScope)
+	t.Run("testAdminScope", testAdminScope)
+	t.Run("testFolderRestrictedScope", testFolderRestrictedScope)
+	t.Run("testMalformedScope", testMalformedScope)
+}
+
+func generateScopedToken(t *testing.T, scopes []string, folders []string) string {
+	token, err := helper.NewTestClient().GenerateScopedToken(authentication.TokenScope{Scopes: scopes, Folders: folders})
+	assert.NoError(t, err)
+
+	return token
+}
+
+func postWithToken(t *testing.T, token string) (int, filesResponse) {
+	testClient := helper.NewTestClient()
+	assert.NoError(t, testClient.AddFiles(createPngFile(t, "image.png")))
+
+	statusCode, body, err := testClient.MakePost(token, scopeServerURL)
+	assert.NoError(t, err)
+
+	var filesResp filesResponse
+	if statusCode == http2.StatusOK {
+		assert.NoError(t, json.Unmarshal([]byte(body), &filesResp))
+	}
+
+	return statusCode, filesResp
+}
+
+func putWithToken(t *testing.T, token, imagePath string) int {
+	resp, _, err := helper.NewTestClient().MakeRequest(
+		http2.MethodPut,
+		token,
+		scopeServerURL+"/"+imagePath,
+		createPngData(t, 10, 10),
+	)
+	assert.NoError(t, err)
+
+	return resp.StatusCode
+}
+
+func deleteWithToken(t *testing.T, token, imagePath string) int {
+	// the delete handler expects the resized images folder to exist, so a resized image is requested first
+	_, _, err := helper.NewTestClient().MakeGet(scopeServerURL + "/10x10/" + imagePath)
+	assert.NoError(t, err)
+
+	statusCode, err := helper.NewTestClient().MakeDelete(token, scopeServerURL+"/"+imagePath)
+	assert.NoError(t, err)
+
+	return statusCode
+}
+
+func testUploadScope(t *testing.T) {
+	uploadToken := generateScopedToken(t, []string{authentication.ScopeUpload}, nil)
+
+	statusCode, filesResp := postWithToken(t, uploadToken)
+	assert.Equal(t, http2.StatusOK, statusCode)
+	assert.Len(t, filesResp.FilesToReturn, 1)
+
+	assert.Equal(t, http2.StatusCreated, putWithToken(t, uploadToken, "uploads_by_scope/image.png"))
+	assert.Equal(t, http2.StatusForbidden, deleteWithToken(t, uploadToken, "uploads_by_scope/image.png"))
+}
+
+func testDeleteScope(t *testing.T) {
+	deleteToken := generateScopedToken(t, []string{authentication.ScopeDelete}, nil)
+
+	statusCode, _ := postWithToken(t, deleteToken)
+	assert.Equal(t, http2.StatusForbidden, statusCode)
+	assert.Equal(t, http2.StatusForbidden, putWithToken(t, deleteToken, "deletes_by_scope/image.png"))
+
+	resp, _, err := helper.NewTestClient().MakeRequest(http2.MethodPost, deleteToken, scopeServerURL+"/"+assets.TusUploadsPath, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusForbidden, resp.StatusCode)
+
+	adminToken, err := helper.NewTestClient().GenerateValidToken()
+	assert.NoError(t, err)
+	statusCode, filesResp := postWithToken(t, adminToken)
+	assert.Equal(t, http2.StatusOK, statusCode)
+	if assert.Len(t, filesResp.FilesToReturn, 1) {
+		assert.Equal(t, http2.StatusOK, deleteWithToken(t, deleteToken, filesResp.FilesToReturn[0]))
+	}
+}
+
+func testAdminScope(t *testing.T) {
+	adminToken := generateScopedToken(t, []string{authentication.ScopeAdmin}, nil)
+
+	statusCode, filesResp := postWithToken(t, adminToken)
+	assert.Equal(t, http2.StatusOK, statusCode)
+	if assert.Len(t, filesResp.FilesToReturn, 1) {
+		assert.Equal(t, http2.StatusOK, deleteWithToken(t, adminToken, filesResp.FilesToReturn[0]))
+	}
+}
+
+func testFolderRestrictedScope(t *testing.T) {
+	folderToken := generateScopedToken(
+		t,
+		[]string{authentication.ScopeUpload, authentication.ScopeDelete},
+		[]string{"catalog"},
+	)
+
+	assert.Equal(t, http2.StatusCreated, putWithToken(t, folderToken, "catalog_2019/image.png"))
+	assert.Equal(t, http2.StatusForbidden, putWithToken(t, folderToken, "other/image.png"))
+
+	// posted files are saved to new folders, which can't match the allowed prefixes
+	statusCode, _ := postWithToken(t, folderToken)
+	assert.Equal(t, http2.StatusForbidden, statusCode)
+
+	adminToken, err := helper.NewTestClient().GenerateValidToken()
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusCreated, putWithToken(t, adminToken, "other/image.png"))
+
+	assert.Equal(t, http2.StatusForbidden, deleteWithToken(t, folderToken, "other/image.png"))
+	assert.Equal(t, http2.StatusOK, deleteWithToken(t, folderToken, "catalog_2019/image.png"))
+}
+
+func testMalformedScope(t *testing.T) {
+	malformedClaims := []jwt.MapClaims{
+		{"scope": []string{authentication.ScopeUpload}},
+		{"scope": ""},
+		{"scope": authentication.ScopeUpload, "folders": "malformed"},
+		{"scope": authentication.ScopeUpload, "folders": []string{""}},
+		{"folders": []string{}},
+	}
+
+	for _, claims := range malformedClaims {
+		token := signValidationToken(t, claims)
+		assert.Equal(t, http2.StatusForbidden, putWithToken(t, token, "malformed/image.png"), "claims %v", claims)
+	}
+
+	assert.Equal(t, http2.StatusCreated, putWithToken(t, signValidationToken(t, nil), "malformed/image.png"))
+}
@@ -0,0 +1,224 @@
+package test
+
+import (
+	"encoding/json"
+	http2 "net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/breathbath/go_utils/utils/errs"
+	"github.com/breathbath/media-library/test/helper"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+const validationServerURL = "http://localhost:9952/images"
+
+func TestTokenValidation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	err := helper.PrepareFileServer(
+		"validation",
+		"/tmp/validationassets",
+		map[string]string{
+			"STORAGE_DRIVER":       "memory",
+			"HOST":                 ":9952",
+			"TOKEN_ISSUER":         "media-service-test",
+			"TOKEN_SECRET":         "12345678",
+			"TOKEN_LEEWAY_SECONDS": "60",
+			"URL_PREFIX":           "/images",
+			"MAX_UPLOADED_FILE_MB": "5",
+		},
+	)
+	errs.FailOnError(err)
+	defer func() {
+		helper.ShutdownFileServers()
+		errs.FailOnError(helper.SetEnvs(map[string]string{"STORAGE_DRIVER": "local"}))
+		errs.FailOnError(os.Unsetenv("TOKEN_LEEWAY_SECONDS"))
+	}()
+
+	t.Run("testTokenAudience", testTokenAudience)
+	t.Run("testTokenIssuer", testTokenIssuer)
+	t.Run("testTokenLeeway", testTokenLeeway)
+	t.Run("testTokenWithoutExpiration", testTokenWithoutExpiration)
+	t.Run("testMalformedToken", testMalformedToken)
+	t.Run("testTokenWithoutBearerPrefix", testTokenWithoutBearerPrefix)
+	t.Run("testInsufficientScope", testInsufficientScope)
+	t.Run("testPublicRoutesIgnoreRejectedTokens", testPublicRoutesIgnoreRejectedTokens)
+}
+
+func signValidationToken(t *testing.T, claims jwt.MapClaims) string {
+	defaultClaims := jwt.MapClaims{
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+		"sub": "test",
+		"iss": "media-service-test",
+		"aud": "media_service",
+	}
+	for name, value := range claims {
+		if value == nil {
+			delete(defaultClaims, name)
+			continue
+		}
+		defaultClaims[name] = value
+	}
+
+	rawToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, defaultClaims).SignedString([]byte("12345678"))
+	assert.NoError(t, err)
+
+	return rawToken
+}
+
+func postValidationImage(t *testing.T, authorization string) int {
+	testClient := helper.NewTestClient()
+	assert.NoError(t, testClient.AddFiles(createPngFile(t, "image.png")))
+	if authorization != "" {
+		testClient.SetHeader("Authorization", authorization)
+	}
+
+	statusCode, _, err := testClient.MakePost("", validationServerURL)
+	assert.NoError(t, err)
+
+	return statusCode
+}
+
+// assertTokenRejected checks the response of the auth handler, so the request has no files
+func assertTokenRejected(t *testing.T, authorization, expectedAuthenticate string) {
+	testClient := helper.NewTestClient()
+	if authorization != "" {
+		testClient.SetHeader("Authorization", authorization)
+	}
+
+	resp, _, err := testClient.MakeRequest(http2.MethodPost, "", validationServerURL, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, expectedAuthenticate, resp.Header.Get("WWW-Authenticate"))
+}
+
+func testTokenAudience(t *testing.T) {
+	assert.Equal(t, http2.StatusOK, postValidationImage(t, "Bearer "+signValidationToken(t, nil)))
+
+	multipleAudiences := jwt.MapClaims{"aud": []string{"other", "media_service"}}
+	assert.Equal(t, http2.StatusOK, postValidationImage(t, "Bearer "+signValidationToken(t, multipleAudiences)))
+
+	const audienceRejection = `Bearer realm="media", error="invalid_token", error_description="token is issued for another audience"`
+	assertTokenRejected(t, "Bearer "+signValidationToken(t, jwt.MapClaims{"aud": "media_service_upload"}), audienceRejection)
+	assertTokenRejected(t, "Bearer "+signValidationToken(t, jwt.MapClaims{"aud": nil}), audienceRejection)
+}
+
+func testTokenIssuer(t *testing.T) {
+	const issuerRejection = `Bearer realm="media", error="invalid_token", error_description="token is issued by another issuer"`
+	assertTokenRejected(t, "Bearer "+signValidationToken(t, jwt.MapClaims{"iss": 123}), issuerRejection)
+	assertTokenRejected(t, "Bearer "+signValidationToken(t, jwt.MapClaims{"iss": nil}), issuerRejection)
+	assertTokenRejected(t, "Bearer "+signValidationToken(t, jwt.MapClaims{"iss": "other"}), issuerRejection)
+}
+
+func testTokenLeeway(t *testing.T) {
+	now := time.Now()
+
+	statusCode := postValidationImage(t, "Bearer "+signValidationToken(t, jwt.MapClaims{
+		"exp": now.Add(-30 * time.Second).Unix(),
+	}))
+	assert.Equal(t, http2.StatusOK, statusCode)
+
+	statusCode = postValidationImage(t, "Bearer "+signValidationToken(t, jwt.MapClaims{
+		"iat": now.Add(30 * time.Second).Unix(),
+		"nbf": now.Add(30 * time.Second).Unix(),
+	}))
+	assert.Equal(t, http2.StatusOK, statusCode)
+
+	assertTokenRejected(
+		t,
+		"Bearer "+signValidationToken(t, jwt.MapClaims{"exp": now.Add(-2 * time.Minute).Unix()}),
+		`Bearer realm="media", error="invalid_token", error_description="token is expired"`,
+	)
+	assertTokenRejected(
+		t,
+		"Bearer "+signValidationToken(t, jwt.MapClaims{"nbf": now.Add(2 * time.Minute).Unix()}),
+		`Bearer realm="media", error="invalid_token", error_description="token is not valid yet"`,
+	)
+}
+
+func testTokenWithoutExpiration(t *testing.T) {
+	assertTokenRejected(
+		t,
+		"Bearer "+signValidationToken(t, jwt.MapClaims{"exp": nil}),
+		`Bearer realm="media", error="invalid_token", error_description="token has no expiration time"`,
+	)
+}
+
+func testMalformedToken(t *testing.T) {
+	assertTokenRejected(
+		t,
+		"Bearer not-a-token",
+		`Bearer realm="media", error="invalid_token", error_description="token contains an invalid number of segments"`,
+	)
+	assertTokenRejected(t, "Basic dXNlcjpwYXNzd29yZA==", `Bearer realm="media"`)
+	assertTokenRejected(t, "", `Bearer realm="media"`)
+
+	wrongSecretToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss": "media-service-test",
+		"aud": "media_service",
+	}).SignedString([]byte("87654321"))
+	assert.NoError(t, err)
+	assertTokenRejected(
+		t,
+		"Bearer "+wrongSecretToken,
+		`Bearer realm="media", error="invalid_token", error_description="signature is invalid"`,
+	)
+}
+
+// testTokenWithoutBearerPrefix accepts bare tokens, which clients could send before the Bearer scheme was checked
+func testTokenWithoutBearerPrefix(t *testing.T) {
+	assert.Equal(t, http2.StatusOK, postValidationImage(t, signValidationToken(t, nil)))
+
+	assertTokenRejected(
+		t,
+		signValidationToken(t, jwt.MapClaims{"aud": "other"}),
+		`Bearer realm="media", error="invalid_token", error_description="token is issued for another audience"`,
+	)
+}
+
+func testInsufficientScope(t *testing.T) {
+	testClient := helper.NewTestClient()
+	resp, _, err := testClient.MakeRequest(
+		http2.MethodPost,
+		signValidationToken(t, jwt.MapClaims{"scope": "delete"}),
+		validationServerURL,
+		nil,
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, `Bearer realm="media", error="insufficient_scope"`, resp.Header.Get("WWW-Authenticate"))
+}
+
+func testPublicRoutesIgnoreRejectedTokens(t *testing.T) {
+	testClient := helper.NewTestClient()
+	assert.NoError(t, testClient.AddFiles(createPngFile(t, "image.png")))
+	statusCode, body, err := testClient.MakePost(signValidationToken(t, nil), validationServerURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusOK, statusCode)
+
+	var filesResp filesResponse
+	assert.NoError(t, json.Unmarshal([]byte(body), &filesResp))
+	if !assert.Len(t, filesResp.FilesToReturn, 1) {
+		return
+	}
+
+	authorizations := []string{
+		"Basic dXNlcjpwYXNzd29yZA==",
+		"Bearer not-a-token",
+		"Bearer " + signValidationToken(t, jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}),
+		"Bearer " + signValidationToken(t, jwt.MapClaims{"aud": "other"}),
+	}
+	for _, authorization := range authorizations {
+		getClient := helper.NewTestClient()
+		getClient.SetHeader("Authorization", authorization)
+		resp, _, err := getClient.MakeRequest(http2.MethodGet, "", validationServerURL+"/"+filesResp.FilesToReturn[0], nil)
+		assert.NoError(t, err)
+		assert.Equal(t, http2.StatusOK, resp.StatusCode, authorization)
+	}
+}
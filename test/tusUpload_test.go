@@ -0,0 +1,413 @@
+package test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	goio "io"
+	"io/ioutil"
+	http2 "net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/breathbath/go_utils/utils/errs"
+	"github.com/breathbath/media-library/assets"
+	"github.com/breathbath/media-library/test/helper"
+	"github.com/stretchr/testify/assert"
+)
+
+const tusServerURL = "http://localhost:9944/images"
+const tusUploadsURL = tusServerURL + "/uploads"
+const tusStagingPath = "/tmp/tusassets/staging"
+
+// expiredTusUploadID is an upload created before the server start, which should be removed without new uploads
+const expiredTusUploadID = "0123456789abcdef0123456789abcde0"
+
+func TestTusUpload(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	errs.FailOnError(os.MkdirAll(tusStagingPath, os.ModePerm))
+	errs.FailOnError(ioutil.WriteFile(
+		filepath.Join(tusStagingPath, expiredTusUploadID+".json"),
+		[]byte(`{"id": "`+expiredTusUploadID+`", "length": 10, "created": "2019-08-05T16:35:40Z"}`),
+		0600,
+	))
+	errs.FailOnError(ioutil.WriteFile(filepath.Join(tusStagingPath, expiredTusUploadID+".bin"), []byte("12345"), 0600))
+
+	err := helper.PrepareFileServer(
+		"tus",
+		"/tmp/tusassets",
+		map[string]string{
+			"STORAGE_DRIVER":       "memory",
+			"HOST":                 ":9944",
+			"TOKEN_ISSUER":         "media-service-test",
+			"TOKEN_SECRET":         "12345678",
+			"URL_PREFIX":           "/images",
+			"MAX_UPLOADED_FILE_MB": "0.1",
+			"TUS_STAGING_PATH":     tusStagingPath,
+			"UPLOAD_URL_SECRET":    "87654321",
+		},
+	)
+	errs.FailOnError(err)
+	defer func() {
+		helper.ShutdownFileServers()
+		errs.FailOnError(helper.SetEnvs(map[string]string{"STORAGE_DRIVER": "local"}))
+		errs.FailOnError(os.Unsetenv("TUS_STAGING_PATH"))
+		errs.FailOnError(os.Unsetenv("UPLOAD_URL_SECRET"))
+	}()
+
+	t.Run("testTusOptions", testTusOptions)
+	t.Run("testTusResumedUpload", testTusResumedUpload)
+	t.Run("testTusInvalidImage", testTusInvalidImage)
+	t.Run("testTusUploadSettings", testTusUploadSettings)
+	t.Run("testTusUploadURL", testTusUploadURL)
+	t.Run("testTusRejectedRequests", testTusRejectedRequests)
+	t.Run("testTusTermination", testTusTermination)
+	t.Run("testTusExpiredUploadRemoval", testTusExpiredUploadRemoval)
+	t.Run("testTusUploadLock", testTusUploadLock)
+}
+
+// makeTusRequest sends a tus request with the protocol version header and a valid token
+func makeTusRequest(t *testing.T, method, url string, headers map[string]string, body []byte) (*http2.Response, string) {
+	validToken, err := helper.NewTestClient().GenerateValidToken()
+	assert.NoError(t, err)
+
+	return makeTusRequestWithToken(t, method, url, validToken, headers, body)
+}
+
+// makeTusRequestWithToken sends a tus request with the protocol version header, an empty token can be used with upload urls
+func makeTusRequestWithToken(
+	t *testing.T,
+	method, url, token string,
+	headers map[string]string,
+	body []byte,
+) (*http2.Response, string) {
+	testClient := helper.NewTestClient()
+	testClient.SetHeader("Tus-Resumable", assets.TusVersion)
+	for key, value := range headers {
+		testClient.SetHeader(key, value)
+	}
+
+	resp, respBody, err := testClient.MakeRequest(method, token, url, body)
+	errs.FailOnError(err)
+
+	return resp, respBody
+}
+
+func buildTusCreationHeaders(length int, fileName string) map[string]string {
+	return map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte(fileName)) + ",filetype",
+	}
+}
+
+func createTusUpload(t *testing.T, length int, fileName string) string {
+	return createTusUploadWithQuery(t, "", length, fileName)
+}
+
+func createTusUploadWithQuery(t *testing.T, query string, length int, fileName string) string {
+	resp, _ := makeTusRequest(t, http2.MethodPost, tusUploadsURL+query, buildTusCreationHeaders(length, fileName), nil)
+	assert.Equal(t, http2.StatusCreated, resp.StatusCode)
+	assert.Regexp(t, `^`+tusUploadsURL+`/[0-9a-f]{32}$`, resp.Header.Get("Location"))
+	assert.NotEmpty(t, resp.Header.Get("Upload-Expires"))
+
+	return resp.Header.Get("Location")
+}
+
+func createTusPngData(t *testing.T, width, height int) []byte {
+	pngImage, err := helper.CreateImage(helper.ImageSpec{Format: "png", Width: width, Height: height})
+	assert.NoError(t, err)
+	pngData, err := ioutil.ReadAll(pngImage)
+	assert.NoError(t, err)
+
+	return pngData
+}
+
+func patchTusUpload(t *testing.T, uploadURL string, offset int, chunk []byte) (*http2.Response, string) {
+	return makeTusRequest(t, http2.MethodPatch, uploadURL, map[string]string{
+		"Content-Type":  assets.TusOffsetMimeType,
+		"Upload-Offset": strconv.Itoa(offset),
+	}, chunk)
+}
+
+func testTusOptions(t *testing.T) {
+	resp, _, err := helper.NewTestClient().MakeRequest(http2.MethodOptions, "", tusUploadsURL, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, assets.TusVersion, resp.Header.Get("Tus-Version"))
+	assert.Equal(t, assets.TusExtensions, resp.Header.Get("Tus-Extension"))
+	assert.Equal(t, "104857", resp.Header.Get("Tus-Max-Size"))
+}
+
+func testTusResumedUpload(t *testing.T) {
+	pngImage, err := helper.CreateImage(helper.ImageSpec{Format: "png", Width: 200, Height: 100})
+	assert.NoError(t, err)
+	pngData, err := ioutil.ReadAll(pngImage)
+	assert.NoError(t, err)
+	half := len(pngData) / 2
+
+	uploadURL := createTusUpload(t, len(pngData), "field photo.png")
+
+	resp, _ := patchTusUpload(t, uploadURL, 0, pngData[:half])
+	assert.Equal(t, http2.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, strconv.Itoa(half), resp.Header.Get("Upload-Offset"))
+	assert.Empty(t, resp.Header.Get(assets.ImagePathHeader))
+
+	// the chunk is sent again, e.g. after a lost response
+	resp, _ = patchTusUpload(t, uploadURL, 0, pngData[:half])
+	assert.Equal(t, http2.StatusConflict, resp.StatusCode)
+
+	resp, _ = makeTusRequest(t, http2.MethodHead, uploadURL, nil, nil)
+	assert.Equal(t, http2.StatusOK, resp.StatusCode)
+	assert.Equal(t, strconv.Itoa(half), resp.Header.Get("Upload-Offset"))
+	assert.Equal(t, strconv.Itoa(len(pngData)), resp.Header.Get("Upload-Length"))
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+
+	resp, body := patchTusUpload(t, uploadURL, half, pngData[half:])
+	assert.Equal(t, http2.StatusOK, resp.StatusCode)
+	assert.Equal(t, strconv.Itoa(len(pngData)), resp.Header.Get("Upload-Offset"))
+	imagePath := resp.Header.Get(assets.ImagePathHeader)
+	assert.Regexp(t, `^\w+/field_photo\.png$`, imagePath)
+
+	var filesResp filesResponse
+	assert.NoError(t, json.Unmarshal([]byte(body), &filesResp))
+	assert.Equal(t, []string{imagePath}, filesResp.FilesToReturn)
+
+	resp, _ = makeTusRequest(t, http2.MethodHead, uploadURL, nil, nil)
+	assert.Equal(t, http2.StatusOK, resp.StatusCode)
+	assert.Equal(t, imagePath, resp.Header.Get(assets.ImagePathHeader))
+
+	statusCode, _, err := helper.NewTestClient().MakeGet(tusServerURL + "/" + imagePath)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusOK, statusCode)
+}
+
+func testTusInvalidImage(t *testing.T) {
+	textData := []byte("some text")
+	uploadURL := createTusUpload(t, len(textData), "notes.txt")
+
+	resp, body := patchTusUpload(t, uploadURL, 0, textData)
+	assert.Equal(t, http2.StatusBadRequest, resp.StatusCode)
+
+	var validationErrors map[string][]string
+	assert.NoError(t, json.Unmarshal([]byte(body), &validationErrors))
+	assert.Len(t, validationErrors[assets.TusUploadFieldName], 1)
+
+	resp, _ = makeTusRequest(t, http2.MethodHead, uploadURL, nil, nil)
+	assert.Equal(t, http2.StatusNotFound, resp.StatusCode)
+}
+
+// testTusUploadSettings applies the upload mode and rules of the creation request on completion
+func testTusUploadSettings(t *testing.T) {
+	resp, body := makeTusRequest(t, http2.MethodPost, tusUploadsURL+"?max_width=abc", buildTusCreationHeaders(10, "image.png"), nil)
+	assert.Equal(t, http2.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, body, "max_width")
+
+	pngData := createTusPngData(t, 200, 100)
+
+	uploadURL := createTusUploadWithQuery(t, "?max_width=100", len(pngData), "wide.png")
+	resp, body = patchTusUpload(t, uploadURL, 0, pngData)
+	assert.Equal(t, http2.StatusBadRequest, resp.StatusCode)
+	var validationErrors map[string][]string
+	assert.NoError(t, json.Unmarshal([]byte(body), &validationErrors))
+	assert.Len(t, validationErrors[assets.TusUploadFieldName], 1)
+
+	uploadURL = createTusUploadWithQuery(t, "?version=2", len(pngData), "photo.png")
+	resp, body = patchTusUpload(t, uploadURL, 0, pngData)
+	assert.Equal(t, http2.StatusOK, resp.StatusCode)
+	var filesResp struct {
+		Files []assets.UploadedImage `json:"files"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &filesResp))
+	if assert.Len(t, filesResp.Files, 1) {
+		assert.Equal(t, resp.Header.Get(assets.ImagePathHeader), filesResp.Files[0].Path)
+		assert.Equal(t, tusServerURL+"/"+filesResp.Files[0].Path, filesResp.Files[0].URL)
+	}
+
+	uploadURL = createTusUploadWithQuery(t, "?upload_mode=partial", len(pngData), "partial.png")
+	resp, body = patchTusUpload(t, uploadURL, 0, pngData)
+	assert.Equal(t, http2.StatusMultiStatus, resp.StatusCode)
+	var partialResp struct {
+		Files []assets.UploadFileStatus `json:"files"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &partialResp))
+	if assert.Len(t, partialResp.Files, 1) {
+		assert.Equal(t, assets.UploadStatusSaved, partialResp.Files[0].Status)
+	}
+}
+
+// testTusUploadURL authorizes the upload with a presigned upload url, which is used up on completion
+func testTusUploadURL(t *testing.T) {
+	testClient := helper.NewTestClient()
+	testClient.SetHeader("Content-Type", "application/json")
+	validToken, err := testClient.GenerateValidToken()
+	assert.NoError(t, err)
+	resp, body, err := testClient.MakeRequest(
+		http2.MethodPost,
+		validToken,
+		tusServerURL+"/"+assets.UploadURLsPath,
+		[]byte(`{"max_size_mb": 0.05, "formats": ["png"]}`),
+	)
+	assert.NoError(t, err)
+	if !assert.Equal(t, http2.StatusOK, resp.StatusCode) {
+		return
+	}
+	var uploadURLResp assets.UploadURLResponse
+	assert.NoError(t, json.Unmarshal([]byte(body), &uploadURLResp))
+	creationURL := tusUploadsURL + "?" + url.Values{assets.UploadTokenQueryParam: {uploadURLResp.UploadToken}}.Encode()
+
+	resp, _ = makeTusRequestWithToken(t, http2.MethodPost, creationURL, "", buildTusCreationHeaders(60000, "large.png"), nil)
+	assert.Equal(t, http2.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	// uploads of others can't be accessed with the upload url
+	otherUploadURL := createTusUpload(t, 10, "other.png")
+	resp, _ = makeTusRequestWithToken(
+		t,
+		http2.MethodHead,
+		otherUploadURL+"?"+url.Values{assets.UploadTokenQueryParam: {uploadURLResp.UploadToken}}.Encode(),
+		"",
+		nil,
+		nil,
+	)
+	assert.Equal(t, http2.StatusNotFound, resp.StatusCode)
+
+	pngData := createTusPngData(t, 20, 10)
+	uploadURLs := make([]string, 2)
+	for i := range uploadURLs {
+		resp, _ = makeTusRequestWithToken(t, http2.MethodPost, creationURL, "", buildTusCreationHeaders(len(pngData), "photo.png"), nil)
+		assert.Equal(t, http2.StatusCreated, resp.StatusCode)
+		uploadURLs[i] = resp.Header.Get("Location")
+		assert.Contains(t, uploadURLs[i], assets.UploadTokenQueryParam+"=")
+	}
+
+	patchHeaders := map[string]string{"Content-Type": assets.TusOffsetMimeType, "Upload-Offset": "0"}
+	resp, body = makeTusRequestWithToken(t, http2.MethodPatch, uploadURLs[0], "", patchHeaders, pngData)
+	assert.Equal(t, http2.StatusOK, resp.StatusCode)
+	var filesResp filesResponse
+	assert.NoError(t, json.Unmarshal([]byte(body), &filesResp))
+	assert.Len(t, filesResp.FilesToReturn, 1)
+
+	// the upload url is single-use, so the second upload is rejected on completion
+	resp, _ = makeTusRequestWithToken(t, http2.MethodPatch, uploadURLs[1], "", patchHeaders, pngData)
+	assert.Equal(t, http2.StatusForbidden, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get(assets.ImagePathHeader))
+}
+
+func testTusRejectedRequests(t *testing.T) {
+	resp, _, err := helper.NewTestClient().MakeRequest(http2.MethodPost, "", tusUploadsURL, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusUnauthorized, resp.StatusCode)
+
+	resp, _ = makeTusRequest(t, http2.MethodPost, tusUploadsURL, map[string]string{
+		"Tus-Resumable": "0.2.2",
+		"Upload-Length": "100",
+	}, nil)
+	assert.Equal(t, http2.StatusPreconditionFailed, resp.StatusCode)
+	assert.Equal(t, assets.TusVersion, resp.Header.Get("Tus-Version"))
+
+	resp, _ = makeTusRequest(t, http2.MethodPost, tusUploadsURL, map[string]string{"Upload-Length": "200000"}, nil)
+	assert.Equal(t, http2.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	uploadURL := createTusUpload(t, 10, "image.png")
+	resp, _ = makeTusRequest(t, http2.MethodPatch, uploadURL, map[string]string{
+		"Content-Type":  "application/octet-stream",
+		"Upload-Offset": "0",
+	}, []byte("12345"))
+	assert.Equal(t, http2.StatusUnsupportedMediaType, resp.StatusCode)
+
+	resp, _ = patchTusUpload(t, uploadURL, 0, []byte("12345678901"))
+	assert.Equal(t, http2.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	resp, _ = makeTusRequest(t, http2.MethodHead, tusUploadsURL+"/0123456789abcdef0123456789abcdef", nil, nil)
+	assert.Equal(t, http2.StatusNotFound, resp.StatusCode)
+}
+
+func testTusTermination(t *testing.T) {
+	uploadURL := createTusUpload(t, 10, "image.png")
+
+	resp, _ := makeTusRequest(t, http2.MethodDelete, uploadURL, nil, nil)
+	assert.Equal(t, http2.StatusNoContent, resp.StatusCode)
+
+	resp, _ = makeTusRequest(t, http2.MethodHead, uploadURL, nil, nil)
+	assert.Equal(t, http2.StatusNotFound, resp.StatusCode)
+}
+
+func testTusExpiredUploadRemoval(t *testing.T) {
+	// the removal runs in background after the start
+	isRemoved := waitFor(func() bool {
+		_, infoErr := os.Stat(filepath.Join(tusStagingPath, expiredTusUploadID+".json"))
+		_, dataErr := os.Stat(filepath.Join(tusStagingPath, expiredTusUploadID+".bin"))
+		return os.IsNotExist(infoErr) && os.IsNotExist(dataErr)
+	})
+	assert.True(t, isRemoved, "the expired upload is not removed")
+}
+
+// testTusUploadLock checks that the upload isn't read or removed while a chunk is being written
+func testTusUploadLock(t *testing.T) {
+	uploadURL := createTusUpload(t, 10, "image.png")
+
+	validToken, err := helper.NewTestClient().GenerateValidToken()
+	assert.NoError(t, err)
+
+	chunkReader, chunkWriter := goio.Pipe()
+	req, err := http2.NewRequest(http2.MethodPatch, uploadURL, chunkReader)
+	assert.NoError(t, err)
+	req.ContentLength = 10
+	req.Header.Set("Authorization", "Bearer "+validToken)
+	req.Header.Set("Tus-Resumable", assets.TusVersion)
+	req.Header.Set("Content-Type", assets.TusOffsetMimeType)
+	req.Header.Set("Upload-Offset", "0")
+
+	patchDone := make(chan struct{})
+	go func() {
+		defer close(patchDone)
+		resp, e := http2.DefaultClient.Do(req)
+		if e == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+
+	_, err = chunkWriter.Write([]byte("12345"))
+	assert.NoError(t, err)
+
+	isLocked := waitFor(func() bool {
+		resp, _ := makeTusRequest(t, http2.MethodHead, uploadURL, nil, nil)
+		return resp.StatusCode == http2.StatusConflict
+	})
+	assert.True(t, isLocked, "the upload is not locked while the chunk is written")
+
+	resp, _ := makeTusRequest(t, http2.MethodDelete, uploadURL, nil, nil)
+	assert.Equal(t, http2.StatusConflict, resp.StatusCode)
+
+	// the connection drops, the received bytes are kept
+	assert.NoError(t, chunkWriter.CloseWithError(goio.ErrUnexpectedEOF))
+	<-patchDone
+
+	isUnlocked := waitFor(func() bool {
+		resp, _ = makeTusRequest(t, http2.MethodHead, uploadURL, nil, nil)
+		return resp.StatusCode == http2.StatusOK
+	})
+	assert.True(t, isUnlocked, "the upload is not unlocked after the dropped connection")
+	assert.Equal(t, "5", resp.Header.Get("Upload-Offset"))
+
+	resp, _ = makeTusRequest(t, http2.MethodDelete, uploadURL, nil, nil)
+	assert.Equal(t, http2.StatusNoContent, resp.StatusCode)
+}
+
+// waitFor checks the condition until it's met or a second passes
+func waitFor(condition func() bool) bool {
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return true
+}
@@ -0,0 +1,101 @@
+package test
+
+import (
+	"bytes"
+	"image"
+	http2 "net/http"
+	"os"
+	"testing"
+
+	"github.com/breathbath/go_utils/utils/errs"
+	"github.com/breathbath/media-library/test/helper"
+	"github.com/stretchr/testify/assert"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+)
+
+const formatsServerURL = "http://localhost:9932/images"
+const normalizedServerURL = "http://localhost:9933/images"
+
+func TestUploadFormats(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	envs := map[string]string{
+		"STORAGE_DRIVER":       "memory",
+		"HOST":                 ":9932",
+		"TOKEN_ISSUER":         "media-service-test",
+		"TOKEN_SECRET":         "12345678",
+		"URL_PREFIX":           "/images",
+		"MAX_UPLOADED_FILE_MB": "0.1",
+	}
+	err := helper.PrepareFileServer("formats", "/tmp/formatsassets", envs)
+	errs.FailOnError(err)
+
+	envs["HOST"] = ":9933"
+	envs["UPLOAD_NORMALIZE_FORMAT"] = "jpg"
+	err = helper.PrepareFileServer("normalized", "/tmp/normalizedassets", envs)
+	errs.FailOnError(err)
+
+	defer func() {
+		helper.ShutdownFileServers()
+		errs.FailOnError(helper.SetEnvs(map[string]string{"STORAGE_DRIVER": "local"}))
+		errs.FailOnError(os.Unsetenv("UPLOAD_NORMALIZE_FORMAT"))
+	}()
+
+	testCases := []struct {
+		serverURL        string
+		format           string
+		fileName         string
+		expectedFileName string
+		expectedFormat   string
+	}{
+		{formatsServerURL, "webp", "screenshot.webp", "screenshot.webp", "webp"},
+		{formatsServerURL, "bmp", "drawing.bmp", "drawing.bmp", "bmp"},
+		{formatsServerURL, "tiff", "export.tiff", "export.tiff", "tiff"},
+		{formatsServerURL, "tiff", "export", "export.tiff", "tiff"},
+		{normalizedServerURL, "webp", "screenshot.webp", "screenshot.jpg", "jpeg"},
+		{normalizedServerURL, "tiff", "export.tif", "export.jpg", "jpeg"},
+		{normalizedServerURL, "jpg", "photo.jpeg", "photo.jpeg", "jpeg"},
+		{normalizedServerURL, "png", "logo.png", "logo.jpg", "jpeg"},
+	}
+
+	testClient := helper.NewTestClient()
+	for _, testCase := range testCases {
+		img, err := helper.CreateImage(helper.ImageSpec{Format: testCase.format, Width: 200, Height: 100})
+		assert.NoError(t, err)
+
+		var filesResp filesResponse
+		statusCode, err := makeTestingPostTo(
+			testCase.serverURL,
+			&filesResp,
+			helper.UploadedFile{FieldName: "files[]", FileName: testCase.fileName, File: img},
+		)
+		assert.NoError(t, err, testCase.fileName)
+		assert.Equal(t, http2.StatusOK, statusCode, testCase.fileName)
+		if !assert.Len(t, filesResp.FilesToReturn, 1, testCase.fileName) {
+			continue
+		}
+		imagePath := filesResp.FilesToReturn[0]
+		assert.Regexp(t, `^\w+/`+testCase.expectedFileName+`$`, imagePath)
+
+		statusCode, body, err := testClient.MakeGet(testCase.serverURL + "/" + imagePath)
+		assert.NoError(t, err, testCase.fileName)
+		assert.Equal(t, http2.StatusOK, statusCode, testCase.fileName)
+
+		imgConfig, format, err := image.DecodeConfig(bytes.NewBufferString(body))
+		assert.NoError(t, err, testCase.fileName)
+		assert.Equal(t, testCase.expectedFormat, format, testCase.fileName)
+		assert.Equal(t, 200, imgConfig.Width, testCase.fileName)
+
+		statusCode, body, err = testClient.MakeGet(testCase.serverURL + "/x50/" + imagePath)
+		assert.NoError(t, err, testCase.fileName)
+		assert.Equal(t, http2.StatusOK, statusCode, testCase.fileName)
+
+		imgConfig, format, err = image.DecodeConfig(bytes.NewBufferString(body))
+		assert.NoError(t, err, testCase.fileName)
+		assert.Equal(t, testCase.expectedFormat, format, testCase.fileName)
+		assert.Equal(t, 100, imgConfig.Width, testCase.fileName)
+	}
+}
@@ -0,0 +1,120 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	http2 "net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/breathbath/go_utils/utils/errs"
+	"github.com/breathbath/media-library/assets"
+	"github.com/breathbath/media-library/test/helper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadMetadata(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	envs := map[string]string{
+		"STORAGE_DRIVER":       "memory",
+		"TOKEN_ISSUER":         "media-service-test",
+		"TOKEN_SECRET":         "12345678",
+		"URL_PREFIX":           "/images",
+		"MAX_UPLOADED_FILE_MB": "0.1",
+	}
+	serverURLs := map[string]string{}
+	policyPorts := []struct {
+		policy string
+		port   string
+	}{
+		{"strip", "9935"},
+		{"keep", "9936"},
+		{"strip_gps", "9937"},
+	}
+	for _, policyPort := range policyPorts {
+		envs["HOST"] = ":" + policyPort.port
+		envs["UPLOAD_METADATA_POLICY"] = policyPort.policy
+		err := helper.PrepareFileServer(policyPort.policy, "/tmp/metadata"+policyPort.port, envs)
+		errs.FailOnError(err)
+		serverURLs[policyPort.policy] = "http://localhost:" + policyPort.port + "/images"
+	}
+
+	defer func() {
+		helper.ShutdownFileServers()
+		errs.FailOnError(helper.SetEnvs(map[string]string{"STORAGE_DRIVER": "local"}))
+		errs.FailOnError(os.Unsetenv("UPLOAD_METADATA_POLICY"))
+	}()
+
+	testCases := []struct {
+		policy         string
+		fileName       string
+		expectExif     bool
+		expectGPS      bool
+		orientation    uint16
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{"strip", "photo.jpg", false, false, 1, 200, 100},
+		// rotated by 90 degrees
+		{"strip", "photo.jpg", false, false, 6, 100, 200},
+		{"keep", "photo.jpg", true, true, 6, 100, 200},
+		{"strip_gps", "photo.jpg", true, false, 8, 100, 200},
+		// extensions of phone photos are uppercase
+		{"strip", "IMG_1234.JPG", false, false, 6, 100, 200},
+		{"strip_gps", "IMG_1234.JPG", true, false, 6, 100, 200},
+	}
+
+	testClient := helper.NewTestClient()
+	for _, testCase := range testCases {
+		jpegImage, err := helper.CreateJpegWithExif(200, 100, testCase.orientation)
+		assert.NoError(t, err)
+
+		var filesResp filesResponse
+		statusCode, err := makeTestingPostTo(
+			serverURLs[testCase.policy],
+			&filesResp,
+			helper.UploadedFile{FieldName: "files[]", FileName: testCase.fileName, File: jpegImage},
+		)
+		assert.NoError(t, err, testCase.policy)
+		assert.Equal(t, http2.StatusOK, statusCode, testCase.policy)
+		if !assert.Len(t, filesResp.FilesToReturn, 1, testCase.policy) {
+			continue
+		}
+		assert.Equal(t, ".jpg", filepath.Ext(filesResp.FilesToReturn[0]), testCase.policy)
+
+		statusCode, body, err := testClient.MakeGet(serverURLs[testCase.policy] + "/" + filesResp.FilesToReturn[0])
+		assert.NoError(t, err, testCase.policy)
+		assert.Equal(t, http2.StatusOK, statusCode, testCase.policy)
+
+		imgConfig, _, err := image.DecodeConfig(bytes.NewBufferString(body))
+		assert.NoError(t, err, testCase.policy)
+		assert.Equal(t, testCase.expectedWidth, imgConfig.Width, testCase.policy)
+		assert.Equal(t, testCase.expectedHeight, imgConfig.Height, testCase.policy)
+
+		statusCode, metaBody, err := testClient.MakeGet(serverURLs[testCase.policy] + "/" + filesResp.FilesToReturn[0] + "/meta")
+		assert.NoError(t, err, testCase.policy)
+		assert.Equal(t, http2.StatusOK, statusCode, testCase.policy)
+
+		var imageMeta assets.ImageMeta
+		assert.NoError(t, json.Unmarshal([]byte(metaBody), &imageMeta), testCase.policy)
+		if !testCase.expectExif {
+			assert.Empty(t, imageMeta.Exif, testCase.policy)
+			assert.NotContains(t, body, "Exif\x00\x00", testCase.policy)
+			continue
+		}
+		assert.Equal(t, map[string]string{"make": "TestCam", "f_number": "28/10", "orientation": "1"}, imageMeta.Exif, testCase.policy)
+
+		// the gps values are wiped, not only unlinked
+		const gpsLatitude = "4\x00\x00\x00\x01\x00\x00\x00\x1f\x00\x00\x00\x01\x00\x00\x00"
+		if testCase.expectGPS {
+			assert.Contains(t, body, gpsLatitude, testCase.policy)
+		} else {
+			assert.NotContains(t, body, gpsLatitude, testCase.policy)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package test
+
+import (
+	"bytes"
+	"io/ioutil"
+	http2 "net/http"
+	"testing"
+
+	"github.com/breathbath/go_utils/utils/errs"
+	"github.com/breathbath/media-library/assets"
+	"github.com/breathbath/media-library/test/helper"
+	"github.com/stretchr/testify/assert"
+)
+
+const modesServerURL = "http://localhost:9940/images"
+const modesAssetsPath = "/tmp/modesassets"
+
+func TestUploadModes(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	err := helper.PrepareFileServer(
+		"modes",
+		modesAssetsPath,
+		map[string]string{
+			"STORAGE_DRIVER":       "local",
+			"ASSETS_PATH":          modesAssetsPath,
+			"HOST":                 ":9940",
+			"TOKEN_ISSUER":         "media-service-test",
+			"TOKEN_SECRET":         "12345678",
+			"URL_PREFIX":           "/images",
+			"MAX_UPLOADED_FILE_MB": "0.1",
+		},
+	)
+	errs.FailOnError(err)
+	defer func() {
+		helper.ShutdownFileServers()
+		errs.FailOnError(helper.SetEnvs(map[string]string{"ASSETS_PATH": helper.AssetsPath}))
+	}()
+
+	t.Run("testAtomicUploadRollback", testAtomicUploadRollback)
+	t.Run("testAtomicUploadRollbackOfUnparsableNames", testAtomicUploadRollbackOfUnparsableNames)
+	t.Run("testLegacyUploadRollbackOnServerError", testLegacyUploadRollbackOnServerError)
+	t.Run("testAtomicUploadSuccess", testAtomicUploadSuccess)
+	t.Run("testPartialUpload", testPartialUpload)
+	t.Run("testUnknownUploadMode", testUnknownUploadMode)
+}
+
+func createUploadModeFiles(t *testing.T, withInvalidFile bool) []helper.UploadedFile {
+	firstImage, err := helper.CreateImage(helper.ImageSpec{Format: "png"})
+	assert.NoError(t, err)
+	secondImage, err := helper.CreateImage(helper.ImageSpec{Format: "jpg"})
+	assert.NoError(t, err)
+
+	files := []helper.UploadedFile{{FieldName: "files[]", FileName: "first.png", File: firstImage}}
+	if withInvalidFile {
+		files = append(files, helper.UploadedFile{FieldName: "files[]", FileName: "notes.txt", File: bytes.NewBufferString("some text")})
+	}
+
+	return append(files, helper.UploadedFile{FieldName: "files[]", FileName: "second.jpg", File: secondImage})
+}
+
+func testAtomicUploadRollback(t *testing.T) {
+	var validationErrors map[string][]string
+	statusCode, err := makeTestingPostTo(
+		modesServerURL+"?upload_mode=atomic",
+		&validationErrors,
+		createUploadModeFiles(t, true)...,
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusBadRequest, statusCode)
+	assert.Len(t, validationErrors["files[]"], 1)
+
+	fileInfos, err := ioutil.ReadDir(modesAssetsPath)
+	assert.NoError(t, err)
+	assert.Len(t, fileInfos, 0, "saved files of the failed atomic upload are not removed")
+}
+
+// testAtomicUploadRollbackOfUnparsableNames rolls back images with names which don't match image urls
+func testAtomicUploadRollbackOfUnparsableNames(t *testing.T) {
+	jpgImage, err := helper.CreateImage(helper.ImageSpec{Format: "jpg"})
+	assert.NoError(t, err)
+
+	var validationErrors map[string][]string
+	statusCode, err := makeTestingPostTo(
+		modesServerURL+"?upload_mode=atomic",
+		&validationErrors,
+		helper.UploadedFile{FieldName: "files[]", FileName: "photo.jfif", File: jpgImage},
+		helper.UploadedFile{FieldName: "files[]", FileName: "notes.txt", File: bytes.NewBufferString("some text")},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusBadRequest, statusCode)
+
+	fileInfos, err := ioutil.ReadDir(modesAssetsPath)
+	assert.NoError(t, err)
+	assert.Len(t, fileInfos, 0, "saved files of the failed atomic upload are not removed")
+}
+
+// testLegacyUploadRollbackOnServerError removes files saved before a file which failed with a server error
+func testLegacyUploadRollbackOnServerError(t *testing.T) {
+	pngImage, err := helper.CreateImage(helper.ImageSpec{Format: "png"})
+	assert.NoError(t, err)
+	// the header of the broken image passes the validation, but the image can't be decoded on saving
+	brokenImage, err := helper.CreateImage(helper.ImageSpec{Format: "png"})
+	assert.NoError(t, err)
+	brokenImageContent, err := ioutil.ReadAll(brokenImage)
+	assert.NoError(t, err)
+
+	testClient := helper.NewTestClient()
+	err = testClient.AddFiles(
+		helper.UploadedFile{FieldName: "files[]", FileName: "first.png", File: pngImage},
+		helper.UploadedFile{FieldName: "files[]", FileName: "broken.png", File: bytes.NewReader(brokenImageContent[:len(brokenImageContent)/2])},
+	)
+	assert.NoError(t, err)
+	validToken, err := testClient.GenerateValidToken()
+	assert.NoError(t, err)
+
+	statusCode, _, err := testClient.MakePost(validToken, modesServerURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusInternalServerError, statusCode)
+
+	fileInfos, err := ioutil.ReadDir(modesAssetsPath)
+	assert.NoError(t, err)
+	assert.Len(t, fileInfos, 0, "saved files of the failed upload are not removed")
+}
+
+func testAtomicUploadSuccess(t *testing.T) {
+	var filesResp filesResponse
+	statusCode, err := makeTestingPostTo(modesServerURL+"?upload_mode=atomic", &filesResp, createUploadModeFiles(t, false)...)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusOK, statusCode)
+	if !assert.Len(t, filesResp.FilesToReturn, 2) {
+		return
+	}
+
+	for _, imagePath := range filesResp.FilesToReturn {
+		statusCode, _, err = helper.NewTestClient().MakeGet(modesServerURL + "/" + imagePath)
+		assert.NoError(t, err)
+		assert.Equal(t, http2.StatusOK, statusCode)
+	}
+}
+
+func testPartialUpload(t *testing.T) {
+	var partialResp struct {
+		Files []assets.UploadFileStatus `json:"files"`
+	}
+	statusCode, err := makeTestingPostTo(modesServerURL+"?upload_mode=partial", &partialResp, createUploadModeFiles(t, true)...)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusMultiStatus, statusCode)
+	if !assert.Len(t, partialResp.Files, 3) {
+		return
+	}
+
+	expectedStatuses := []struct {
+		fileName   string
+		status     string
+		statusCode int
+	}{
+		{"first.png", assets.UploadStatusSaved, http2.StatusOK},
+		{"notes.txt", assets.UploadStatusRejected, http2.StatusBadRequest},
+		{"second.jpg", assets.UploadStatusSaved, http2.StatusOK},
+	}
+	for i, expectedStatus := range expectedStatuses {
+		fileStatus := partialResp.Files[i]
+		assert.Equal(t, i, fileStatus.Index)
+		assert.Equal(t, expectedStatus.fileName, fileStatus.OriginalFilename)
+		assert.Equal(t, expectedStatus.status, fileStatus.Status)
+		assert.Equal(t, expectedStatus.statusCode, fileStatus.StatusCode)
+
+		if expectedStatus.status != assets.UploadStatusSaved {
+			assert.Nil(t, fileStatus.File)
+			if assert.Len(t, fileStatus.Violations, 1) {
+				assert.Equal(t, assets.ViolationUnsupportedMimeType, fileStatus.Violations[0].Code)
+			}
+			continue
+		}
+
+		if !assert.NotNil(t, fileStatus.File) {
+			continue
+		}
+		assert.Empty(t, fileStatus.Violations)
+		assert.Equal(t, expectedStatus.fileName, fileStatus.File.Filename)
+		assert.Equal(t, "http://localhost:9940/images/"+fileStatus.File.Path, fileStatus.File.URL)
+
+		statusCode, _, err = helper.NewTestClient().MakeGet(fileStatus.File.URL)
+		assert.NoError(t, err)
+		assert.Equal(t, http2.StatusOK, statusCode)
+	}
+}
+
+func testUnknownUploadMode(t *testing.T) {
+	var validationErrors map[string][]string
+	statusCode, err := makeTestingPostTo(modesServerURL+"?upload_mode=all", &validationErrors, createUploadModeFiles(t, false)...)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusBadRequest, statusCode)
+	assert.Len(t, validationErrors["upload_mode"], 1)
+}
@@ -0,0 +1,171 @@
+package test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	http2 "net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/breathbath/go_utils/utils/errs"
+	"github.com/breathbath/media-library/assets"
+	error2 "github.com/breathbath/media-library/error"
+	"github.com/breathbath/media-library/test/helper"
+	"github.com/stretchr/testify/assert"
+)
+
+const responseServerURL = "http://localhost:9939/images"
+
+type filesResponseV2 struct {
+	Files []assets.UploadedImage `json:"files"`
+}
+
+func TestUploadResponse(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	err := helper.PrepareFileServer(
+		"response",
+		"/tmp/responseassets",
+		map[string]string{
+			"STORAGE_DRIVER":         "memory",
+			"HOST":                   ":9939",
+			"TOKEN_ISSUER":           "media-service-test",
+			"TOKEN_SECRET":           "12345678",
+			"URL_PREFIX":             "/images",
+			"MAX_UPLOADED_FILE_MB":   "0.1",
+			"HORIZ_MAX_IMAGE_HEIGHT": "50",
+			"PUBLIC_URL":             "https://cdn.example.com/",
+		},
+	)
+	errs.FailOnError(err)
+	defer func() {
+		helper.ShutdownFileServers()
+		errs.FailOnError(helper.SetEnvs(map[string]string{"STORAGE_DRIVER": "local"}))
+		errs.FailOnError(os.Unsetenv("HORIZ_MAX_IMAGE_HEIGHT"))
+		errs.FailOnError(os.Unsetenv("PUBLIC_URL"))
+	}()
+
+	testCases := []struct {
+		name   string
+		url    string
+		accept string
+	}{
+		{"version param", responseServerURL + "?version=2", ""},
+		{"accept header", responseServerURL, assets.ResponseV2MimeType},
+	}
+
+	for _, testCase := range testCases {
+		pngImage, err := helper.CreateImage(helper.ImageSpec{Format: "png", Width: 200, Height: 100})
+		assert.NoError(t, err)
+
+		testClient := helper.NewTestClient()
+		assert.NoError(t, testClient.AddFiles(helper.UploadedFile{FieldName: "files[]", FileName: "my photo@2x.png", File: pngImage}))
+		if testCase.accept != "" {
+			testClient.SetHeader("Accept", testCase.accept)
+		}
+		validToken, err := testClient.GenerateValidToken()
+		assert.NoError(t, err)
+
+		statusCode, body, err := testClient.MakePost(validToken, testCase.url)
+		assert.NoError(t, err, testCase.name)
+		assert.Equal(t, http2.StatusOK, statusCode, testCase.name)
+
+		var resp filesResponseV2
+		assert.NoError(t, json.Unmarshal([]byte(body), &resp), testCase.name)
+		if !assert.Len(t, resp.Files, 1, testCase.name) {
+			continue
+		}
+		uploadedImage := resp.Files[0]
+
+		assert.Regexp(t, `^\w+/my_photo_2x\.png$`, uploadedImage.Path, testCase.name)
+		assert.Equal(t, "my photo@2x.png", uploadedImage.OriginalFilename, testCase.name)
+		assert.Equal(t, "my_photo_2x.png", uploadedImage.Filename, testCase.name)
+		assert.Equal(t, 100, uploadedImage.Width, testCase.name)
+		assert.Equal(t, 50, uploadedImage.Height, testCase.name)
+		assert.Equal(t, "image/png", uploadedImage.Mime, testCase.name)
+		assert.Equal(t, "https://cdn.example.com/images/"+uploadedImage.Path, uploadedImage.URL, testCase.name)
+		assert.Equal(t, uploadedImage.URL+"/meta", uploadedImage.MetaURL, testCase.name)
+
+		statusCode, imageBody, err := helper.NewTestClient().MakeGet(
+			strings.Replace(uploadedImage.URL, "https://cdn.example.com", "http://localhost:9939", 1),
+		)
+		assert.NoError(t, err, testCase.name)
+		assert.Equal(t, http2.StatusOK, statusCode, testCase.name)
+		expectedHash := sha256.Sum256([]byte(imageBody))
+		assert.Equal(t, hex.EncodeToString(expectedHash[:]), uploadedImage.Sha256, testCase.name)
+		assert.Equal(t, int64(len(imageBody)), uploadedImage.Size, testCase.name)
+	}
+
+	pngImage, err := helper.CreateImage(helper.ImageSpec{Format: "png"})
+	assert.NoError(t, err)
+
+	var legacyResp filesResponse
+	statusCode, err := makeTestingPostTo(
+		responseServerURL,
+		&legacyResp,
+		helper.UploadedFile{FieldName: "files[]", FileName: "legacy.png", File: pngImage},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusOK, statusCode)
+	if assert.Len(t, legacyResp.FilesToReturn, 1) {
+		assert.Regexp(t, `^\w+/legacy\.png$`, legacyResp.FilesToReturn[0])
+	}
+
+	testValidationErrorsPerFile(t)
+}
+
+func createInvalidUploadFiles(t *testing.T) []helper.UploadedFile {
+	pngImage, err := helper.CreateImage(helper.ImageSpec{Format: "png"})
+	assert.NoError(t, err)
+
+	// the text is both not an image and larger than MAX_UPLOADED_FILE_MB
+	largeText := bytes.NewBufferString(strings.Repeat("some text ", 20000))
+
+	return []helper.UploadedFile{
+		{FieldName: "files[]", FileName: "valid.png", File: pngImage},
+		{FieldName: "files[]", FileName: "large.txt", File: largeText},
+	}
+}
+
+func testValidationErrorsPerFile(t *testing.T) {
+	var legacyErrors map[string][]string
+	statusCode, err := makeTestingPostTo(responseServerURL, &legacyErrors, createInvalidUploadFiles(t)...)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusBadRequest, statusCode)
+	if assert.Len(t, legacyErrors["files[]"], 2) {
+		assert.Contains(t, legacyErrors["files[]"][0], "Not supported image type 'text/plain'")
+		assert.Contains(t, legacyErrors["files[]"][1], "The file is larger than")
+	}
+
+	testClient := helper.NewTestClient()
+	assert.NoError(t, testClient.AddFiles(createInvalidUploadFiles(t)...))
+	validToken, err := testClient.GenerateValidToken()
+	assert.NoError(t, err)
+
+	statusCode, body, err := testClient.MakePost(validToken, responseServerURL+"?version=2")
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusBadRequest, statusCode)
+
+	var v2Errors struct {
+		Errors []error2.FileValidationError `json:"errors"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &v2Errors))
+	if !assert.Len(t, v2Errors.Errors, 1) {
+		return
+	}
+
+	fileError := v2Errors.Errors[0]
+	assert.Equal(t, 1, fileError.Index)
+	assert.Equal(t, "large.txt", fileError.Filename)
+	assert.Equal(t, "files[]", fileError.Field)
+	if assert.Len(t, fileError.Violations, 2) {
+		assert.Equal(t, assets.ViolationUnsupportedMimeType, fileError.Violations[0].Code)
+		assert.Equal(t, assets.ViolationFileTooLarge, fileError.Violations[1].Code)
+		assert.Contains(t, fileError.Violations[1].Message, "The file is larger than")
+	}
+}
@@ -0,0 +1,161 @@
+package test
+
+import (
+	"encoding/json"
+	"io"
+	http2 "net/http"
+	"os"
+	"testing"
+
+	"github.com/breathbath/go_utils/utils/errs"
+	"github.com/breathbath/media-library/assets"
+	error2 "github.com/breathbath/media-library/error"
+	"github.com/breathbath/media-library/test/helper"
+	"github.com/stretchr/testify/assert"
+)
+
+const rulesServerURL = "http://localhost:9941/images"
+
+func TestUploadRules(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	err := helper.PrepareFileServer(
+		"rules",
+		"/tmp/rulesassets",
+		map[string]string{
+			"STORAGE_DRIVER":       "memory",
+			"HOST":                 ":9941",
+			"TOKEN_ISSUER":         "media-service-test",
+			"TOKEN_SECRET":         "12345678",
+			"URL_PREFIX":           "/images",
+			"MAX_UPLOADED_FILE_MB": "5",
+			"UPLOAD_MIN_WIDTH":     "256",
+			"UPLOAD_MIN_HEIGHT":    "256",
+			"UPLOAD_MAX_PIXELS":    "1000000",
+		},
+	)
+	errs.FailOnError(err)
+	defer func() {
+		helper.ShutdownFileServers()
+		errs.FailOnError(helper.SetEnvs(map[string]string{"STORAGE_DRIVER": "local"}))
+		for _, envName := range []string{"UPLOAD_MIN_WIDTH", "UPLOAD_MIN_HEIGHT", "UPLOAD_MAX_PIXELS"} {
+			errs.FailOnError(os.Unsetenv(envName))
+		}
+	}()
+
+	t.Run("testServerUploadRules", testServerUploadRules)
+	t.Run("testRequestUploadRules", testRequestUploadRules)
+	t.Run("testOrientedImageUploadRules", testOrientedImageUploadRules)
+	t.Run("testInvalidUploadRulesOverride", testInvalidUploadRulesOverride)
+}
+
+// postWithRules uploads the image and gives codes of violated rules, nil codes mean the image was saved
+func postWithRules(t *testing.T, url string, image io.Reader) (statusCode int, codes []string) {
+	testClient := helper.NewTestClient()
+	assert.NoError(t, testClient.AddFiles(helper.UploadedFile{FieldName: "files[]", FileName: "image.png", File: image}))
+	validToken, err := testClient.GenerateValidToken()
+	assert.NoError(t, err)
+
+	statusCode, body, err := testClient.MakePost(validToken, url)
+	assert.NoError(t, err)
+	if statusCode != http2.StatusBadRequest {
+		return statusCode, nil
+	}
+
+	var v2Errors struct {
+		Errors []error2.FileValidationError `json:"errors"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &v2Errors))
+
+	codes = []string{}
+	for _, fileError := range v2Errors.Errors {
+		for _, violation := range fileError.Violations {
+			codes = append(codes, violation.Code)
+		}
+	}
+
+	return statusCode, codes
+}
+
+func testServerUploadRules(t *testing.T) {
+	testCases := []struct {
+		width         int
+		height        int
+		expectedCodes []string
+	}{
+		{100, 300, []string{assets.ViolationWidthTooSmall}},
+		{100, 100, []string{assets.ViolationWidthTooSmall, assets.ViolationHeightTooSmall}},
+		{256, 256, nil},
+		{1200, 900, []string{assets.ViolationTooManyPixels}},
+	}
+
+	for _, testCase := range testCases {
+		pngImage, err := helper.CreateImage(helper.ImageSpec{Format: "png", Width: testCase.width, Height: testCase.height})
+		assert.NoError(t, err)
+
+		statusCode, codes := postWithRules(t, rulesServerURL+"?version=2", pngImage)
+		if testCase.expectedCodes == nil {
+			assert.Equal(t, http2.StatusOK, statusCode, "%dx%d", testCase.width, testCase.height)
+			continue
+		}
+		assert.Equal(t, http2.StatusBadRequest, statusCode, "%dx%d", testCase.width, testCase.height)
+		assert.Equal(t, testCase.expectedCodes, codes, "%dx%d", testCase.width, testCase.height)
+	}
+}
+
+func testRequestUploadRules(t *testing.T) {
+	testCases := []struct {
+		name          string
+		query         string
+		width         int
+		height        int
+		expectedCodes []string
+	}{
+		{"banner ratio accepted", "aspect_ratios=2.9:1-3.1:1", 900, 300, nil},
+		{"banner ratio rejected", "aspect_ratios=2.9:1-3.1:1", 300, 300, []string{assets.ViolationAspectRatioNotAllowed}},
+		{"looser minimum ignored", "min_width=100", 200, 300, []string{assets.ViolationWidthTooSmall}},
+		{"tighter maximum applied", "max_width=500", 600, 300, []string{assets.ViolationWidthTooLarge}},
+		{"looser pixels limit ignored", "max_pixels=5000000", 1200, 900, []string{assets.ViolationTooManyPixels}},
+	}
+
+	for _, testCase := range testCases {
+		pngImage, err := helper.CreateImage(helper.ImageSpec{Format: "png", Width: testCase.width, Height: testCase.height})
+		assert.NoError(t, err)
+
+		statusCode, codes := postWithRules(t, rulesServerURL+"?version=2&"+testCase.query, pngImage)
+		if testCase.expectedCodes == nil {
+			assert.Equal(t, http2.StatusOK, statusCode, testCase.name)
+			continue
+		}
+		assert.Equal(t, http2.StatusBadRequest, statusCode, testCase.name)
+		assert.Equal(t, testCase.expectedCodes, codes, testCase.name)
+	}
+}
+
+func testOrientedImageUploadRules(t *testing.T) {
+	// the stored image is rotated to 900x300 according to the exif orientation
+	jpgImage, err := helper.CreateJpegWithExif(300, 900, 6)
+	assert.NoError(t, err)
+
+	statusCode, codes := postWithRules(t, rulesServerURL+"?version=2&aspect_ratios=3:1", jpgImage)
+	assert.Equal(t, http2.StatusOK, statusCode)
+	assert.Nil(t, codes)
+}
+
+func testInvalidUploadRulesOverride(t *testing.T) {
+	pngImage, err := helper.CreateImage(helper.ImageSpec{Format: "png", Width: 300, Height: 300})
+	assert.NoError(t, err)
+
+	var fieldErrors map[string][]string
+	statusCode, err := makeTestingPostTo(
+		rulesServerURL+"?max_width=wide&aspect_ratios=3:1:1",
+		&fieldErrors,
+		helper.UploadedFile{FieldName: "files[]", FileName: "image.png", File: pngImage},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusBadRequest, statusCode)
+	assert.Equal(t, []string{"Should be a positive integer"}, fieldErrors["max_width"])
+	assert.Len(t, fieldErrors["aspect_ratios"], 1)
+}
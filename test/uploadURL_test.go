@@ -0,0 +1,277 @@
+package test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	http2 "net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/breathbath/go_utils/utils/errs"
+	"github.com/breathbath/media-library/assets"
+	"github.com/breathbath/media-library/authentication"
+	error2 "github.com/breathbath/media-library/error"
+	"github.com/breathbath/media-library/filesystem"
+	"github.com/breathbath/media-library/test/helper"
+	"github.com/stretchr/testify/assert"
+)
+
+const uploadURLServerURL = "http://localhost:9948/images"
+
+func TestUploadURL(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	err := helper.PrepareFileServer(
+		"uploadurl",
+		"/tmp/uploadurlassets",
+		map[string]string{
+			"STORAGE_DRIVER":             "memory",
+			"HOST":                       ":9948",
+			"TOKEN_ISSUER":               "media-service-test",
+			"TOKEN_SECRET":               "12345678",
+			"URL_PREFIX":                 "/images",
+			"MAX_UPLOADED_FILE_MB":       "5",
+			"UPLOAD_URL_SECRET":          "87654321",
+			"UPLOAD_URL_MAX_TTL_SECONDS": "600",
+		},
+	)
+	errs.FailOnError(err)
+	defer func() {
+		helper.ShutdownFileServers()
+		errs.FailOnError(helper.SetEnvs(map[string]string{"STORAGE_DRIVER": "local"}))
+		errs.FailOnError(os.Unsetenv("UPLOAD_URL_SECRET"))
+		errs.FailOnError(os.Unsetenv("UPLOAD_URL_MAX_TTL_SECONDS"))
+	}()
+
+	t.Run("testCreateUploadURL", testCreateUploadURL)
+	t.Run("testInvalidUploadURLRequests", testInvalidUploadURLRequests)
+	t.Run("testUploadURLIsSingleUse", testUploadURLIsSingleUse)
+	t.Run("testRejectedUploadKeepsUploadURL", testRejectedUploadKeepsUploadURL)
+	t.Run("testUploadTokenIsSharedByInstances", testUploadTokenIsSharedByInstances)
+	t.Run("testUsedUploadTokensOfExpiredTokensAreRemoved", testUsedUploadTokensOfExpiredTokensAreRemoved)
+	t.Run("testUploadURLRestrictions", testUploadURLRestrictions)
+	t.Run("testUploadTokenIsNotBearerToken", testUploadTokenIsNotBearerToken)
+}
+
+func createUploadURL(t *testing.T, body string) (int, assets.UploadURLResponse, string) {
+	testClient := helper.NewTestClient()
+	testClient.SetHeader("Content-Type", "application/json")
+	validToken, err := testClient.GenerateValidToken()
+	assert.NoError(t, err)
+
+	resp, respBody, err := testClient.MakeRequest(
+		http2.MethodPost,
+		validToken,
+		uploadURLServerURL+"/"+assets.UploadURLsPath,
+		[]byte(body),
+	)
+	errs.FailOnError(err)
+
+	uploadURLResp := assets.UploadURLResponse{}
+	if resp.StatusCode == http2.StatusOK {
+		assert.NoError(t, json.Unmarshal([]byte(respBody), &uploadURLResp))
+	}
+
+	return resp.StatusCode, uploadURLResp, respBody
+}
+
+// postToUploadURL uploads files without the bearer token
+func postToUploadURL(t *testing.T, uploadURL string, files ...helper.UploadedFile) (int, string) {
+	testClient := helper.NewTestClient()
+	assert.NoError(t, testClient.AddFiles(files...))
+
+	statusCode, body, err := testClient.MakePost("", uploadURL)
+	assert.NoError(t, err)
+
+	return statusCode, body
+}
+
+func createPngFile(t *testing.T, fileName string) helper.UploadedFile {
+	pngImage, err := helper.CreateImage(helper.ImageSpec{Format: "png"})
+	assert.NoError(t, err)
+
+	return helper.UploadedFile{FieldName: "files[]", FileName: fileName, File: pngImage}
+}
+
+func testCreateUploadURL(t *testing.T) {
+	resp, _, err := helper.NewTestClient().MakeRequest(
+		http2.MethodPost,
+		"",
+		uploadURLServerURL+"/"+assets.UploadURLsPath,
+		nil,
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusUnauthorized, resp.StatusCode)
+
+	statusCode, uploadURLResp, _ := createUploadURL(t, `{"max_size_mb": 0.5, "formats": ["png", "JPG"], "max_files": 2}`)
+	assert.Equal(t, http2.StatusOK, statusCode)
+	assert.Equal(t, 0.5, uploadURLResp.MaxSizeMb)
+	assert.Equal(t, []string{"png", "jpg"}, uploadURLResp.Formats)
+	assert.Equal(t, 2, uploadURLResp.MaxFiles)
+	assert.WithinDuration(t, time.Now().Add(600*time.Second), uploadURLResp.ExpiresAt, 5*time.Second)
+
+	parsedURL, err := url.Parse(uploadURLResp.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "/images", parsedURL.Path)
+	assert.Equal(t, uploadURLResp.UploadToken, parsedURL.Query().Get(assets.UploadTokenQueryParam))
+
+	statusCode, uploadURLResp, _ = createUploadURL(t, "")
+	assert.Equal(t, http2.StatusOK, statusCode)
+	assert.Equal(t, float64(5), uploadURLResp.MaxSizeMb)
+	assert.Equal(t, []string{}, uploadURLResp.Formats)
+	assert.Equal(t, 1, uploadURLResp.MaxFiles)
+}
+
+func testInvalidUploadURLRequests(t *testing.T) {
+	testCases := []struct {
+		body          string
+		expectedField string
+	}{
+		{`{"max_size_mb": 6}`, "max_size_mb"},
+		{`{"formats": ["png", "exe"]}`, "formats"},
+		{`{"max_files": -1}`, "max_files"},
+		{`{"ttl_seconds": 601}`, "ttl_seconds"},
+	}
+
+	for _, testCase := range testCases {
+		statusCode, _, body := createUploadURL(t, testCase.body)
+		assert.Equal(t, http2.StatusBadRequest, statusCode, testCase.body)
+
+		var fieldErrors map[string][]string
+		assert.NoError(t, json.Unmarshal([]byte(body), &fieldErrors))
+		assert.Len(t, fieldErrors[testCase.expectedField], 1, testCase.body)
+	}
+}
+
+func testUploadURLIsSingleUse(t *testing.T) {
+	_, uploadURLResp, _ := createUploadURL(t, `{"ttl_seconds": 60}`)
+
+	statusCode, body := postToUploadURL(t, uploadURLResp.URL, createPngFile(t, "first.png"))
+	assert.Equal(t, http2.StatusOK, statusCode)
+
+	var filesResp filesResponse
+	assert.NoError(t, json.Unmarshal([]byte(body), &filesResp))
+	if assert.Len(t, filesResp.FilesToReturn, 1) {
+		assert.Regexp(t, `^\w+/first\.png$`, filesResp.FilesToReturn[0])
+	}
+
+	statusCode, _ = postToUploadURL(t, uploadURLResp.URL, createPngFile(t, "second.png"))
+	assert.Equal(t, http2.StatusForbidden, statusCode)
+
+	statusCode, _ = postToUploadURL(t, uploadURLResp.URL+"x", createPngFile(t, "third.png"))
+	assert.Equal(t, http2.StatusForbidden, statusCode)
+}
+
+func testRejectedUploadKeepsUploadURL(t *testing.T) {
+	_, uploadURLResp, _ := createUploadURL(t, `{"formats": ["png"]}`)
+
+	jpgImage, err := helper.CreateImage(helper.ImageSpec{Format: helper.JPG})
+	assert.NoError(t, err)
+	statusCode, _ := postToUploadURL(t, uploadURLResp.URL, helper.UploadedFile{
+		FieldName: "files[]",
+		FileName:  "image.jpg",
+		File:      jpgImage,
+	})
+	assert.Equal(t, http2.StatusBadRequest, statusCode)
+
+	statusCode, _ = postToUploadURL(t, uploadURLResp.URL, createPngFile(t, "image.png"))
+	assert.Equal(t, http2.StatusOK, statusCode)
+
+	statusCode, _ = postToUploadURL(t, uploadURLResp.URL, createPngFile(t, "image.png"))
+	assert.Equal(t, http2.StatusForbidden, statusCode)
+}
+
+// testUploadTokenIsSharedByInstances consumes a token by two managers with the same storage like two service instances
+func testUploadTokenIsSharedByInstances(t *testing.T) {
+	sharedStorage := filesystem.LocalFileSystemManager{AssetsPath: "/tmp/uploadurlassets/shared"}
+	firstInstance, err := authentication.NewUploadTokenManager(sharedStorage)
+	assert.NoError(t, err)
+	secondInstance, err := authentication.NewUploadTokenManager(sharedStorage)
+	assert.NoError(t, err)
+
+	rawToken, err := firstInstance.GenerateToken(authentication.UploadPermit{MaxFiles: 1, ExpiresAt: time.Now().Add(time.Minute)})
+	assert.NoError(t, err)
+	permit, err := secondInstance.ParseToken(rawToken)
+	assert.NoError(t, err)
+
+	assert.NoError(t, firstInstance.Consume(permit))
+	assert.Equal(t, authentication.ErrUploadTokenUsed, secondInstance.Consume(permit))
+	assert.Equal(t, authentication.ErrUploadTokenUsed, firstInstance.Consume(permit))
+}
+
+func testUsedUploadTokensOfExpiredTokensAreRemoved(t *testing.T) {
+	const assetsPath = "/tmp/uploadurlassets/pruned"
+	assert.NoError(t, os.RemoveAll(assetsPath))
+	usedTokensPath := filepath.Join(assetsPath, "cache", "used_upload_tokens")
+
+	// markers of tokens which expired in the previous hour
+	expiredFolder := strconv.FormatInt(time.Now().Truncate(time.Hour).Unix(), 10)
+	assert.NoError(t, os.MkdirAll(filepath.Join(usedTokensPath, expiredFolder), os.ModePerm))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(usedTokensPath, expiredFolder, "abc"), []byte{}, 0600))
+
+	tokenManager, err := authentication.NewUploadTokenManager(filesystem.LocalFileSystemManager{AssetsPath: assetsPath})
+	assert.NoError(t, err)
+	rawToken, err := tokenManager.GenerateToken(authentication.UploadPermit{MaxFiles: 1, ExpiresAt: time.Now().Add(time.Minute)})
+	assert.NoError(t, err)
+	permit, err := tokenManager.ParseToken(rawToken)
+	assert.NoError(t, err)
+	assert.NoError(t, tokenManager.Consume(permit))
+
+	folderInfos, err := ioutil.ReadDir(usedTokensPath)
+	assert.NoError(t, err)
+	if assert.Len(t, folderInfos, 1) {
+		assert.NotEqual(t, expiredFolder, folderInfos[0].Name())
+		assert.FileExists(t, filepath.Join(usedTokensPath, folderInfos[0].Name(), permit.ID))
+	}
+	assert.Equal(t, authentication.ErrUploadTokenUsed, tokenManager.Consume(permit))
+}
+
+func testUploadURLRestrictions(t *testing.T) {
+	_, uploadURLResp, _ := createUploadURL(t, `{"formats": ["jpg"]}`)
+	statusCode, body := postToUploadURL(t, uploadURLResp.URL+"&version=2", createPngFile(t, "image.png"))
+	assert.Equal(t, http2.StatusBadRequest, statusCode)
+
+	var v2Errors struct {
+		Errors []error2.FileValidationError `json:"errors"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &v2Errors))
+	if assert.Len(t, v2Errors.Errors, 1) && assert.Len(t, v2Errors.Errors[0].Violations, 1) {
+		assert.Equal(t, assets.ViolationUnsupportedMimeType, v2Errors.Errors[0].Violations[0].Code)
+	}
+
+	_, uploadURLResp, _ = createUploadURL(t, `{"max_size_mb": 0.01}`)
+	statusCode, body = postToUploadURL(t, uploadURLResp.URL+"&version=2", helper.UploadedFile{
+		FieldName: "files[]",
+		FileName:  "large.png",
+		File:      createPaddedPng(t, 20000),
+	})
+	assert.Equal(t, http2.StatusBadRequest, statusCode)
+	assert.NoError(t, json.Unmarshal([]byte(body), &v2Errors))
+	if assert.Len(t, v2Errors.Errors, 1) && assert.Len(t, v2Errors.Errors[0].Violations, 1) {
+		assert.Equal(t, assets.ViolationFileTooLarge, v2Errors.Errors[0].Violations[0].Code)
+	}
+
+	_, uploadURLResp, _ = createUploadURL(t, `{"max_files": 1}`)
+	statusCode, body = postToUploadURL(t, uploadURLResp.URL, createPngFile(t, "first.png"), createPngFile(t, "second.png"))
+	assert.Equal(t, http2.StatusBadRequest, statusCode)
+
+	var fieldErrors map[string][]string
+	assert.NoError(t, json.Unmarshal([]byte(body), &fieldErrors))
+	assert.Equal(t, []string{"Should contain at most 1 elements"}, fieldErrors[assets.SubmittedFileFieldName])
+}
+
+func testUploadTokenIsNotBearerToken(t *testing.T) {
+	_, uploadURLResp, _ := createUploadURL(t, "")
+
+	testClient := helper.NewTestClient()
+	assert.NoError(t, testClient.AddFiles(createPngFile(t, "image.png")))
+	statusCode, _, err := testClient.MakePost(uploadURLResp.UploadToken, uploadURLServerURL)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusUnauthorized, statusCode)
+}
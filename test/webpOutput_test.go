@@ -0,0 +1,103 @@
+package test
+
+import (
+	"context"
+	"image"
+	"io/ioutil"
+	http2 "net/http"
+	"strings"
+	"testing"
+
+	"github.com/breathbath/go_utils/utils/errs"
+	"github.com/breathbath/media-library/test/helper"
+	_ "github.com/chai2010/webp"
+	"github.com/stretchr/testify/assert"
+)
+
+const webpServerURL = "http://localhost:9931/images"
+
+func TestWebpOutput(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	err := helper.PrepareFileServer(
+		"webp",
+		"/tmp/webpassets",
+		map[string]string{
+			"STORAGE_DRIVER":       "memory",
+			"HOST":                 ":9931",
+			"TOKEN_ISSUER":         "media-service-test",
+			"TOKEN_SECRET":         "12345678",
+			"URL_PREFIX":           "/images",
+			"MAX_UPLOADED_FILE_MB": "0.1",
+		},
+	)
+	errs.FailOnError(err)
+	defer func() {
+		helper.ShutdownFileServers()
+		errs.FailOnError(helper.SetEnvs(map[string]string{"STORAGE_DRIVER": "local"}))
+	}()
+
+	pngImage, err := helper.CreateImage(helper.ImageSpec{Format: "png", Width: 200, Height: 100})
+	assert.NoError(t, err)
+
+	var filesResp filesResponse
+	statusCode, err := makeTestingPostTo(
+		webpServerURL,
+		&filesResp,
+		helper.UploadedFile{FieldName: "files[]", FileName: "webp.png", File: pngImage},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, http2.StatusOK, statusCode)
+	if !assert.Len(t, filesResp.FilesToReturn, 1) {
+		return
+	}
+	imagePath := filesResp.FilesToReturn[0]
+
+	testCases := []struct {
+		url            string
+		accept         string
+		expectedStatus int
+		expectedFormat string
+		expectedVary   string
+	}{
+		{webpServerURL + "/x50/" + imagePath, "", http2.StatusOK, "png", "Accept"},
+		{webpServerURL + "/x50/" + imagePath, "image/avif,image/webp,*/*", http2.StatusOK, "webp", "Accept"},
+		{webpServerURL + "/x50/" + imagePath, "image/webp;q=0,image/png", http2.StatusOK, "png", "Accept"},
+		{webpServerURL + "/x50/" + imagePath + ".webp", "", http2.StatusOK, "webp", "Accept"},
+		{webpServerURL + "/h_50,f_webp/" + imagePath, "", http2.StatusOK, "webp", "Accept"},
+		{webpServerURL + "/h_50,f_jpg/" + imagePath, "image/webp", http2.StatusOK, "jpeg", "Accept"},
+		{webpServerURL + "/h_50,f_png/" + imagePath + ".webp", "", http2.StatusNotFound, "", "Accept"},
+		{webpServerURL + "/h_50,f_bmp/" + imagePath, "", http2.StatusNotFound, "", "Accept"},
+		{webpServerURL + "/" + imagePath, "image/webp", http2.StatusOK, "png", ""},
+	}
+
+	for _, testCase := range testCases {
+		r, err := http2.NewRequestWithContext(context.Background(), http2.MethodGet, testCase.url, nil)
+		assert.NoError(t, err)
+		if testCase.accept != "" {
+			r.Header.Set("Accept", testCase.accept)
+		}
+
+		resp, err := http2.DefaultClient.Do(r)
+		if !assert.NoError(t, err, testCase.url) {
+			continue
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, testCase.expectedStatus, resp.StatusCode, testCase.url)
+		assert.Equal(t, testCase.expectedVary, resp.Header.Get("Vary"), testCase.url)
+		if testCase.expectedStatus != http2.StatusOK {
+			continue
+		}
+
+		imgConfig, format, err := image.DecodeConfig(strings.NewReader(string(body)))
+		assert.NoError(t, err, testCase.url)
+		assert.Equal(t, testCase.expectedFormat, format, testCase.url)
+		assert.Equal(t, imgConfig.Width, 2*imgConfig.Height, testCase.url)
+		assert.Equal(t, "image/"+testCase.expectedFormat, resp.Header.Get("Content-Type"), testCase.url)
+	}
+}